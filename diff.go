@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+
+	"github.com/Slach/clickhouse-flamegraph/pkg/flamegraph"
+	"github.com/urfave/cli/v3"
+)
+
+func diffCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "diff",
+		Usage: "render differential flamegraph between baseline (--base-*) and comparison (--date-from, --date-to, --query-ids) stacks, red frames grew, blue frames shrank, see https://www.brendangregg.com/blog/2014-11-09/differential-flame-graphs.html",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "base-date-from",
+				Aliases: []string{"base-from"},
+				Usage:   "baseline filter system.trace_log from date in any parsable format or time duration (from current time), the same as --date-from when empty",
+				Sources: cli.EnvVars("CH_FLAME_BASE_DATE_FROM"),
+			},
+			&cli.StringFlag{
+				Name:    "base-date-to",
+				Aliases: []string{"base-to"},
+				Usage:   "baseline filter system.trace_log to date in any parsable format or time duration (from current time), the same as --date-to when empty",
+				Sources: cli.EnvVars("CH_FLAME_BASE_DATE_TO"),
+			},
+			&cli.StringSliceFlag{
+				Name:    "base-query-ids",
+				Aliases: []string{"base-query-id"},
+				Usage:   "baseline filter system.query_log by query_id field, comma separated list, the same as --query-ids when empty",
+				Sources: cli.EnvVars("CH_FLAME_BASE_QUERY_IDS"),
+			},
+			&cli.BoolFlag{
+				Name:    "diff-normalize",
+				Usage:   "scale baseline values to comparison total for each host and trace_type, useful when time windows have different length, the same as difffolded.pl -n",
+				Sources: cli.EnvVars("CH_FLAME_DIFF_NORMALIZE"),
+			},
+		},
+		Action: diff,
+	}
+}
+
+func diff(ctx context.Context, c *cli.Command) error {
+	opts, err := optionsFromCLI(c)
+	if err != nil {
+		return err
+	}
+	base := opts.Filter
+	if len(c.StringSlice("base-query-ids")) > 0 {
+		base.QueryIds = c.StringSlice("base-query-ids")
+	}
+	if c.String("base-date-from") != "" {
+		if base.DateFrom, err = parseDate(c, "base-date-from"); err != nil {
+			return err
+		}
+	}
+	if c.String("base-date-to") != "" {
+		if base.DateTo, err = parseDate(c, "base-date-to"); err != nil {
+			return err
+		}
+	}
+	g, err := flamegraph.NewGenerator(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	return g.Diff(ctx, base, c.Bool("diff-normalize"))
+}
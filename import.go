@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+
+	"github.com/Slach/clickhouse-flamegraph/pkg/flamegraph"
+	"github.com/urfave/cli/v3"
+)
+
+func importCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "import",
+		Usage: "render flamegraphs from system.trace_log and system.query_log files exported via SELECT * INTO OUTFILE, without ClickHouse connection, all rows used when --date-from and --date-to are not set",
+		Flags: []cli.Flag{
+			&cli.StringSliceFlag{
+				Name:     "trace-log",
+				Usage:    "system.trace_log export file, comma separated list, file name without extension used as hostname when hostname column doesn't exist",
+				Sources:  cli.EnvVars("CH_FLAME_IMPORT_TRACE_LOG"),
+				Required: true,
+			},
+			&cli.StringSliceFlag{
+				Name:    "query-log",
+				Usage:   "system.query_log export file, comma separated list, required for .sql files and query_log filters",
+				Sources: cli.EnvVars("CH_FLAME_IMPORT_QUERY_LOG"),
+			},
+			&cli.StringFlag{
+				Name:    "input-format",
+				Usage:   "format of exported files, accept values: TSVWithNames, JSONEachRow, Native, Parquet, detected by file extension when empty",
+				Sources: cli.EnvVars("CH_FLAME_IMPORT_INPUT_FORMAT"),
+			},
+		},
+		Action: importDump,
+	}
+}
+
+func importDump(ctx context.Context, c *cli.Command) error {
+	opts, err := optionsFromCLI(c)
+	if err != nil {
+		return err
+	}
+	g, err := flamegraph.NewImportGenerator(opts, flamegraph.ImportOptions{
+		TraceLogFiles: c.StringSlice("trace-log"),
+		QueryLogFiles: c.StringSlice("query-log"),
+		InputFormat:   c.String("input-format"),
+	})
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	return g.Generate(ctx)
+}
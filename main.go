@@ -2,21 +2,12 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
-	"database/sql"
-	"fmt"
 	stdlog "log"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"regexp"
 	"strconv"
-	"strings"
 	"time"
 
-	"github.com/araddon/dateparse"
-	"github.com/mailru/go-clickhouse/v2"
+	"github.com/Slach/clickhouse-flamegraph/pkg/flamegraph"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -25,7 +16,14 @@ import (
 )
 
 func main() {
-	cmd := cli.Command{}
+	if err := newCommand().Run(context.Background(), os.Args); err != nil {
+		log.Fatal().Err(err).Msg("generation failed")
+	}
+}
+
+// newCommand return root command with global flags and subcommands
+func newCommand() *cli.Command {
+	cmd := &cli.Command{}
 	cmd.Name = "clickhouse-flamegraph"
 	cmd.Usage = "visualize clickhouse system.trace_log as flamegraph, based on https://gist.github.com/alexey-milovidov/92758583dd41c24c360fdb8d6a4da194"
 	cmd.ArgsUsage = ""
@@ -45,8 +43,8 @@ func main() {
 		&cli.StringFlag{
 			Name:    "flamegraph-script",
 			Sources: cli.EnvVars("CH_FLAME_FLAMEGRAPH_SCRIPT"),
-			Value:   "flamegraph.pl",
-			Usage:   "path to script which run SVG flamegraph generation, can be passed without full path, will try to find the script from $PATH",
+			Value:   "",
+			Usage:   "optional path to flamegraph.pl compatible script which run SVG flamegraph generation instead of built-in renderer, can be passed without full path, will try to find the script from $PATH",
 		},
 		&cli.StringFlag{
 			Name:    "output-dir",
@@ -58,16 +56,14 @@ func main() {
 		&cli.StringFlag{
 			Name:    "date-from",
 			Aliases: []string{"from"},
-			Usage:   "filter system.trace_log from date in any parsable format (see https://github.com/araddon/dateparse) or time duration (from current time)",
+			Usage:   "filter system.trace_log from date in any parsable format (see https://github.com/araddon/dateparse) or time duration (from current time), 5 minutes before --date-to when empty",
 			Sources: cli.EnvVars("CH_FLAME_DATE_FROM"),
-			Value:   time.Now().Add(time.Duration(-5) * time.Minute).Format("2006-01-02 15:04:05 -0700"),
 		},
 		&cli.StringFlag{
 			Name:    "date-to",
 			Aliases: []string{"to"},
-			Usage:   "filter system.trace_log to date in any parsable format or time duration (see https://github.com/araddon/dateparse) or time duration (from current time)",
+			Usage:   "filter system.trace_log to date in any parsable format or time duration (see https://github.com/araddon/dateparse) or time duration (from current time), current time when empty",
 			Sources: cli.EnvVars("CH_FLAME_DATE_TO"),
-			Value:   time.Now().Format("2006-01-02 15:04:05 -0700"),
 		},
 		&cli.StringFlag{
 			Name:    "query-filter",
@@ -82,6 +78,56 @@ func main() {
 			Usage:   "filter system.query_log by query_id field, comma separated list",
 			Sources: cli.EnvVars("CH_FLAME_QUERY_IDS"),
 		},
+		&cli.StringSliceFlag{
+			Name:    "query-users",
+			Aliases: []string{"query-user"},
+			Usage:   "filter system.query_log by user or initial_user field, comma separated list",
+			Sources: cli.EnvVars("CH_FLAME_QUERY_USERS"),
+		},
+		&cli.StringSliceFlag{
+			Name:    "query-databases",
+			Aliases: []string{"query-database"},
+			Usage:   "filter system.query_log by any of databases field, comma separated list",
+			Sources: cli.EnvVars("CH_FLAME_QUERY_DATABASES"),
+		},
+		&cli.StringSliceFlag{
+			Name:    "query-tables",
+			Aliases: []string{"query-table"},
+			Usage:   "filter system.query_log by any of tables field, comma separated list in database.table format",
+			Sources: cli.EnvVars("CH_FLAME_QUERY_TABLES"),
+		},
+		&cli.StringSliceFlag{
+			Name:    "query-kinds",
+			Aliases: []string{"query-kind"},
+			Usage:   "filter system.query_log by query_kind field, comma separated list, for example Select,Insert, require ClickHouse 21.1+",
+			Sources: cli.EnvVars("CH_FLAME_QUERY_KINDS"),
+		},
+		&cli.Uint64Flag{
+			Name:    "min-query-duration-ms",
+			Usage:   "filter system.query_log by query_duration_ms field greater or equal",
+			Sources: cli.EnvVars("CH_FLAME_MIN_QUERY_DURATION_MS"),
+		},
+		&cli.Uint64Flag{
+			Name:    "min-memory-usage",
+			Usage:   "filter system.query_log by memory_usage field greater or equal, in bytes",
+			Sources: cli.EnvVars("CH_FLAME_MIN_MEMORY_USAGE"),
+		},
+		&cli.Uint64Flag{
+			Name:    "min-read-rows",
+			Usage:   "filter system.query_log by read_rows field greater or equal",
+			Sources: cli.EnvVars("CH_FLAME_MIN_READ_ROWS"),
+		},
+		&cli.Int64SliceFlag{
+			Name:    "exception-codes",
+			Aliases: []string{"exception-code"},
+			Usage:   "filter system.query_log by exception_code field, comma separated list, see https://github.com/ClickHouse/ClickHouse/blob/master/src/Common/ErrorCodes.cpp",
+			Sources: cli.EnvVars("CH_FLAME_EXCEPTION_CODES"),
+		},
+		&cli.StringFlag{
+			Name:    "log-comment",
+			Usage:   "filter system.query_log by log_comment field, require ClickHouse 21.3+",
+			Sources: cli.EnvVars("CH_FLAME_LOG_COMMENT"),
+		},
 		&cli.StringSliceFlag{
 			Name:    "trace-types",
 			Aliases: []string{"trace-type"},
@@ -92,7 +138,7 @@ func main() {
 		&cli.StringFlag{
 			Name:    "clickhouse-dsn",
 			Aliases: []string{"dsn"},
-			Usage:   "clickhouse connection string, see https://github.com/mailru/go-clickhouse#dsn",
+			Usage:   "clickhouse connection string, http:// and https:// use HTTP protocol, see https://github.com/mailru/go-clickhouse#dsn, clickhouse:// and tcp:// use native protocol on port 9000 or 9440 with secure=true, see https://github.com/ClickHouse/clickhouse-go#dsn",
 			Sources: cli.EnvVars("CH_FLAME_CLICKHOUSE_DSN"),
 			Value:   "http://localhost:8123/default",
 		},
@@ -105,29 +151,120 @@ func main() {
 		},
 		&cli.StringFlag{
 			Name:    "tls-certificate",
-			Usage:   "X509 *.cer, *.crt or *.pem file for https connection, use only if tls_config exists in --dsn, see https://clickhouse.com/docs/en/operations/server-configuration-parameters/settings/#server_configuration_parameters-openssl for details",
+			Usage:   "X509 *.cer, *.crt or *.pem file for https connection, use only if tls_config exists in http --dsn or secure=true in native --dsn, see https://clickhouse.com/docs/en/operations/server-configuration-parameters/settings/#server_configuration_parameters-openssl for details",
 			Sources: cli.EnvVars("CH_FLAME_TLS_CERT"),
 			Value:   "",
 		},
 		&cli.StringFlag{
 			Name:    "tls-key",
-			Usage:   "X509 *.key file for https connection, use only if tls_config exists in --dsn",
+			Usage:   "X509 *.key file for https connection, use only if tls_config exists in http --dsn or secure=true in native --dsn",
 			Sources: cli.EnvVars("CH_FLAME_TLS_KEY"),
 			Value:   "",
 		},
 		&cli.StringFlag{
 			Name:    "tls-ca",
-			Usage:   "X509 *.cer, *.crt or *.pem file used with https connection for self-signed certificate, use only if tls_config exists in --dsn, see https://clickhouse.com/docs/en/operations/server-configuration-parameters/settings/#server_configuration_parameters-openssl for details",
+			Usage:   "X509 *.cer, *.crt or *.pem file used with https connection for self-signed certificate, use only if tls_config exists in http --dsn or secure=true in native --dsn, see https://clickhouse.com/docs/en/operations/server-configuration-parameters/settings/#server_configuration_parameters-openssl for details",
 			Sources: cli.EnvVars("CH_FLAME_TLS_CA"),
 			Value:   "",
 		},
 		&cli.StringFlag{
 			Name:    "output-format",
 			Aliases: []string{"format"},
-			Usage:   "accept values: svg, txt (see https://github.com/brendangregg/FlameGraph#2-fold-stacks), json (see https://github.com/spiermar/d3-flame-graph/#input-format, ",
+			Usage:   "accept values: svg, txt (see https://github.com/brendangregg/FlameGraph#2-fold-stacks), json (see https://github.com/spiermar/d3-flame-graph/#input-format), pprof (gzipped profile.proto, see https://github.com/google/pprof/blob/main/doc/README.md), speedscope (one file with all profiles, see https://www.speedscope.app/)",
 			Sources: cli.EnvVars("CH_FLAME_OUTPUT_FORMAT"),
 			Value:   "svg",
 		},
+		&cli.IntFlag{
+			Name:    "max-memory-stacks",
+			Usage:   "unique stacks count aggregated in memory before spill to temporary files, increase it when enough memory, decrease when clickhouse-flamegraph OOM killed",
+			Sources: cli.EnvVars("CH_FLAME_MAX_MEMORY_STACKS"),
+			Value:   flamegraph.DefaultMaxMemoryStacks,
+		},
+		&cli.IntFlag{
+			Name:    "parallelism",
+			Usage:   "count of profiles rendered concurrently while stacks for next profiles are fetched, 0 means count of CPU cores",
+			Sources: cli.EnvVars("CH_FLAME_PARALLELISM"),
+			Value:   0,
+		},
+		&cli.StringFlag{
+			Name:    "group-by",
+			Usage:   "accept values: query (one profile for each query_id), thread (one profile for each query_id and thread_id, global profiles split by thread name), thread-root (thread name and thread_id added as root frame), thread names resolved via system.query_thread_log when log_query_threads=1",
+			Sources: cli.EnvVars("CH_FLAME_GROUP_BY"),
+			Value:   "query",
+		},
+		&cli.DurationFlag{
+			Name:    "bucket",
+			Usage:   "split profiles into time buckets via toStartOfInterval(event_time), for example 1m, one profile for each bucket written as queryId.YYYYMMDDThhmmssZ.traceType.*, output-dir/buckets.csv contains total for each bucket",
+			Sources: cli.EnvVars("CH_FLAME_BUCKET"),
+		},
+		&cli.BoolFlag{
+			Name:    "leaks",
+			Usage:   "pair Memory and MemorySample allocations with frees by system.trace_log ptr column, Memory trace types split into traceTypeAllocated, traceTypeFreed and traceTypeLeaked profiles, Leaked contains only bytes not freed before date-to, requires newer ClickHouse server with ptr column, memory_profiler_sample_probability > 0 for MemorySample",
+			Sources: cli.EnvVars("CH_FLAME_LEAKS"),
+		},
+		&cli.StringFlag{
+			Name:    "focus",
+			Usage:   "regexp, keep only stacks which contain matched frame, the same as pprof -focus, see https://github.com/google/re2/wiki/Syntax",
+			Sources: cli.EnvVars("CH_FLAME_FOCUS"),
+		},
+		&cli.StringFlag{
+			Name:    "ignore",
+			Usage:   "regexp, drop stacks which contain matched frame, the same as pprof -ignore",
+			Sources: cli.EnvVars("CH_FLAME_IGNORE"),
+		},
+		&cli.StringFlag{
+			Name:    "hide",
+			Usage:   "regexp, remove matched frames from stacks, for example 'ThreadPool|std::__1::', the same as pprof -hide",
+			Sources: cli.EnvVars("CH_FLAME_HIDE"),
+		},
+		&cli.StringFlag{
+			Name:    "prune-from",
+			Usage:   "regexp, drop frames called from matched frame, the same as pprof -prune_from",
+			Sources: cli.EnvVars("CH_FLAME_PRUNE_FROM"),
+		},
+		&cli.BoolFlag{
+			Name:    "invert",
+			Usage:   "reverse stacks before rendering, leaf functions like memcpy become root frames after trace_type frame, so time spent in function summed regardless of callers, not supported for pprof output-format",
+			Sources: cli.EnvVars("CH_FLAME_INVERT"),
+		},
+		&cli.IntFlag{
+			Name:    "top",
+			Usage:   "write .sql and flamegraph files only for N queries ranked by --rank-by, global flamegraphs still contain all queries, 0 means all queries",
+			Sources: cli.EnvVars("CH_FLAME_TOP"),
+			Value:   0,
+		},
+		&cli.StringFlag{
+			Name:    "rank-by",
+			Usage:   "used with --top, accept values: cpu (CPU samples count), real (Real samples count), memory (allocated and freed bytes from Memory and MemorySample)",
+			Sources: cli.EnvVars("CH_FLAME_RANK_BY"),
+			Value:   "cpu",
+		},
+		&cli.BoolFlag{
+			Name:    "client-symbolize",
+			Usage:   "fetch raw addresses from system.trace_log and resolve only unique addresses, instead of run addressToSymbol and addressToLine for every frame of every stack, resolved addresses stored into --symbol-cache-dir",
+			Sources: cli.EnvVars("CH_FLAME_CLIENT_SYMBOLIZE"),
+		},
+		&cli.StringFlag{
+			Name:    "symbol-cache-dir",
+			Usage:   "directory for resolved addresses cache, one file for each ClickHouse server build_id and version",
+			Sources: cli.EnvVars("CH_FLAME_SYMBOL_CACHE_DIR"),
+			Value:   flamegraph.DefaultSymbolCacheDir(),
+		},
+		&cli.StringFlag{
+			Name:    "symbols-binary",
+			Usage:   "local clickhouse binary with the same build_id as server, raw addresses resolved via ELF symbols and DWARF line tables, allow_introspection_functions is not required on server",
+			Sources: cli.EnvVars("CH_FLAME_SYMBOLS_BINARY"),
+		},
+		&cli.StringFlag{
+			Name:    "symbols-base-address",
+			Usage:   "load address for PIE --symbols-binary, for example 0x55d4a8a00000, detected automatically when empty",
+			Sources: cli.EnvVars("CH_FLAME_SYMBOLS_BASE_ADDRESS"),
+		},
+		&cli.StringFlag{
+			Name:    "state-file",
+			Usage:   "JSON file with last processed event_time_microseconds for each host, next run fetch only newer samples for known hosts instead of --date-from and merge them into existing folded files in --output-dir, for cumulative profiles from cron",
+			Sources: cli.EnvVars("CH_FLAME_STATE_FILE"),
+		},
 		&cli.BoolFlag{
 			Name:    "normalize-query",
 			Aliases: []string{"normalize"},
@@ -145,44 +282,33 @@ func main() {
 			Usage:   "output logs to console format instead of json",
 			Sources: cli.EnvVars("CH_FLAME_LOG_TO_CONSOLE"),
 		},
+		&cli.StringFlag{
+			Name:    "config",
+			Usage:   "YAML or TOML file with named profiles, each profile contains flag names as keys, for example dsn, cluster, tls-ca, trace-types, output-format, command line and env have priority over profile",
+			Sources: cli.EnvVars("CH_FLAME_CONFIG"),
+		},
+		&cli.StringFlag{
+			Name:    "profile",
+			Usage:   "profile name from --config, default-profile from --config when empty",
+			Sources: cli.EnvVars("CH_FLAME_PROFILE"),
+		},
 	}
 
+	cmd.Before = setupConfig
 	cmd.Action = run
-	if err := cmd.Run(context.Background(), os.Args); err != nil {
-		log.Fatal().Err(err).Msg("generation failed")
+	cmd.Commands = []*cli.Command{
+		diffCommand(),
+		serveCommand(),
+		importCommand(),
+		watchCommand(),
 	}
+	for _, subcommand := range cmd.Commands {
+		subcommand.Before = applySubcommandConfig
+	}
+	return cmd
 }
 
-var (
-	queryIdSQLTemplate = `
-SELECT DISTINCT hostName() AS host_name, {queryField}, {queryIdField} 
-FROM {from}
-WHERE {where}
-`
-
-	traceSQLTemplate = `
-SELECT 
-	hostName() AS host_name,
-    {queryIdField},
-	trace_type,
-	sum(abs(size)) AS total_size,
-	count() AS samples, 
-	concat(
-		multiIf( 
-			position( toString(trace_type), 'Memory') > 0 AND sum(size) >= 0, 'allocate;',
-			position( toString(trace_type), 'Memory') > 0 AND sum(size) < 0, 'free;',
-			concat( toString(trace_type), ';')
-		),
-		arrayStringConcat(arrayReverse(arrayMap(x -> concat( demangle(addressToSymbol(x)), '#', addressToLine(x) ), trace)), ';')
-	) AS stack
-FROM {from}
-WHERE {where}
-GROUP BY host_name, query_id, trace_type, trace
-SETTINGS allow_introspection_functions=1
-`
-)
-
-func run(_ context.Context, c *cli.Command) error {
+func setupLogs(ctx context.Context, c *cli.Command) (context.Context, error) {
 	stdlog.SetOutput(log.Logger)
 	zerolog.ErrorStackMarshaler = pkgerrors.MarshalStack
 	if c.Bool("verbose") {
@@ -194,435 +320,94 @@ func run(_ context.Context, c *cli.Command) error {
 	if c.Bool("console") {
 		log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout})
 	}
-
-	return generate(c)
-}
-
-func parseDate(c *cli.Command, dateValue string, serverTimezone *time.Location) time.Time {
-	var parsedDate time.Time
-	var err error
-	if parsedDate, err = dateparse.ParseAny(c.String(dateValue)); err != nil {
-		if duration, err := time.ParseDuration(c.String(dateValue)); err != nil {
-			log.Fatal().Err(err).Msgf("invalid %s parameter = %s", dateValue, c.String(dateValue))
-		} else {
-			parsedDate = time.Now().Add(-duration)
-		}
-	}
-	return parsedDate.In(serverTimezone)
-}
-
-func prepareTLSConfig(dsn string, c *cli.Command) {
-	if strings.Contains(dsn, "tls_config") {
-		cfg, err := clickhouse.ParseDSN(dsn)
-		if err != nil {
-			log.Fatal().Stack().Err(errors.Wrap(err, "")).Send()
-		}
-		tlsConfig := &tls.Config{}
-		if c.String("tls-ca") != "" {
-			CA := x509.NewCertPool()
-			severCert, err := os.ReadFile(c.String("tls-ca"))
-			if err != nil {
-				log.Fatal().Stack().Err(errors.Wrap(err, "")).
-					Str("tls-ca", c.String("tls-ca")).
-					Str("tls-certificate", c.String("tls-certificate")).
-					Str("tls-key", c.String("tls-key")).
-					Send()
-			}
-			CA.AppendCertsFromPEM(severCert)
-			tlsConfig.RootCAs = CA
-		}
-		if c.String("tls-certificate") != "" {
-			cert, err := tls.LoadX509KeyPair(c.String("tls-certificate"), c.String("tls-key"))
-			if err != nil {
-				log.Fatal().Stack().Err(errors.Wrap(err, "")).
-					Str("tls-ca", c.String("tls-ca")).
-					Str("tls-certificate", c.String("tls-certificate")).
-					Str("tls-key", c.String("tls-key")).
-					Send()
-			}
-			tlsConfig.Certificates = []tls.Certificate{cert}
-		}
-		if err := clickhouse.RegisterTLSConfig(cfg.TLSConfig, tlsConfig); err != nil {
-			log.Fatal().Stack().Err(errors.Wrap(err, "")).Send()
-		}
-	}
-}
-
-func generate(c *cli.Command) error {
-	queryFilter := c.String("query-filter")
-	queryIds := c.StringSlice("query-ids")
-	traceTypes := c.StringSlice("trace-types")
-	if len(traceTypes) == 0 {
-		traceTypes = []string{"Real", "CPU", "Memory", "MemorySample"}
-	}
-	dsn := c.String("dsn")
-
-	prepareTLSConfig(dsn, c)
-
-	db := openDbConnection(dsn)
-	checkClickHouseVersion(c, db)
-	serverTimeZone := getServerTimeZone(db)
-	dateFrom := parseDate(c, "date-from", serverTimeZone)
-	dateTo := parseDate(c, "date-to", serverTimeZone)
-	flushSystemLog(db)
-
-	createOutputDir(c)
-	// stackFiles format = outputDir/hostname/queryId.traceType.outExtension -> stackFile descriptor
-	stackFiles := make(map[string]*os.File, 256)
-	stackWhere := " trace_type IN ('" + strings.Join(traceTypes, "','") + "') AND event_time >= ? AND event_time <= ?"
-	stackArgs := []interface{}{dateFrom, dateTo}
-	stackWhere, stackArgs = applyQueryFilter(db, c, queryFilter, queryIds, dateFrom, dateTo, stackWhere, stackArgs)
-
-	var queryIdField string
-	if c.Bool("normalize-query") {
-		queryIdField = "toString(normalizedQueryHash(q.query)) AS query_id"
-	} else {
-		queryIdField = "replaceAll(t.query_id,':','_') AS query_id"
-	}
-
-	var traceFrom string
-	if c.String("clickhouse-cluster") != "" {
-		traceFrom = "clusterAllReplicas('" + c.String("clickhouse-cluster") + "', system.trace_log) AS t"
-		traceFrom += " ANY LEFT JOIN (SELECT query_id, query, '" + traceTypes[0] + "' AS trace_type FROM clusterAllReplicas('" + c.String("clickhouse-cluster") + "', system.query_log) WHERE {where}) AS q"
-		traceFrom += " ON q.query_id=t.query_id"
-	} else {
-		traceFrom = "system.trace_log AS t ANY LEFT JOIN (SELECT query_id, query, '" + traceTypes[0] + "' AS trace_type FROM system.query_log WHERE {where} ) AS q ON q.query_id=t.query_id"
-	}
-
-	stackSQL := formatSQLTemplate(traceSQLTemplate, map[string]interface{}{
-		"where":        stackWhere,
-		"from":         traceFrom,
-		"queryIdField": queryIdField,
-	})
-	stackArgs = append(stackArgs, stackArgs...)
-	stackSQL = formatSQLTemplate(stackSQL, map[string]interface{}{
-		"where": stackWhere,
-	})
-	fetchQuery(db, stackSQL, stackArgs, func(r map[string]interface{}) error {
-		fetchStack := func(hostName, queryId, stack, traceType string, totalSize, samples uint64) {
-			stackFile := filepath.Join(c.String("output-dir"), hostName, queryId+"."+traceType)
-			if c.String("output-format") == "json" {
-				stackFile += ".json"
-			} else {
-				stackFile += ".txt"
-			}
-			if _, exists := stackFiles[stackFile]; !exists {
-				if f, err := os.Create(stackFile); err != nil {
-					log.Fatal().Stack().Err(errors.Wrap(err, "")).Str("stackFile", stackFile).Send()
-				} else {
-					stackFiles[stackFile] = f
-				}
-				if c.String("output-format") == "json" {
-					if _, err := stackFiles[stackFile].WriteString("[\n"); err != nil {
-						log.Fatal().Stack().Err(errors.Wrap(err, "")).Send()
-					}
-				}
-			}
-			outputFormat := "%s %d\n"
-			if c.String("output-format") == "json" {
-				outputFormat = " {\"stack\":\"%s\", \"Value\": %d},\n"
-			}
-			if strings.Contains(traceType, "Memory") {
-				if _, err := stackFiles[stackFile].WriteString(fmt.Sprintf(outputFormat, stack, totalSize)); err != nil {
-					log.Fatal().Stack().Err(errors.Wrap(err, "")).Send()
-				}
-			} else {
-				if _, err := stackFiles[stackFile].WriteString(fmt.Sprintf(outputFormat, stack, samples)); err != nil {
-					log.Fatal().Stack().Err(errors.Wrap(err, "")).Send()
-				}
-			}
-
-		}
-
-		hostName := r["host_name"].(string)
-		queryId := r["query_id"].(string)
-		stack := r["stack"].(string)
-		traceType := r["trace_type"].(string)
-		totalSize := r["total_size"].(uint64)
-		samples := r["samples"].(uint64)
-
-		if queryId != "" {
-			fetchStack(hostName, queryId, stack, traceType, totalSize, samples)
-		}
-		fetchStack(hostName, "global", stack, traceType, totalSize, samples)
-		return nil
-	})
-
-	for stackKey, stackFile := range stackFiles {
-		fileName := strings.Split(filepath.Base(stackKey), ".")
-		queryId := fileName[0]
-		traceType := fileName[1]
-		pathItems := strings.Split(filepath.Dir(stackKey), string(filepath.Separator))
-		hostName := ""
-		if len(pathItems) > 1 {
-			hostName = strings.Split(filepath.Dir(stackKey), string(filepath.Separator))[1]
-		} else {
-			hostName = strings.Split(filepath.Dir(stackKey), string(filepath.Separator))[0]
-		}
-
-		if c.String("output-format") == "json" {
-			if _, err := stackFile.WriteString("{}]\n"); err != nil {
-				log.Fatal().Stack().Err(errors.Wrap(err, "")).Send()
-			}
-		}
-		if err := stackFile.Close(); err != nil {
-			log.Fatal().Stack().Err(err).Str("stackFile", stackFile.Name()).Send()
-		}
-		if c.String("output-format") == "svg" {
-			writeSVG(c, hostName, queryId, traceType, stackFile.Name())
-		}
-	}
-	log.Info().Int("processedFiles", len(stackFiles)).Msg("done processing")
-	return nil
+	return ctx, nil
 }
 
-func createOutputDir(c *cli.Command) {
-	// create output-dir if not exits
-	if _, err := os.Stat(c.String("output-dir")); os.IsNotExist(err) {
-		if err := os.MkdirAll(c.String("output-dir"), 0755); err != nil {
-			log.Fatal().Err(err).Str("output-dir", c.String("output-dir")).Msg("Failed create output-dir")
-		}
-	}
-}
-
-func flushSystemLog(db *sql.DB) {
-	if _, err := db.Exec("SYSTEM FLUSH LOGS"); err != nil {
-		log.Fatal().Stack().Err(errors.Wrap(err, "")).Msg("SYSTEM FLUSH LOGS failed")
-	}
-}
-
-func parseClickhouseVersion(versionStr string) ([]int, error) {
-	split := strings.Split(versionStr, ".")
-	if len(split) < 2 {
-		return nil, fmt.Errorf("can't parse clickhouse version: '%s'", versionStr)
-	}
-	version := make([]int, len(split))
-	var err error
-	for i := range split {
-		if version[i], err = strconv.Atoi(split[i]); err != nil {
-			break
-		}
-	}
-	return version, err
-}
-
-func checkClickHouseVersion(c *cli.Command, db *sql.DB) {
-	fetchQuery(db, "SELECT version() AS version", nil, func(r map[string]interface{}) error {
-		version, err := parseClickhouseVersion(r["version"].(string))
-		if err != nil {
-			log.Fatal().Str("version", r["version"].(string)).Err(err)
-		}
-		if (version[0] == 20 && version[1] < 6) && c.Bool("normalize-query") {
-			log.Fatal().Str("version", r["version"].(string)).Msg("normalize-query require ClickHouse server version 20.6+")
-		}
-		if version[0] < 20 || (version[0] == 20 && version[1] < 5) {
-			log.Fatal().Str("version", r["version"].(string)).Msg("system.trace_log with trace_type require ClickHouse server version 20.5+")
-		}
-		return nil
-	})
-}
-
-func getServerTimeZone(db *sql.DB) *time.Location {
-	var serverTimeZone *time.Location
-	var err error
-	fetchQuery(db, "SELECT timezone() AS timezone", nil, func(r map[string]interface{}) error {
-		serverTimeZone, err = time.LoadLocation(r["timezone"].(string))
-		if err != nil {
-			log.Fatal().Str("location", r["timezone"].(string)).Msg("Unknown clickhouse timezone")
-		}
-		return nil
-	})
-	return serverTimeZone
-}
-func openDbConnection(dsn string) *sql.DB {
-	db, err := sql.Open("chhttp", dsn)
+func run(ctx context.Context, c *cli.Command) error {
+	opts, err := optionsFromCLI(c)
 	if err != nil {
-		log.Fatal().Str("dsn", dsn).Err(err).Msg("Can't establishment ClickHouse connection")
-	} else {
-		log.Info().Str("dsn", dsn).Msg("connected to ClickHouse")
-	}
-	return db
-}
-
-func addWhereArgs(where, addWhere string, args []interface{}, addArg interface{}) (string, []interface{}) {
-	where += addWhere
-	if addArg != nil {
-		args = append(args, addArg)
-	}
-	return where, args
-}
-
-func applyQueryFilter(db *sql.DB, c *cli.Command, queryFilter string, queryIds []string, dateFrom time.Time, dateTo time.Time, stackWhere string, stackArgs []interface{}) (string, []interface{}) {
-	var queryIdSQL string
-	var queryIdWhere, queryLogTable string
-	var queryField, queryIdField string
-	var queryIdArgs []interface{}
-
-	queryIdWhere = "event_time >= ? AND event_time <= ?"
-	queryIdArgs = []interface{}{dateFrom, dateTo}
-
-	if c.String("clickhouse-cluster") != "" {
-		queryLogTable = "clusterAllReplicas('" + c.String("clickhouse-cluster") + "', system.query_log) AS q"
-	} else {
-		queryLogTable = "system.query_log AS q"
-	}
-
-	if c.Bool("normalize-query") {
-		queryField = "normalizeQuery(q.query) AS query"
-		queryIdField = "toString(normalizedQueryHash(q.query)) AS query_id"
-	} else {
-		queryField = "q.query"
-		queryIdField = "q.query_id"
-	}
-
-	if queryFilter != "" {
-		if _, err := regexp.Compile(queryFilter); err != nil {
-			log.Fatal().Err(err).Str("queryFilter", queryFilter).Msg("Invalid regexp")
-		}
-		queryIdWhere, queryIdArgs = addWhereArgs(queryIdWhere, " AND match(query, ?) ", queryIdArgs, queryFilter)
-		stackWhere, stackArgs = addWhereArgs(stackWhere, " AND match(query, ?) ", stackArgs, queryFilter)
-	}
-	if len(queryIds) != 0 {
-		queryIdWhere, queryIdArgs = addWhereArgs(queryIdWhere, " AND query_id IN ('"+strings.Join(queryIds, "','")+"') ", queryIdArgs, nil)
-		stackWhere, stackArgs = addWhereArgs(stackWhere, " AND query_id IN ('"+strings.Join(queryIds, "','")+"') ", stackArgs, nil)
+		return err
 	}
-
-	queryIdSQL = formatSQLTemplate(
-		queryIdSQLTemplate,
-		map[string]interface{}{
-			"where":        queryIdWhere,
-			"from":         queryLogTable,
-			"queryField":   queryField,
-			"queryIdField": queryIdField,
-		},
-	)
-
-	if queryIdSQL != "" {
-		sqlFiles := 0
-		fetchQuery(db, queryIdSQL, queryIdArgs, func(r map[string]interface{}) error {
-			if err := os.MkdirAll(filepath.Join(c.String("output-dir"), r["host_name"].(string)), 0755); err != nil {
-				log.Fatal().Stack().Err(errors.Wrap(err, "")).Str("sqlDir", filepath.Join(c.String("output-dir"), r["host_name"].(string))).Send()
-			}
-			sqlFile := filepath.Join(c.String("output-dir"), r["host_name"].(string), r["query_id"].(string)+".sql")
-			if err := os.WriteFile(sqlFile, []byte(r["query"].(string)), 0644); err != nil {
-				log.Fatal().Stack().Err(errors.Wrap(err, "")).Str("sqlFile", sqlFile).Send()
-			}
-			sqlFiles++
-			return nil
-		})
-		log.Info().Int("sqlFiles", sqlFiles).Msg("write .sql files")
-	}
-	return stackWhere, stackArgs
-}
-
-func findFlameGraphScript(c *cli.Command) string {
-	script := c.String("flamegraph-script")
-	if script != "" {
-		log.Debug().Msgf("set flamegraph-script: %s", script)
-		if _, err := os.Stat(script); err == nil {
-			return script
-		}
-
-		var err error
-		if script, err = exec.LookPath(script); err != nil {
-			log.Fatal().Msgf("%s is not found in $PATH", script)
-		}
+	g, err := flamegraph.NewGenerator(ctx, opts)
+	if err != nil {
+		return err
 	}
-	return script
+	defer g.Close()
+	return g.Generate(ctx)
 }
 
-func writeSVG(c *cli.Command, hostName, queryId, traceType, stackName string) {
-	title := fmt.Sprintf("hostName %s queryId %s (%s) from %s to %s", hostName, queryId, traceType, c.String("date-from"), c.String("date-to"))
-	countName := "samples"
-	if strings.Contains(traceType, "Memory") {
-		countName = "bytes"
-	}
-	args := []string{
-		"--title", title,
-		"--width", fmt.Sprintf("%d", c.Int("width")),
-		"--height", fmt.Sprintf("%d", c.Int("height")),
-		"--countname", countName,
-		"--nametype", traceType,
-		//"--colors", "aqua",
-	}
-	stackFile, err := os.Open(stackName)
+// optionsFromCLI convert global flags into flamegraph.Options
+func optionsFromCLI(c *cli.Command) (flamegraph.Options, error) {
+	dateFrom, err := parseDate(c, "date-from")
 	if err != nil {
-		log.Fatal().Stack().Err(errors.Wrap(err, "")).Str("stackName", stackName).Send()
+		return flamegraph.Options{}, err
 	}
-	script := findFlameGraphScript(c)
-	log.Debug().Str("script", script).Str("stdin", stackFile.Name()).Strs("args", args).Send()
-	cmd := exec.Command(script, args...)
-	cmd.Stdin = stackFile
-	cmd.Stderr = os.Stderr
-
-	svg, err := cmd.Output()
+	dateTo, err := parseDate(c, "date-to")
 	if err != nil {
-		log.Fatal().Msgf("writeSVG: failed to run script %s : %s", script, err)
-	}
-
-	fileName := filepath.Join(c.String("output-dir"), hostName, queryId+"."+traceType+".svg")
-	if err := os.WriteFile(fileName, svg, 0644); err != nil {
-		log.Fatal().Err(err).Str("fileName", fileName).Msg("can't write to svg")
-	}
-	if err := stackFile.Close(); err != nil {
-		log.Fatal().Stack().Err(errors.Wrap(err, "")).Str("stackName", stackName).Send()
+		return flamegraph.Options{}, err
 	}
-}
-
-// formatSQLTemplate use simple {key_from_context} template syntax
-func formatSQLTemplate(sqlTemplate string, context map[string]interface{}) string {
-	args, i := make([]string, len(context)*2), 0
-	for k, v := range context {
-		args[i] = "{" + k + "}"
-		args[i+1] = fmt.Sprint(v)
-		i += 2
+	var symbolsBaseAddress uint64
+	if v := c.String("symbols-base-address"); v != "" {
+		if symbolsBaseAddress, err = strconv.ParseUint(v, 0, 64); err != nil {
+			return flamegraph.Options{}, errors.Wrapf(err, "invalid symbols-base-address parameter = %s", v)
+		}
 	}
-	return strings.NewReplacer(args...).Replace(sqlTemplate)
+	return flamegraph.Options{
+		DSN:            c.String("dsn"),
+		TLSCertificate: c.String("tls-certificate"),
+		TLSKey:         c.String("tls-key"),
+		TLSCA:          c.String("tls-ca"),
+		Filter: flamegraph.Filter{
+			DateFrom:           dateFrom,
+			DateTo:             dateTo,
+			QueryFilter:        c.String("query-filter"),
+			QueryIds:           c.StringSlice("query-ids"),
+			TraceTypes:         c.StringSlice("trace-types"),
+			Users:              c.StringSlice("query-users"),
+			Databases:          c.StringSlice("query-databases"),
+			Tables:             c.StringSlice("query-tables"),
+			QueryKinds:         c.StringSlice("query-kinds"),
+			MinQueryDurationMs: c.Uint64("min-query-duration-ms"),
+			MinMemoryUsage:     c.Uint64("min-memory-usage"),
+			MinReadRows:        c.Uint64("min-read-rows"),
+			ExceptionCodes:     c.Int64Slice("exception-codes"),
+			LogComment:         c.String("log-comment"),
+			Cluster:            c.String("clickhouse-cluster"),
+			NormalizeQuery:     c.Bool("normalize-query"),
+			GroupBy:            c.String("group-by"),
+			Bucket:             c.Duration("bucket"),
+			Leaks:              c.Bool("leaks"),
+		},
+		OutputDir:          c.String("output-dir"),
+		OutputFormat:       c.String("output-format"),
+		Width:              c.Int("width"),
+		Height:             c.Int("height"),
+		MaxMemoryStacks:    c.Int("max-memory-stacks"),
+		Parallelism:        c.Int("parallelism"),
+		Focus:              c.String("focus"),
+		Ignore:             c.String("ignore"),
+		Hide:               c.String("hide"),
+		PruneFrom:          c.String("prune-from"),
+		Invert:             c.Bool("invert"),
+		Top:                c.Int("top"),
+		RankBy:             c.String("rank-by"),
+		ClientSymbolize:    c.Bool("client-symbolize"),
+		SymbolCacheDir:     c.String("symbol-cache-dir"),
+		SymbolsBinary:      c.String("symbols-binary"),
+		SymbolsBaseAddress: symbolsBaseAddress,
+		StateFile:          c.String("state-file"),
+		FlameGraphScript:   c.String("flamegraph-script"),
+	}, nil
 }
 
-// fetchRowAsMap see https://kylewbanks.com/blog/query-result-to-map-in-golang
-func fetchRowAsMap(rows *sql.Rows, cols []string) (m map[string]interface{}, err error) {
-	// Create a slice of interface{}'s to represent each column,
-	// and a second slice to contain pointers to each item in the columns slice.
-	columns := make([]interface{}, len(cols))
-	columnPointers := make([]interface{}, len(cols))
-	for i := range columns {
-		columnPointers[i] = &columns[i]
-	}
-
-	// Scan the result into the column pointers...
-	if err := rows.Scan(columnPointers...); err != nil {
-		return nil, err
-	}
-
-	// Create our map, and retrieve the value for each column from the pointers slice,
-	// storing it in the map with the name of the column as the key.
-	m = make(map[string]interface{}, len(cols))
-	for i, colName := range cols {
-		val := columnPointers[i].(*interface{})
-		m[colName] = *val
+// parseDate return zero time for empty value, so defaults computed when Generator created instead of flag definition time
+func parseDate(c *cli.Command, dateValue string) (time.Time, error) {
+	if c.String(dateValue) == "" {
+		return time.Time{}, nil
 	}
-	return m, nil
-}
-
-func fetchQuery(db *sql.DB, sql string, sqlArgs []interface{}, fetchCallback func(r map[string]interface{}) error) {
-	rows, err := db.Query(sql, sqlArgs...)
+	parsedDate, err := flamegraph.ParseDate(c.String(dateValue))
 	if err != nil {
-		log.Fatal().Stack().Err(errors.Wrap(err, "")).Str("sql", sql).Str("sqlArgs", fmt.Sprintf("%v", sqlArgs)).Send()
-	} else {
-		log.Debug().Str("sql", sql).Str("sqlArgs", fmt.Sprintf("%v", sqlArgs)).Msg("query OK")
-	}
-	cols, _ := rows.Columns()
-	for rows.Next() {
-		r, err := fetchRowAsMap(rows, cols)
-		if err != nil {
-			log.Fatal().Stack().Err(errors.Wrap(err, "")).Msg("fetch error")
-		}
-		if err := fetchCallback(r); err != nil {
-			log.Fatal().Stack().Err(errors.Wrap(err, "")).Msg("fetch error")
-		}
-	}
-	if err := rows.Close(); err != nil {
-		log.Fatal().Stack().Err(errors.Wrap(err, "")).Interface("rows", rows).Send()
+		return parsedDate, errors.Wrapf(err, "invalid %s parameter = %s", dateValue, c.String(dateValue))
 	}
+	return parsedDate, nil
 }
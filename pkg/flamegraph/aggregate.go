@@ -0,0 +1,321 @@
+package flamegraph
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// DefaultMaxMemoryStacks used when Options.MaxMemoryStacks is not set
+const DefaultMaxMemoryStacks = 1000000
+
+// profileKey identify one output profile, queryId is "global" for all queries on hostName, thread is not empty only for GroupByThread,
+// bucket is not empty only for Filter.Bucket
+type profileKey struct {
+	hostName  string
+	queryId   string
+	thread    string
+	traceType string
+	bucket    string
+}
+
+// fileName return hostName/queryId.traceType.ext, thread and bucket added before traceType when not empty
+func (k profileKey) fileName(ext string) string {
+	return filepath.Join(k.hostName, k.name(".")+"."+ext)
+}
+
+// name return queryId, thread, bucket and traceType joined with separator, empty parts skipped
+func (k profileKey) name(separator string) string {
+	parts := []string{k.queryId}
+	for _, part := range []string{k.thread, k.bucket} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(append(parts, k.traceType), separator)
+}
+
+func (k profileKey) less(other profileKey) bool {
+	if k.hostName != other.hostName {
+		return k.hostName < other.hostName
+	}
+	if k.queryId != other.queryId {
+		return k.queryId < other.queryId
+	}
+	if k.thread != other.thread {
+		return k.thread < other.thread
+	}
+	if k.bucket != other.bucket {
+		return k.bucket < other.bucket
+	}
+	return k.traceType < other.traceType
+}
+
+// stackAggregator sum values for the same stack in memory, when unique stacks count reach maxStacks,
+// all profiles spilled to disk as one file with sorted run for each profile and merged later during aggregatedProfile.writeFolded
+type stackAggregator struct {
+	maxStacks  int
+	size       int
+	stacks     map[profileKey]map[string]uint64
+	spillDir   string
+	spillCount int
+	spills     map[profileKey][]spillRun
+}
+
+// spillRun is sorted folded stacks of one profile stored in fileName from offset, size < 0 means till the end of file
+type spillRun struct {
+	fileName string
+	offset   int64
+	size     int64
+}
+
+func newStackAggregator(maxStacks int) *stackAggregator {
+	if maxStacks <= 0 {
+		maxStacks = DefaultMaxMemoryStacks
+	}
+	return &stackAggregator{
+		maxStacks: maxStacks,
+		stacks:    make(map[profileKey]map[string]uint64),
+		spills:    make(map[profileKey][]spillRun),
+	}
+}
+
+func (a *stackAggregator) add(key profileKey, stack string, value uint64) error {
+	profile, exists := a.stacks[key]
+	if !exists {
+		profile = make(map[string]uint64)
+		a.stacks[key] = profile
+	}
+	if _, exists := profile[stack]; !exists {
+		a.size++
+	}
+	profile[stack] += value
+	if a.size >= a.maxStacks {
+		return a.spill()
+	}
+	return nil
+}
+
+// spill write all in-memory profiles into one file, each profile as separate sorted run, and free memory,
+// so spill files count doesn't depend on profiles count
+func (a *stackAggregator) spill() error {
+	if a.spillDir == "" {
+		spillDir, err := os.MkdirTemp("", "clickhouse-flamegraph-")
+		if err != nil {
+			return errors.Wrap(err, "can't create spill directory")
+		}
+		a.spillDir = spillDir
+	}
+	keys := make([]profileKey, 0, len(a.stacks))
+	for key := range a.stacks {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].less(keys[j])
+	})
+	a.spillCount++
+	fileName := filepath.Join(a.spillDir, fmt.Sprintf("%d.txt", a.spillCount))
+	runs := make(map[profileKey]spillRun, len(keys))
+	if err := writeFile(fileName, func(w io.Writer) error {
+		cw := &countingWriter{w: w}
+		bw := bufio.NewWriter(cw)
+		for _, key := range keys {
+			if err := bw.Flush(); err != nil {
+				return errors.Wrap(err, "can't flush folded stacks")
+			}
+			offset := cw.n
+			if err := writeFoldedStacks(bw, a.stacks[key]); err != nil {
+				return err
+			}
+			runs[key] = spillRun{fileName: fileName, offset: offset, size: cw.n + int64(bw.Buffered()) - offset}
+		}
+		return errors.Wrap(bw.Flush(), "can't flush folded stacks")
+	}); err != nil {
+		return err
+	}
+	for key, run := range runs {
+		a.spills[key] = append(a.spills[key], run)
+	}
+	log.Debug().Int("stacks", a.size).Int("profiles", len(a.stacks)).Str("fileName", fileName).Msg("spill stacks to disk")
+	a.stacks = make(map[profileKey]map[string]uint64)
+	a.size = 0
+	return nil
+}
+
+// countingWriter count written bytes, used for spillRun offsets
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// keys return all profile keys sorted by hostName, queryId and traceType
+func (a *stackAggregator) keys() []profileKey {
+	keys := make([]profileKey, 0, len(a.stacks)+len(a.spills))
+	for key := range a.stacks {
+		keys = append(keys, key)
+	}
+	for key := range a.spills {
+		if _, exists := a.stacks[key]; !exists {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].less(keys[j])
+	})
+	return keys
+}
+
+// aggregatedProfile contains in-memory stacks and sorted spilled runs for one profile
+type aggregatedProfile struct {
+	stacks map[string]uint64
+	spills []spillRun
+}
+
+// take remove profile from aggregator, so it could be written concurrently with next add calls
+func (a *stackAggregator) take(key profileKey) *aggregatedProfile {
+	p := &aggregatedProfile{stacks: a.stacks[key], spills: a.spills[key]}
+	a.size -= len(p.stacks)
+	delete(a.stacks, key)
+	delete(a.spills, key)
+	return p
+}
+
+// writeFolded write merged stacks sorted by stack name in folded format
+func (p *aggregatedProfile) writeFolded(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	if len(p.spills) == 0 {
+		if err := writeFoldedStacks(bw, p.stacks); err != nil {
+			return err
+		}
+		return errors.Wrap(bw.Flush(), "can't flush folded stacks")
+	}
+
+	runs := make([]*foldedRun, 0, len(p.spills)+1)
+	defer func() {
+		for _, run := range runs {
+			_ = run.closer.Close()
+		}
+	}()
+	for _, spill := range p.spills {
+		f, err := os.Open(spill.fileName)
+		if err != nil {
+			return errors.Wrapf(err, "can't open %s", spill.fileName)
+		}
+		var r io.Reader = f
+		if spill.size >= 0 {
+			r = io.NewSectionReader(f, spill.offset, spill.size)
+		}
+		runs = append(runs, newFoldedRun(r, f))
+	}
+	if len(p.stacks) > 0 {
+		pr, pw := io.Pipe()
+		go func() {
+			_ = pw.CloseWithError(writeFoldedStacks(pw, p.stacks))
+		}()
+		runs = append(runs, newFoldedRun(pr, pr))
+	}
+	if err := mergeFoldedRuns(bw, runs); err != nil {
+		return err
+	}
+	return errors.Wrap(bw.Flush(), "can't flush folded stacks")
+}
+
+// close remove spilled files
+func (a *stackAggregator) close() error {
+	if a.spillDir == "" {
+		return nil
+	}
+	return errors.Wrapf(os.RemoveAll(a.spillDir), "can't remove %s", a.spillDir)
+}
+
+// foldedRun read folded stacks sorted by stack name
+type foldedRun struct {
+	scanner *bufio.Scanner
+	closer  io.Closer
+	stack   string
+	value   uint64
+}
+
+func newFoldedRun(r io.Reader, closer io.Closer) *foldedRun {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	return &foldedRun{scanner: scanner, closer: closer}
+}
+
+// next read next line, return false when run is finished
+func (r *foldedRun) next() (bool, error) {
+	for r.scanner.Scan() {
+		if strings.TrimSpace(r.scanner.Text()) == "" {
+			continue
+		}
+		stack, value, err := splitFoldedLine(r.scanner.Text())
+		if err != nil {
+			return false, err
+		}
+		r.stack, r.value = stack, value
+		return true, nil
+	}
+	return false, errors.Wrap(r.scanner.Err(), "can't read folded stacks")
+}
+
+type foldedRunHeap []*foldedRun
+
+func (h foldedRunHeap) Len() int            { return len(h) }
+func (h foldedRunHeap) Less(i, j int) bool  { return h[i].stack < h[j].stack }
+func (h foldedRunHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *foldedRunHeap) Push(x interface{}) { *h = append(*h, x.(*foldedRun)) }
+func (h *foldedRunHeap) Pop() interface{} {
+	old := *h
+	run := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return run
+}
+
+// mergeFoldedRuns k-way merge sorted runs, values for the same stack are summed
+func mergeFoldedRuns(w io.Writer, runs []*foldedRun) error {
+	h := make(foldedRunHeap, 0, len(runs))
+	for _, run := range runs {
+		ok, err := run.next()
+		if err != nil {
+			return err
+		}
+		if ok {
+			h = append(h, run)
+		}
+	}
+	heap.Init(&h)
+	for h.Len() > 0 {
+		stack, value := h[0].stack, uint64(0)
+		for h.Len() > 0 && h[0].stack == stack {
+			run := h[0]
+			value += run.value
+			ok, err := run.next()
+			if err != nil {
+				return err
+			}
+			if ok {
+				heap.Fix(&h, 0)
+			} else {
+				heap.Pop(&h)
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s %d\n", stack, value); err != nil {
+			return errors.Wrap(err, "can't write folded stacks")
+		}
+	}
+	return nil
+}
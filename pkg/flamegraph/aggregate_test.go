@@ -0,0 +1,225 @@
+package flamegraph
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFoldedLine(t *testing.T) {
+	testCases := []struct {
+		line    string
+		frames  []string
+		value   uint64
+		isError bool
+	}{
+		{line: "CPU;main;foo 10", frames: []string{"CPU", "main", "foo"}, value: 10},
+		{line: "  CPU;main 1\n", frames: []string{"CPU", "main"}, value: 1},
+		{line: "CPU;operator new (unsigned long) 3", frames: []string{"CPU", "operator new (unsigned long)"}, value: 3},
+		{line: "CPU;main", isError: true},
+		{line: " 10", isError: true},
+		{line: "CPU;main -1", isError: true},
+	}
+	for _, tc := range testCases {
+		frames, value, err := parseFoldedLine(tc.line)
+		if tc.isError != (err != nil) {
+			t.Errorf("%q unexpected error = %v", tc.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(frames, tc.frames) || value != tc.value {
+			t.Errorf("%q expected %v %d, got %v %d", tc.line, tc.frames, tc.value, frames, value)
+		}
+	}
+}
+
+func TestMergeFoldedRuns(t *testing.T) {
+	testCases := []struct {
+		name     string
+		runs     []string
+		expected string
+		isError  bool
+	}{
+		{name: "empty", runs: []string{"", "\n"}, expected: ""},
+		{name: "single", runs: []string{"a 1\nb 2\n"}, expected: "a 1\nb 2\n"},
+		{name: "duplicate keys", runs: []string{"a 1\nc 3\n", "a 2\nb 1\nc 1\n", "c 5\n"}, expected: "a 3\nb 1\nc 9\n"},
+		{name: "blank lines", runs: []string{"a 1\n\nb 1\n", "\nb 1\n"}, expected: "a 1\nb 2\n"},
+		{name: "spaces in frames", runs: []string{"a;f (int) 1\n", "a;f (int) 1\n"}, expected: "a;f (int) 2\n"},
+		{name: "invalid value", runs: []string{"a 1\n", "b x\n"}, isError: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			runs := make([]*foldedRun, len(tc.runs))
+			for i, run := range tc.runs {
+				runs[i] = newFoldedRun(strings.NewReader(run), io.NopCloser(nil))
+			}
+			var out bytes.Buffer
+			err := mergeFoldedRuns(&out, runs)
+			if tc.isError != (err != nil) {
+				t.Fatalf("unexpected error = %v", err)
+			}
+			if !tc.isError && out.String() != tc.expected {
+				t.Errorf("expected:\n%s\ngot:\n%s", tc.expected, out.String())
+			}
+		})
+	}
+}
+
+// TestStackAggregatorSpill check profiles written after spills are the same as profiles aggregated in memory
+func TestStackAggregatorSpill(t *testing.T) {
+	cpuKey, realKey := profileKey{hostName: "host1", queryId: "q1", traceType: "CPU"}, profileKey{hostName: "host1", queryId: "q1", traceType: "Real"}
+	adds := []struct {
+		key   profileKey
+		stack string
+		value uint64
+	}{
+		{cpuKey, "CPU;main;foo", 1},
+		{cpuKey, "CPU;main;bar", 2},
+		{realKey, "Real;main;foo", 1},
+		{cpuKey, "CPU;main;foo", 3},
+		{cpuKey, "CPU;main", 1},
+		{realKey, "Real;main;foo", 4},
+		{cpuKey, "CPU;main;bar", 1},
+	}
+	expected := map[profileKey]string{
+		cpuKey:  "CPU;main 1\nCPU;main;bar 3\nCPU;main;foo 4\n",
+		realKey: "Real;main;foo 5\n",
+	}
+	for _, maxStacks := range []int{1, 2, 3, 100} {
+		a := newStackAggregator(maxStacks)
+		for _, add := range adds {
+			if err := a.add(add.key, add.stack, add.value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if maxStacks < len(adds) && a.spillCount == 0 {
+			t.Errorf("maxStacks = %d expected spills", maxStacks)
+		}
+		if keys := a.keys(); !reflect.DeepEqual(keys, []profileKey{cpuKey, realKey}) {
+			t.Errorf("maxStacks = %d unexpected keys %v", maxStacks, keys)
+		}
+		for key, content := range expected {
+			var out bytes.Buffer
+			if err := a.take(key).writeFolded(&out); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != content {
+				t.Errorf("maxStacks = %d %s expected:\n%s\ngot:\n%s", maxStacks, key.traceType, content, out.String())
+			}
+		}
+		if err := a.close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestStackAggregatorSpillFiles check each spill write one file for all profiles, and each profile merged from its own runs
+func TestStackAggregatorSpillFiles(t *testing.T) {
+	const profiles, spills = 5, 4
+	a := newStackAggregator(profiles)
+	defer func() {
+		if err := a.close(); err != nil {
+			t.Fatal(err)
+		}
+	}()
+	keys := make([]profileKey, profiles)
+	for i := range keys {
+		keys[i] = profileKey{hostName: "host1", queryId: fmt.Sprintf("q%d", i), traceType: "CPU"}
+	}
+	// each spill contains one stack for each profile, last spill contains new stack of each profile
+	for spill := 0; spill < spills; spill++ {
+		for i, key := range keys {
+			stack := "CPU;main"
+			if spill == spills-1 {
+				stack = "CPU;main;foo"
+			}
+			if err := a.add(key, stack, uint64(i+1)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	fileNames, err := filepath.Glob(filepath.Join(a.spillDir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.spillCount != spills || len(fileNames) != spills {
+		t.Errorf("expected %d spill files, got spillCount = %d, files = %v", spills, a.spillCount, fileNames)
+	}
+	for i, key := range keys {
+		p := a.take(key)
+		if len(p.spills) != spills {
+			t.Errorf("%s expected %d runs, got %d", key.queryId, spills, len(p.spills))
+		}
+		var out bytes.Buffer
+		if err := p.writeFolded(&out); err != nil {
+			t.Fatal(err)
+		}
+		expected := fmt.Sprintf("CPU;main %d\nCPU;main;foo %d\n", (spills-1)*(i+1), i+1)
+		if out.String() != expected {
+			t.Errorf("%s expected:\n%s\ngot:\n%s", key.queryId, expected, out.String())
+		}
+	}
+}
+
+func TestMergeStackFile(t *testing.T) {
+	testCases := []struct {
+		name     string
+		existing string
+		stacks   map[string]uint64
+		expected string
+	}{
+		{name: "new file", stacks: map[string]uint64{"b": 1, "a": 2}, expected: "a 2\nb 1\n"},
+		{name: "duplicate keys", existing: "a 1\nc 2\n", stacks: map[string]uint64{"a": 2, "b": 1, "c": 3}, expected: "a 3\nb 1\nc 5\n"},
+		{name: "no new stacks", existing: "a 1\n", stacks: map[string]uint64{}, expected: "a 1\n"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			stackName := filepath.Join(t.TempDir(), "q1.CPU.txt")
+			if tc.existing != "" {
+				if err := os.WriteFile(stackName, []byte(tc.existing), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := mergeStackFile(stackName, &aggregatedProfile{stacks: tc.stacks}); err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(stackName + ".tmp")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tc.expected {
+				t.Errorf("expected:\n%s\ngot:\n%s", tc.expected, string(data))
+			}
+		})
+	}
+}
+
+// TestGenerateSpill check profiles submitted while rows are fetched are the same with spills and in memory
+func TestGenerateSpill(t *testing.T) {
+	traceLog := writeTestFile(t, "host1.tsv", testTraceLog)
+	for _, groupBy := range []string{GroupByQuery, GroupByThread, GroupByThreadRoot} {
+		t.Run(groupBy, func(t *testing.T) {
+			outputs := make([]map[string]string, 0, 2)
+			for _, maxMemoryStacks := range []int{1, 0} {
+				opts := Options{OutputDir: t.TempDir(), OutputFormat: "txt", MaxMemoryStacks: maxMemoryStacks}
+				opts.GroupBy = groupBy
+				g, err := NewImportGenerator(opts, ImportOptions{TraceLogFiles: []string{traceLog}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := g.Generate(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+				outputs = append(outputs, readOutputFiles(t, opts.OutputDir))
+			}
+			if !reflect.DeepEqual(outputs[0], outputs[1]) {
+				t.Errorf("spilled output:\n%v\nin-memory output:\n%v", outputs[0], outputs[1])
+			}
+		})
+	}
+}
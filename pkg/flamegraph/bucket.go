@@ -0,0 +1,85 @@
+package flamegraph
+
+import (
+	"encoding/csv"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// bucketLayout is time.Format layout for bucket start in profile file names, in UTC
+const bucketLayout = "20060102T150405Z"
+
+func validateBucket(bucket time.Duration) error {
+	if bucket < 0 || bucket%time.Second != 0 {
+		return errors.Errorf("invalid bucket = %s, shall be whole seconds", bucket)
+	}
+	return nil
+}
+
+// bucketName return bucket start formatted for profile file name, empty when buckets are not used
+func bucketName(bucket time.Duration, bucketStart time.Time) string {
+	if bucket <= 0 {
+		return ""
+	}
+	return bucketStart.UTC().Format(bucketLayout)
+}
+
+// bucketStart the same as toStartOfInterval(event_time, INTERVAL N SECOND), intervals aligned to unix epoch,
+// time.Truncate can't be used, because it aligns to zero time
+func bucketStart(eventTime time.Time, bucket time.Duration) time.Time {
+	seconds, unix := int64(bucket/time.Second), eventTime.Unix()
+	return time.Unix(unix-((unix%seconds)+seconds)%seconds, 0).In(eventTime.Location())
+}
+
+func parseBucket(name string) (time.Time, error) {
+	return time.Parse(bucketLayout, name)
+}
+
+// bucketSQL return toStartOfInterval field, GROUP BY and ORDER BY suffixes for traceSQLTemplate, seconds inlined because it's validated integer,
+// bucket selected as unix timestamp, because chhttp parse DateTime without timezone as UTC
+func bucketSQL(bucket time.Duration) (fields, groupBy, orderBy string) {
+	if bucket <= 0 {
+		return "", "", ""
+	}
+	seconds := strconv.FormatInt(int64(bucket/time.Second), 10)
+	return "\n\ttoUnixTimestamp(toStartOfInterval(event_time, INTERVAL " + seconds + " SECOND)) AS bucket,", ", bucket", " bucket,"
+}
+
+// writeBucketsCSV write outputDir/buckets.csv with total samples or bytes for each bucket, profiles shall be sorted by key
+func (g *Generator) writeBucketsCSV(profiles []profileKey, totals map[profileKey]uint64) error {
+	fileName := filepath.Join(g.opts.OutputDir, "buckets.csv")
+	rows := 0
+	if err := writeFile(fileName, func(w io.Writer) error {
+		cw := csv.NewWriter(w)
+		if err := cw.Write([]string{"host_name", "query_id", "thread", "trace_type", "bucket", "value", "unit"}); err != nil {
+			return err
+		}
+		for _, key := range profiles {
+			bucketStart, err := parseBucket(key.bucket)
+			if err != nil {
+				continue
+			}
+			unit := "samples"
+			if strings.Contains(key.traceType, "Memory") {
+				unit = "bytes"
+			}
+			record := []string{key.hostName, key.queryId, key.thread, key.traceType, bucketStart.In(g.serverTimeZone).Format(time.RFC3339), strconv.FormatUint(totals[key], 10), unit}
+			if err := cw.Write(record); err != nil {
+				return err
+			}
+			rows++
+		}
+		cw.Flush()
+		return cw.Error()
+	}); err != nil {
+		return err
+	}
+	log.Info().Str("fileName", fileName).Int("rows", rows).Msg("write buckets file")
+	return nil
+}
@@ -0,0 +1,79 @@
+package flamegraph
+
+import (
+	"context"
+	"database/sql/driver"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBucketStart(t *testing.T) {
+	moscow := time.FixedZone("MSK", 3*60*60)
+	testCases := []struct {
+		eventTime time.Time
+		bucket    time.Duration
+		expected  time.Time
+	}{
+		{time.Date(2026, 10, 1, 10, 0, 59, 0, time.UTC), time.Minute, time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 10, 1, 10, 0, 59, 999999000, time.UTC), time.Minute, time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)},
+		// 7s doesn't divide seconds between zero time and unix epoch, time.Truncate return 10:00:04
+		{time.Date(2026, 10, 1, 10, 0, 6, 0, time.UTC), 7 * time.Second, time.Date(2026, 10, 1, 10, 0, 1, 0, time.UTC)},
+		{time.Date(2026, 10, 1, 10, 0, 8, 0, time.UTC), 7 * time.Second, time.Date(2026, 10, 1, 10, 0, 8, 0, time.UTC)},
+		// aligned to unix epoch in UTC, the same as toStartOfInterval for intervals in seconds
+		{time.Date(2026, 10, 1, 13, 30, 0, 0, moscow), 2 * time.Hour, time.Date(2026, 10, 1, 13, 0, 0, 0, moscow)},
+		{time.Date(1969, 12, 31, 23, 59, 59, 0, time.UTC), time.Minute, time.Date(1969, 12, 31, 23, 59, 0, 0, time.UTC)},
+	}
+	for _, tc := range testCases {
+		actual := bucketStart(tc.eventTime, tc.bucket)
+		if !actual.Equal(tc.expected) {
+			t.Errorf("bucketStart(%s, %s) expected %s, got %s", tc.eventTime, tc.bucket, tc.expected, actual)
+		}
+		if actual.Location() != tc.eventTime.Location() {
+			t.Errorf("bucketStart(%s, %s) location %s changed", tc.eventTime, tc.bucket, actual.Location())
+		}
+	}
+}
+
+func TestValidateBucket(t *testing.T) {
+	testCases := []struct {
+		bucket  time.Duration
+		isError bool
+	}{
+		{0, false},
+		{time.Minute, false},
+		{1500 * time.Millisecond, true},
+		{-time.Second, true},
+	}
+	for _, tc := range testCases {
+		if err := validateBucket(tc.bucket); tc.isError != (err != nil) {
+			t.Errorf("validateBucket(%s) unexpected error = %v", tc.bucket, err)
+		}
+	}
+}
+
+// TestFetchStacksBucketServerTimeZone check bucket selected as unix timestamp, so bucket name doesn't depend on server timezone
+func TestFetchStacksBucketServerTimeZone(t *testing.T) {
+	bucket := time.Date(2026, 10, 1, 10, 1, 0, 0, time.UTC)
+	g, ch := newFakeGenerator(t, Options{}, time.FixedZone("MSK", 3*60*60), func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		return []string{"host_name", "query_id", "trace_type", "stack", "samples", "total_size", "max_event_time", "bucket"},
+			[][]driver.Value{{"host1", "q1", "CPU", "CPU;main", uint64(1), uint64(0), uint32(bucket.Unix() + 30), uint32(bucket.Unix())}}
+	})
+	filter := Filter{TraceTypes: []string{"CPU"}, DateFrom: bucket.Add(-time.Hour), DateTo: bucket.Add(time.Hour), Bucket: time.Minute}
+	var stacks []Stack
+	if err := g.FetchStacks(context.Background(), filter, func(s Stack) error {
+		stacks = append(stacks, s)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(stacks) != 1 || !stacks[0].Bucket.Equal(bucket) {
+		t.Fatalf("expected bucket %s, got %v", bucket, stacks)
+	}
+	if name := bucketName(filter.Bucket, stacks[0].Bucket); name != "20261001T100100Z" {
+		t.Errorf("expected bucket name 20261001T100100Z, got %s", name)
+	}
+	if q := ch.findQuery(t, "AS bucket"); !strings.Contains(q.sql, "toUnixTimestamp(toStartOfInterval(event_time, INTERVAL 60 SECOND)) AS bucket") {
+		t.Errorf("expected bucket as unix timestamp, got %s", q.sql)
+	}
+}
@@ -0,0 +1,271 @@
+package flamegraph
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	chnative "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/mailru/go-clickhouse/v2"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// prepareTLSConfig build tls.Config from TLS* options, return nil when no one option passed, for chhttp driver config registered with tls_config name from DSN
+func prepareTLSConfig(opts Options) (*tls.Config, error) {
+	var tlsConfig *tls.Config
+	if opts.TLSCA != "" || opts.TLSCertificate != "" || strings.Contains(opts.DSN, "tls_config") {
+		tlsConfig = &tls.Config{}
+	}
+	if opts.TLSCA != "" {
+		CA := x509.NewCertPool()
+		severCert, err := os.ReadFile(opts.TLSCA)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't read tls-ca = %s", opts.TLSCA)
+		}
+		CA.AppendCertsFromPEM(severCert)
+		tlsConfig.RootCAs = CA
+	}
+	if opts.TLSCertificate != "" {
+		cert, err := tls.LoadX509KeyPair(opts.TLSCertificate, opts.TLSKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't load tls-certificate = %s, tls-key = %s", opts.TLSCertificate, opts.TLSKey)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if strings.Contains(opts.DSN, "tls_config") && !isNativeDSN(opts.DSN) {
+		cfg, err := clickhouse.ParseDSN(opts.DSN)
+		if err != nil {
+			return nil, errors.Wrap(err, "can't parse dsn")
+		}
+		if err := clickhouse.RegisterTLSConfig(cfg.TLSConfig, tlsConfig); err != nil {
+			return nil, errors.Wrap(err, "can't register tls_config")
+		}
+	}
+	return tlsConfig, nil
+}
+
+// isNativeDSN return true for clickhouse:// and tcp:// DSN, which use native TCP protocol instead of HTTP
+func isNativeDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, "clickhouse://") || strings.HasPrefix(dsn, "tcp://")
+}
+
+// openDbConnection use github.com/mailru/go-clickhouse for http:// and https:// DSN and github.com/ClickHouse/clickhouse-go for native protocol DSN
+func openDbConnection(ctx context.Context, dsn string, tlsConfig *tls.Config) (*sql.DB, error) {
+	if !isNativeDSN(dsn) {
+		if tlsConfig != nil && !strings.Contains(dsn, "tls_config") {
+			log.Warn().Str("dsn", dsn).Msg("tls-* options ignored, because dsn doesn't contain tls_config")
+		}
+		db, err := sql.Open("chhttp", dsn)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Can't establishment ClickHouse connection, dsn = %s", dsn)
+		}
+		log.Info().Str("dsn", dsn).Msg("connected to ClickHouse")
+		return db, nil
+	}
+	opts, err := chnative.ParseDSN(dsn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Can't parse ClickHouse native dsn = %s", dsn)
+	}
+	applyNativeTLS(opts, dsn, tlsConfig)
+	// trace_log results could be large, so use LZ4 compression by default, when compress is not passed in dsn explicitly
+	if opts.Compression == nil && !strings.Contains(dsn, "compress=") {
+		opts.Compression = &chnative.Compression{Method: chnative.CompressionLZ4}
+	}
+	db := chnative.OpenDB(opts)
+	if err := db.PingContext(ctx); err != nil {
+		return nil, errors.Wrapf(err, "Can't establishment ClickHouse native connection, dsn = %s", dsn)
+	}
+	log.Info().Str("dsn", dsn).Msg("connected to ClickHouse via native protocol")
+	return db, nil
+}
+
+// applyNativeTLS replace TLS config parsed from native dsn with tls-* options, only when dsn contains secure=true, plain TCP connection is kept otherwise
+func applyNativeTLS(opts *chnative.Options, dsn string, tlsConfig *tls.Config) {
+	if tlsConfig == nil {
+		return
+	}
+	if opts.TLS == nil {
+		log.Warn().Str("dsn", dsn).Msg("tls-* options ignored, because dsn doesn't contain secure=true")
+		return
+	}
+	tlsConfig.InsecureSkipVerify = opts.TLS.InsecureSkipVerify
+	opts.TLS = tlsConfig
+}
+
+// systemLogFlushInterval is default flush_interval_milliseconds of system.trace_log
+const systemLogFlushInterval = 7500 * time.Millisecond
+
+func flushSystemLog(ctx context.Context, db *sql.DB) error {
+	if _, err := db.ExecContext(ctx, "SYSTEM FLUSH LOGS"); err != nil {
+		return errors.Wrap(err, "SYSTEM FLUSH LOGS failed")
+	}
+	return nil
+}
+
+func parseClickhouseVersion(versionStr string) ([]int, error) {
+	split := strings.Split(versionStr, ".")
+	if len(split) < 2 {
+		return nil, fmt.Errorf("can't parse clickhouse version: '%s'", versionStr)
+	}
+	version := make([]int, len(split))
+	var err error
+	for i := range split {
+		if version[i], err = strconv.Atoi(split[i]); err != nil {
+			break
+		}
+	}
+	return version, err
+}
+
+func checkClickHouseVersion(ctx context.Context, db *sql.DB, normalizeQuery bool) error {
+	return fetchQuery(ctx, db, "SELECT version() AS version", nil, func(r map[string]interface{}) error {
+		version, err := parseClickhouseVersion(r["version"].(string))
+		if err != nil {
+			return errors.Wrapf(err, "version = %s", r["version"].(string))
+		}
+		if (version[0] == 20 && version[1] < 6) && normalizeQuery {
+			return errors.Errorf("normalize-query require ClickHouse server version 20.6+, version = %s", r["version"].(string))
+		}
+		if version[0] < 20 || (version[0] == 20 && version[1] < 5) {
+			return errors.Errorf("system.trace_log with trace_type require ClickHouse server version 20.5+, version = %s", r["version"].(string))
+		}
+		return nil
+	})
+}
+
+func getServerTimeZone(ctx context.Context, db *sql.DB) (*time.Location, error) {
+	var serverTimeZone *time.Location
+	err := fetchQuery(ctx, db, "SELECT timezone() AS timezone", nil, func(r map[string]interface{}) error {
+		var err error
+		if serverTimeZone, err = time.LoadLocation(r["timezone"].(string)); err != nil {
+			return errors.Wrapf(err, "Unknown clickhouse timezone %s", r["timezone"].(string))
+		}
+		return nil
+	})
+	return serverTimeZone, err
+}
+
+// validateCluster check cluster name exists in system.clusters before use it in clusterAllReplicas()
+func validateCluster(ctx context.Context, db *sql.DB, cluster string) error {
+	if cluster == "" {
+		return nil
+	}
+	exists := false
+	err := fetchQuery(ctx, db, "SELECT count() AS cnt FROM system.clusters WHERE cluster = ?", []interface{}{cluster}, func(r map[string]interface{}) error {
+		exists = r["cnt"].(uint64) > 0
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.Errorf("cluster = %s not found in system.clusters", cluster)
+	}
+	return nil
+}
+
+func addWhereArgs(where, addWhere string, args []interface{}, addArgs ...interface{}) (string, []interface{}) {
+	where += addWhere
+	args = append(args, addArgs...)
+	return where, args
+}
+
+// inPlaceholders return "(?,?,?)" for IN condition and values as SQL arguments, so values escaped by driver instead of string concatenation
+func inPlaceholders(values []string) (string, []interface{}) {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return "(" + placeholders(len(values)) + ")", args
+}
+
+// placeholders return "?,?,?" for n values
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// systemTable return system table name or clusterAllReplicas() table function with cluster name as SQL argument
+func systemTable(filter Filter, table string) (string, []interface{}) {
+	if filter.Cluster != "" {
+		return "clusterAllReplicas(?, system." + table + ")", []interface{}{filter.Cluster}
+	}
+	return "system." + table, nil
+}
+
+// formatSQLTemplate use simple {key_from_context} template syntax
+func formatSQLTemplate(sqlTemplate string, context map[string]interface{}) string {
+	args, i := make([]string, len(context)*2), 0
+	for k, v := range context {
+		args[i] = "{" + k + "}"
+		args[i+1] = fmt.Sprint(v)
+		i += 2
+	}
+	return strings.NewReplacer(args...).Replace(sqlTemplate)
+}
+
+// unixTime convert unix timestamp column in unit into time in loc, value of unexpected type is treated as zero
+func unixTime(v interface{}, unit time.Duration, loc *time.Location) time.Time {
+	value, _ := toUint64(v)
+	return time.Unix(0, int64(value)*int64(unit)).In(loc)
+}
+
+// fetchRowAsMap see https://kylewbanks.com/blog/query-result-to-map-in-golang
+func fetchRowAsMap(rows *sql.Rows, cols []string) (m map[string]interface{}, err error) {
+	// Create a slice of interface{}'s to represent each column,
+	// and a second slice to contain pointers to each item in the columns slice.
+	columns := make([]interface{}, len(cols))
+	columnPointers := make([]interface{}, len(cols))
+	for i := range columns {
+		columnPointers[i] = &columns[i]
+	}
+
+	// Scan the result into the column pointers...
+	if err := rows.Scan(columnPointers...); err != nil {
+		return nil, err
+	}
+
+	// Create our map, and retrieve the value for each column from the pointers slice,
+	// storing it in the map with the name of the column as the key.
+	m = make(map[string]interface{}, len(cols))
+	for i, colName := range cols {
+		val := columnPointers[i].(*interface{})
+		m[colName] = *val
+	}
+	return m, nil
+}
+
+func fetchQuery(ctx context.Context, db *sql.DB, sql string, sqlArgs []interface{}, fetchCallback func(r map[string]interface{}) error) error {
+	rows, err := db.QueryContext(ctx, sql, sqlArgs...)
+	if err != nil {
+		return errors.Wrapf(err, "query failed sql = %s, sqlArgs = %v", sql, sqlArgs)
+	}
+	log.Debug().Str("sql", sql).Str("sqlArgs", fmt.Sprintf("%v", sqlArgs)).Msg("query OK")
+	cols, err := rows.Columns()
+	if err != nil {
+		_ = rows.Close()
+		return errors.Wrap(err, "can't get columns")
+	}
+	for rows.Next() {
+		r, err := fetchRowAsMap(rows, cols)
+		if err != nil {
+			_ = rows.Close()
+			return errors.Wrap(err, "fetch error")
+		}
+		if err := fetchCallback(r); err != nil {
+			_ = rows.Close()
+			return errors.Wrap(err, "fetch error")
+		}
+	}
+	if err := rows.Err(); err != nil {
+		_ = rows.Close()
+		return errors.Wrap(err, "fetch error")
+	}
+	return errors.Wrap(rows.Close(), "can't close rows")
+}
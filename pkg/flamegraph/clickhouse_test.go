@@ -0,0 +1,160 @@
+package flamegraph
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	chnative "github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/pkg/errors"
+)
+
+func TestApplyNativeTLS(t *testing.T) {
+	testCases := []struct {
+		dsn                string
+		tlsConfig          *tls.Config
+		secure             bool
+		insecureSkipVerify bool
+	}{
+		{dsn: "clickhouse://localhost:9000/default", tlsConfig: nil, secure: false},
+		{dsn: "clickhouse://localhost:9000/default", tlsConfig: &tls.Config{}, secure: false},
+		{dsn: "clickhouse://localhost:9440/default?secure=true", tlsConfig: nil, secure: true},
+		{dsn: "clickhouse://localhost:9440/default?secure=true", tlsConfig: &tls.Config{ServerName: "ca"}, secure: true},
+		{dsn: "clickhouse://localhost:9440/default?secure=true&skip_verify=true", tlsConfig: &tls.Config{ServerName: "ca"}, secure: true, insecureSkipVerify: true},
+	}
+	for _, tc := range testCases {
+		opts, err := chnative.ParseDSN(tc.dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		applyNativeTLS(opts, tc.dsn, tc.tlsConfig)
+		if tc.secure != (opts.TLS != nil) {
+			t.Errorf("%s expected secure = %v, got TLS = %v", tc.dsn, tc.secure, opts.TLS)
+			continue
+		}
+		if opts.TLS == nil {
+			continue
+		}
+		if tc.tlsConfig != nil && opts.TLS != tc.tlsConfig {
+			t.Errorf("%s expected tls-* options applied", tc.dsn)
+		}
+		if opts.TLS.InsecureSkipVerify != tc.insecureSkipVerify {
+			t.Errorf("%s expected InsecureSkipVerify = %v", tc.dsn, tc.insecureSkipVerify)
+		}
+	}
+}
+
+// fakeClickHouse answer queries via handler and record each query with args, used for check generated SQL without ClickHouse
+type fakeClickHouse struct {
+	mu      sync.Mutex
+	queries []fakeQuery
+	// handler return columns and rows for query, nil columns means empty result
+	handler func(query string, args []driver.Value) ([]string, [][]driver.Value)
+}
+
+type fakeQuery struct {
+	sql  string
+	args []driver.Value
+}
+
+type fakeConn struct{ c *fakeClickHouse }
+type fakeStmt struct {
+	c     *fakeClickHouse
+	query string
+}
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+	i       int
+}
+
+func (c *fakeClickHouse) Open(string) (driver.Conn, error) { return fakeConn{c}, nil }
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{c: c.c, query: query}, nil
+}
+func (c fakeConn) Close() error              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error) { return nil, io.EOF }
+func (s *fakeStmt) Close() error             { return nil }
+func (s *fakeStmt) NumInput() int            { return -1 }
+func (s *fakeStmt) record(args []driver.Value) error {
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+	s.c.queries = append(s.c.queries, fakeQuery{sql: s.query, args: args})
+	if placeholders := strings.Count(s.query, "?"); placeholders != len(args) {
+		return errors.Errorf("%d placeholders, but %d args in %s", placeholders, len(args), s.query)
+	}
+	return nil
+}
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(0), s.record(args)
+}
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if err := s.record(args); err != nil {
+		return nil, err
+	}
+	columns, rows := s.c.handler(s.query, args)
+	return &fakeRows{columns: columns, rows: rows}, nil
+}
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.i >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.i])
+	r.i++
+	return nil
+}
+
+// newFakeGenerator return Generator connected to fakeClickHouse with handler, serverTimeZone is ClickHouse server timezone
+func newFakeGenerator(t *testing.T, opts Options, serverTimeZone *time.Location, handler func(query string, args []driver.Value) ([]string, [][]driver.Value)) (*Generator, *fakeClickHouse) {
+	t.Helper()
+	c := &fakeClickHouse{handler: handler}
+	sql.Register("fake-"+t.Name(), c)
+	db, err := sql.Open("fake-"+t.Name(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return &Generator{opts: opts.withDefaults(), db: db, serverTimeZone: serverTimeZone}, c
+}
+
+// findQuery return first recorded query which contains substring
+func (c *fakeClickHouse) findQuery(t *testing.T, substring string) fakeQuery {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, q := range c.queries {
+		if strings.Contains(q.sql, substring) {
+			return q
+		}
+	}
+	t.Fatalf("query with %s not found", substring)
+	return fakeQuery{}
+}
+
+// interpolateSQL replace each placeholder by quoted argument in order, used for check arguments order in generated SQL
+func interpolateSQL(query string, args []driver.Value) string {
+	var result strings.Builder
+	for _, arg := range args {
+		before, after, _ := strings.Cut(query, "?")
+		result.WriteString(before)
+		switch v := arg.(type) {
+		case string:
+			result.WriteString("'" + strings.ReplaceAll(v, "'", "\\'") + "'")
+		case time.Time:
+			result.WriteString("'" + v.Format("2006-01-02 15:04:05") + "'")
+		default:
+			fmt.Fprint(&result, v)
+		}
+		query = after
+	}
+	result.WriteString(query)
+	return result.String()
+}
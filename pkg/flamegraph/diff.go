@@ -0,0 +1,180 @@
+package flamegraph
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// diffStack contains baseline and comparison values for the same folded stack
+type diffStack struct {
+	baseValue uint64
+	value     uint64
+}
+
+// Diff render differential flamegraph between base and Options.Filter stacks into outputDir/hostname/diff.traceType.*, red frames grew, blue frames shrank,
+// when normalize is true, baseline values scaled to comparison total for each host and trace_type
+func (g *Generator) Diff(ctx context.Context, base Filter, normalize bool) error {
+	if g.opts.OutputFormat != "svg" && g.opts.OutputFormat != "txt" {
+		return errors.Errorf("diff support only svg and txt output format, got %s", g.opts.OutputFormat)
+	}
+	// baseline for all queries compared with a few queries or vice versa is meaningless
+	if (len(base.QueryIds) == 0) != (len(g.opts.QueryIds) == 0) {
+		return errors.New("base query ids and query ids shall be both set or both empty")
+	}
+	frames, err := newFrameFilter(g.opts.Focus, g.opts.Ignore, g.opts.Hide, g.opts.PruneFrom)
+	if err != nil {
+		return err
+	}
+	if err := g.FlushLogs(ctx); err != nil {
+		return err
+	}
+	if err := g.createOutputDir(); err != nil {
+		return err
+	}
+	// diffStacks format = hostname/traceType -> stack -> baseline and comparison values
+	diffStacks := make(map[string]map[string]*diffStack)
+	collectStacks := func(isBase bool) func(s Stack) error {
+		return func(s Stack) error {
+			diffKey, stack, value := s.HostName+"/"+s.TraceType, s.Frames, s.Value
+			stack, accepted := frames.apply(stack)
+			if !accepted {
+				return nil
+			}
+			if g.opts.Invert {
+				stack = invertFrames(stack, g.opts.GroupBy)
+			}
+			if _, exists := diffStacks[diffKey]; !exists {
+				diffStacks[diffKey] = make(map[string]*diffStack)
+			}
+			if _, exists := diffStacks[diffKey][stack]; !exists {
+				diffStacks[diffKey][stack] = &diffStack{}
+			}
+			if isBase {
+				diffStacks[diffKey][stack].baseValue += value
+			} else {
+				diffStacks[diffKey][stack].value += value
+			}
+			return nil
+		}
+	}
+	// diff compare whole windows, so time buckets are not used
+	comparison := g.opts.Filter
+	base.Bucket, comparison.Bucket = 0, 0
+	if err := g.FetchStacks(ctx, base, collectStacks(true)); err != nil {
+		return err
+	}
+	if err := g.FetchStacks(ctx, comparison, collectStacks(false)); err != nil {
+		return err
+	}
+
+	diffKeys := make([]string, 0, len(diffStacks))
+	for diffKey := range diffStacks {
+		diffKeys = append(diffKeys, diffKey)
+	}
+	sort.Strings(diffKeys)
+	for _, diffKey := range diffKeys {
+		hostName, traceType, _ := strings.Cut(diffKey, "/")
+		if normalize {
+			normalizeDiffStacks(diffStacks[diffKey])
+		}
+		stackName, err := g.writeDiffFolded(hostName, traceType, diffStacks[diffKey])
+		if err != nil {
+			return err
+		}
+		if g.opts.OutputFormat == "svg" {
+			if err := g.writeDiffSVG(ctx, base, hostName, traceType, stackName, diffStacks[diffKey]); err != nil {
+				return err
+			}
+		}
+	}
+	log.Info().Int("processedFiles", len(diffKeys)).Msg("done processing diff")
+	return nil
+}
+
+// normalizeDiffStacks scale baseline values, so baseline total equals comparison total
+func normalizeDiffStacks(stacks map[string]*diffStack) {
+	var baseTotal, total uint64
+	for _, s := range stacks {
+		baseTotal += s.baseValue
+		total += s.value
+	}
+	if baseTotal == 0 || total == 0 {
+		return
+	}
+	scale := float64(total) / float64(baseTotal)
+	for _, s := range stacks {
+		s.baseValue = uint64(float64(s.baseValue)*scale + 0.5)
+	}
+}
+
+// writeDiffFolded write outputDir/hostname/diff.traceType.txt in difffolded.pl format "stack baseValue value"
+func (g *Generator) writeDiffFolded(hostName, traceType string, stacks map[string]*diffStack) (string, error) {
+	stackKeys := make([]string, 0, len(stacks))
+	for stack := range stacks {
+		stackKeys = append(stackKeys, stack)
+	}
+	sort.Strings(stackKeys)
+	var buf bytes.Buffer
+	for _, stack := range stackKeys {
+		buf.WriteString(fmt.Sprintf("%s %d %d\n", stack, stacks[stack].baseValue, stacks[stack].value))
+	}
+	hostDir := filepath.Join(g.opts.OutputDir, hostName)
+	if err := os.MkdirAll(hostDir, 0755); err != nil {
+		return "", errors.Wrapf(err, "can't create %s", hostDir)
+	}
+	stackName := filepath.Join(hostDir, "diff."+traceType+".txt")
+	if err := os.WriteFile(stackName, buf.Bytes(), 0644); err != nil {
+		return "", errors.Wrapf(err, "can't write %s", stackName)
+	}
+	return stackName, nil
+}
+
+func (g *Generator) writeDiffSVG(ctx context.Context, base Filter, hostName, traceType, stackName string, stacks map[string]*diffStack) error {
+	title := fmt.Sprintf("hostName %s (%s) baseline from %s to %s, comparison from %s to %s", hostName, traceType, g.formatDate(base.DateFrom), g.formatDate(base.DateTo), g.formatDate(g.opts.DateFrom), g.formatDate(g.opts.DateTo))
+	if g.opts.Invert {
+		title += " inverted"
+	}
+	countName := "samples"
+	if strings.Contains(traceType, "Memory") {
+		countName = "bytes"
+	}
+	var svg []byte
+	if g.opts.FlameGraphScript != "" {
+		stackFile, err := os.Open(stackName)
+		if err != nil {
+			return errors.Wrapf(err, "can't open %s", stackName)
+		}
+		svg, err = g.runFlameGraphScript(ctx, stackFile, title, countName, traceType)
+		_ = stackFile.Close()
+		if err != nil {
+			return err
+		}
+	} else {
+		root := newStackNode("")
+		for stack, s := range stacks {
+			root.addDiff(strings.Split(stack, ";"), s.baseValue, s.value)
+		}
+		var buf bytes.Buffer
+		if err := renderSVG(&buf, root, svgOptions{
+			Title:     title,
+			Width:     g.opts.Width,
+			Height:    g.opts.Height,
+			CountName: countName,
+			NameType:  traceType,
+			Colors:    "diff",
+		}); err != nil {
+			return errors.Wrapf(err, "stackName = %s", stackName)
+		}
+		svg = buf.Bytes()
+	}
+	fileName := filepath.Join(g.opts.OutputDir, hostName, "diff."+traceType+".svg")
+	return errors.Wrapf(os.WriteFile(fileName, svg, 0644), "can't write %s", fileName)
+}
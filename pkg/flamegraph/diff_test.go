@@ -0,0 +1,51 @@
+package flamegraph
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiffQueryIds(t *testing.T) {
+	traceLog := writeTestFile(t, "host1.tsv", testTraceLog+
+		"host1\t2026-10-01 10:00:04\tq2\tCPU\t1\t0\t[1,2]\t['foo','main']\t['a.cpp:2','a.cpp:1']\n")
+	testCases := []struct {
+		name         string
+		queryIds     []string
+		baseQueryIds []string
+		expected     string
+		isError      bool
+	}{
+		{name: "both queries", queryIds: []string{"q2"}, baseQueryIds: []string{"q1"}, expected: "CPU;main#a.cpp:1;bar#a.cpp:3 1 0\nCPU;main#a.cpp:1;foo#a.cpp:2 2 1\n"},
+		{name: "all queries", expected: "CPU;main#a.cpp:1;bar#a.cpp:3 1 1\nCPU;main#a.cpp:1;foo#a.cpp:2 3 3\n"},
+		{name: "only query ids", queryIds: []string{"q2"}, isError: true},
+		{name: "only base query ids", baseQueryIds: []string{"q1"}, isError: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := Options{OutputDir: t.TempDir(), OutputFormat: "txt"}
+			opts.QueryIds, opts.TraceTypes = tc.queryIds, []string{"CPU"}
+			g, err := NewImportGenerator(opts, ImportOptions{TraceLogFiles: []string{traceLog}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			base := opts.Filter
+			base.QueryIds = tc.baseQueryIds
+			err = g.Diff(context.Background(), base, false)
+			if tc.isError != (err != nil) {
+				t.Fatalf("unexpected error = %v", err)
+			}
+			if tc.isError {
+				return
+			}
+			data, err := os.ReadFile(filepath.Join(opts.OutputDir, "host1", "diff.CPU.txt"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tc.expected {
+				t.Errorf("expected:\n%s\ngot:\n%s", tc.expected, string(data))
+			}
+		})
+	}
+}
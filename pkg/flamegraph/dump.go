@@ -0,0 +1,451 @@
+package flamegraph
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/ch-go/proto"
+	"github.com/araddon/dateparse"
+	"github.com/parquet-go/parquet-go"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DumpFormatTSV is TabSeparatedWithNames, header with column names is required
+	DumpFormatTSV = "TSVWithNames"
+	// DumpFormatJSONEachRow one JSON object per line
+	DumpFormatJSONEachRow = "JSONEachRow"
+	// DumpFormatNative ClickHouse Native format
+	DumpFormatNative = "Native"
+	// DumpFormatParquet Apache Parquet, DateTime exported by ClickHouse as UInt32 and Enum8 as Int8 are supported
+	DumpFormatParquet = "Parquet"
+)
+
+// detectDumpFormat return format by file extension when format is empty
+func detectDumpFormat(fileName, format string) (string, error) {
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(fileName)) {
+		case ".tsv", ".tab", ".txt":
+			format = DumpFormatTSV
+		case ".json", ".jsonl", ".ndjson":
+			format = DumpFormatJSONEachRow
+		case ".native", ".bin":
+			format = DumpFormatNative
+		case ".parquet":
+			format = DumpFormatParquet
+		default:
+			return "", errors.Errorf("can't detect format for %s, pass input-format", fileName)
+		}
+	}
+	switch strings.ToLower(format) {
+	case "tsv", "tsvwithnames", "tabseparated", "tabseparatedwithnames":
+		return DumpFormatTSV, nil
+	case "jsoneachrow", "json", "ndjson":
+		return DumpFormatJSONEachRow, nil
+	case "native":
+		return DumpFormatNative, nil
+	case "parquet":
+		return DumpFormatParquet, nil
+	}
+	return "", errors.Errorf("unsupported input-format = %s, accept values: %s, %s, %s, %s", format, DumpFormatTSV, DumpFormatJSONEachRow, DumpFormatNative, DumpFormatParquet)
+}
+
+// readDumpFile read rows from system.trace_log or system.query_log export produced via SELECT ... INTO OUTFILE,
+// values type depends on format, use dump* accessors for read it
+func readDumpFile(fileName, format string, rowCallback func(r map[string]interface{}) error) error {
+	format, err := detectDumpFormat(fileName, format)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return errors.Wrapf(err, "can't open %s", fileName)
+	}
+	defer f.Close()
+	switch format {
+	case DumpFormatTSV:
+		err = readTSVDump(f, rowCallback)
+	case DumpFormatJSONEachRow:
+		err = readJSONEachRowDump(f, rowCallback)
+	case DumpFormatNative:
+		err = readNativeDump(f, rowCallback)
+	case DumpFormatParquet:
+		err = readParquetDump(f, rowCallback)
+	}
+	return errors.Wrapf(err, "fileName = %s, format = %s", fileName, format)
+}
+
+func readTSVDump(r io.Reader, rowCallback func(r map[string]interface{}) error) error {
+	reader := bufio.NewReader(r)
+	var columns []string
+	for line := 1; ; line++ {
+		text, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		text = strings.TrimRight(text, "\r\n")
+		if text != "" {
+			fields := strings.Split(text, "\t")
+			if columns == nil {
+				if !slices.Contains(fields, "query_id") {
+					return errors.New("TSV header with column names not found, export with FORMAT TSVWithNames")
+				}
+				columns = fields
+			} else {
+				if len(fields) != len(columns) {
+					return errors.Errorf("line %d contains %d fields, header contains %d columns", line, len(fields), len(columns))
+				}
+				row := make(map[string]interface{}, len(columns))
+				for i, column := range columns {
+					row[column] = unescapeTSV(fields[i])
+				}
+				if err := rowCallback(row); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// unescapeTSV see https://clickhouse.com/docs/en/interfaces/formats#tabseparated-data-formatting
+func unescapeTSV(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case '0':
+			b.WriteByte(0)
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// splitTSVArray split ['a','b'] or [1,2] text representation of array, quotes removed from items
+func splitTSVArray(s string) []string {
+	s = strings.TrimSpace(s)
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if s == "" {
+		return nil
+	}
+	var items []string
+	var item strings.Builder
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && quoted && i+1 < len(s):
+			i++
+			item.WriteByte(s[i])
+		case c == '\'':
+			quoted = !quoted
+		case c == ',' && !quoted:
+			items = append(items, item.String())
+			item.Reset()
+		default:
+			item.WriteByte(c)
+		}
+	}
+	return append(items, item.String())
+}
+
+func readJSONEachRowDump(r io.Reader, rowCallback func(r map[string]interface{}) error) error {
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	decoder.UseNumber()
+	for {
+		row := make(map[string]interface{})
+		if err := decoder.Decode(&row); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := rowCallback(row); err != nil {
+			return err
+		}
+	}
+}
+
+// readNativeDump read blocks without block info, the same way as ClickHouse write Native format into files,
+// export only required columns when some column type is not supported
+func readNativeDump(r io.Reader, rowCallback func(r map[string]interface{}) error) error {
+	reader := proto.NewReader(bufio.NewReader(r))
+	var results proto.Results
+	for {
+		for _, column := range results {
+			column.Data.Reset()
+		}
+		var block proto.Block
+		if err := block.DecodeRawBlock(reader, 0, results.Auto()); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if block.End() {
+			return nil
+		}
+		rowMethods := make([]reflect.Value, len(results))
+		for i, column := range results {
+			if rowMethods[i] = reflect.ValueOf(column.Data).MethodByName("Row"); !rowMethods[i].IsValid() {
+				return errors.Errorf("column %s with type %s is not supported", column.Name, column.Data.Type())
+			}
+		}
+		for i := 0; i < block.Rows; i++ {
+			row := make(map[string]interface{}, len(results))
+			for j, column := range results {
+				row[column.Name] = rowMethods[j].Call([]reflect.Value{reflect.ValueOf(i)})[0].Interface()
+			}
+			if err := rowCallback(row); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// readParquetDump read rows without reflection into struct, because exported columns depend on server version,
+// Array columns returned as []interface{}, NULL and empty arrays as empty []interface{}
+func readParquetDump(f *os.File, rowCallback func(r map[string]interface{}) error) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	file, err := parquet.OpenFile(f, info.Size())
+	if err != nil {
+		return err
+	}
+	columns := file.Schema().Columns()
+	leafs, names := make([]parquet.LeafColumn, len(columns)), make([]string, len(columns))
+	for _, path := range columns {
+		leaf, _ := file.Schema().Lookup(path...)
+		// Array(T) is LIST with path name.list.element, so first path item is column name
+		leafs[leaf.ColumnIndex], names[leaf.ColumnIndex] = leaf, path[0]
+	}
+	reader := parquet.NewReader(file)
+	defer reader.Close()
+	rows := make([]parquet.Row, 1024)
+	for {
+		n, readErr := reader.ReadRows(rows)
+		for _, values := range rows[:n] {
+			row := make(map[string]interface{}, len(leafs))
+			for _, v := range values {
+				leaf, name := leafs[v.Column()], names[v.Column()]
+				if leaf.MaxRepetitionLevel == 0 {
+					if !v.IsNull() {
+						row[name] = parquetValue(v, leaf.Node)
+					}
+					continue
+				}
+				items, _ := row[name].([]interface{})
+				if items == nil {
+					items = make([]interface{}, 0)
+				}
+				if v.DefinitionLevel() == leaf.MaxDefinitionLevel {
+					items = append(items, parquetValue(v, leaf.Node))
+				}
+				row[name] = items
+			}
+			if err := rowCallback(row); err != nil {
+				return err
+			}
+		}
+		if readErr == io.EOF {
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+// parquetValue convert physical value by logical type, unsigned integers returned as uint64, timestamps as time.Time
+func parquetValue(v parquet.Value, node parquet.Node) interface{} {
+	logicalType := node.Type().LogicalType()
+	switch v.Kind() {
+	case parquet.Boolean:
+		return v.Boolean()
+	case parquet.Int32:
+		if logicalType != nil && logicalType.Integer != nil && !logicalType.Integer.IsSigned {
+			return uint64(v.Uint32())
+		}
+		return int64(v.Int32())
+	case parquet.Int64:
+		if logicalType != nil && logicalType.Timestamp != nil {
+			switch unit := logicalType.Timestamp.Unit; {
+			case unit.Millis != nil:
+				return time.UnixMilli(v.Int64())
+			case unit.Micros != nil:
+				return time.UnixMicro(v.Int64())
+			default:
+				return time.Unix(0, v.Int64())
+			}
+		}
+		if logicalType != nil && logicalType.Integer != nil && !logicalType.Integer.IsSigned {
+			return v.Uint64()
+		}
+		return v.Int64()
+	case parquet.Float:
+		return float64(v.Float())
+	case parquet.Double:
+		return v.Double()
+	}
+	return string(v.ByteArray())
+}
+
+// dumpString return column value as string, false when column doesn't exist
+func dumpString(r map[string]interface{}, name string) (string, bool) {
+	v, exists := r[name]
+	if !exists || v == nil {
+		return "", false
+	}
+	if s, ok := v.(string); ok {
+		return s, true
+	}
+	return fmt.Sprint(v), true
+}
+
+// dumpUint64 parse numbers from TSV and JSON strings, JSON numbers and any integer types from Native
+func dumpUint64(r map[string]interface{}, name string) (uint64, bool) {
+	v, exists := r[name]
+	if !exists || v == nil {
+		return 0, false
+	}
+	return toUint64(v)
+}
+
+func toUint64(v interface{}) (uint64, bool) {
+	switch value := v.(type) {
+	case string:
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		return parsed, err == nil
+	case json.Number:
+		parsed, err := strconv.ParseUint(value.String(), 10, 64)
+		return parsed, err == nil
+	}
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return value.Uint(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return uint64(value.Int()), true
+	}
+	return 0, false
+}
+
+func dumpInt64(r map[string]interface{}, name string) (int64, bool) {
+	v, exists := r[name]
+	if !exists || v == nil {
+		return 0, false
+	}
+	switch value := v.(type) {
+	case string:
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		return parsed, err == nil
+	case json.Number:
+		parsed, err := strconv.ParseInt(value.String(), 10, 64)
+		return parsed, err == nil
+	}
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int(), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(value.Uint()), true
+	}
+	return 0, false
+}
+
+// dumpTime parse DateTime text representation in loc, Native DateTime already contains time zone
+func dumpTime(r map[string]interface{}, name string, loc *time.Location) (time.Time, bool) {
+	v, exists := r[name]
+	if !exists || v == nil {
+		return time.Time{}, false
+	}
+	if t, ok := v.(time.Time); ok {
+		return t, true
+	}
+	// DateTime exported as UInt32 unix timestamp into Parquet
+	if _, isString := v.(string); !isString {
+		if seconds, ok := toUint64(v); ok {
+			return time.Unix(int64(seconds), 0).In(loc), true
+		}
+	}
+	s, _ := dumpString(r, name)
+	t, err := dateparse.ParseIn(s, loc)
+	return t, err == nil
+}
+
+// dumpUint64Array accept [1,2] text, JSON array with numbers or quoted numbers, and Array(UInt64) from Native
+func dumpUint64Array(r map[string]interface{}, name string) ([]uint64, bool) {
+	v, exists := r[name]
+	if !exists || v == nil {
+		return nil, false
+	}
+	var items []interface{}
+	switch value := v.(type) {
+	case []uint64:
+		return value, true
+	case string:
+		for _, item := range splitTSVArray(value) {
+			items = append(items, item)
+		}
+	case []interface{}:
+		items = value
+	default:
+		return nil, false
+	}
+	result := make([]uint64, 0, len(items))
+	for _, item := range items {
+		parsed, ok := toUint64(item)
+		if !ok {
+			return nil, false
+		}
+		result = append(result, parsed)
+	}
+	return result, true
+}
+
+// dumpStringArray accept ['a','b'] text, JSON array and Array(String) from Native
+func dumpStringArray(r map[string]interface{}, name string) ([]string, bool) {
+	v, exists := r[name]
+	if !exists || v == nil {
+		return nil, false
+	}
+	switch value := v.(type) {
+	case []string:
+		return value, true
+	case string:
+		return splitTSVArray(value), true
+	case []interface{}:
+		result := make([]string, 0, len(value))
+		for _, item := range value {
+			result = append(result, fmt.Sprint(item))
+		}
+		return result, true
+	}
+	return nil, false
+}
@@ -0,0 +1,99 @@
+package flamegraph
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// testParquetTrace has the same types as ClickHouse Parquet export of system.trace_log, DateTime as UInt32 and Enum8 as signed integer
+type testParquetTrace struct {
+	Hostname  string   `parquet:"hostname"`
+	EventTime uint32   `parquet:"event_time"`
+	QueryId   string   `parquet:"query_id"`
+	TraceType int32    `parquet:"trace_type"`
+	ThreadId  uint64   `parquet:"thread_id"`
+	Size      int64    `parquet:"size"`
+	Trace     []uint64 `parquet:"trace,list"`
+	Symbols   []string `parquet:"symbols,list"`
+	Lines     []string `parquet:"lines,list"`
+}
+
+func TestDetectDumpFormat(t *testing.T) {
+	testCases := []struct {
+		fileName string
+		format   string
+		expected string
+		isError  bool
+	}{
+		{fileName: "trace_log.tsv", expected: DumpFormatTSV},
+		{fileName: "trace_log.jsonl", expected: DumpFormatJSONEachRow},
+		{fileName: "trace_log.native", expected: DumpFormatNative},
+		{fileName: "trace_log.parquet", expected: DumpFormatParquet},
+		{fileName: "trace_log.out", format: "parquet", expected: DumpFormatParquet},
+		{fileName: "trace_log.out", isError: true},
+		{fileName: "trace_log.tsv", format: "xml", isError: true},
+	}
+	for _, tc := range testCases {
+		format, err := detectDumpFormat(tc.fileName, tc.format)
+		if tc.isError != (err != nil) {
+			t.Errorf("%s %s unexpected error = %v", tc.fileName, tc.format, err)
+		}
+		if format != tc.expected {
+			t.Errorf("%s %s expected %s, got %s", tc.fileName, tc.format, tc.expected, format)
+		}
+	}
+}
+
+// TestImportParquet check Parquet export rendered the same way as TSV export with the same rows
+func TestImportParquet(t *testing.T) {
+	dir := t.TempDir()
+	parquetFile := filepath.Join(dir, "trace_log.parquet")
+	f, err := os.Create(parquetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventTime := time.Date(2026, 10, 1, 10, 0, 0, 0, time.Local)
+	rows := []testParquetTrace{
+		{Hostname: "host1", EventTime: uint32(eventTime.Unix()), QueryId: "q1", TraceType: 1, ThreadId: 1, Trace: []uint64{1, 2}, Symbols: []string{"foo", "main"}, Lines: []string{"a.cpp:2", "a.cpp:1"}},
+		{Hostname: "host1", EventTime: uint32(eventTime.Unix()) + 1, QueryId: "q1", TraceType: 1, ThreadId: 1, Trace: []uint64{1, 2}, Symbols: []string{"foo", "main"}, Lines: []string{"a.cpp:2", "a.cpp:1"}},
+		{Hostname: "host1", EventTime: uint32(eventTime.Unix()) + 1, QueryId: "q1", TraceType: 0, ThreadId: 1, Trace: []uint64{1, 2}, Symbols: []string{"foo", "main"}, Lines: []string{"a.cpp:2", "a.cpp:1"}},
+		{Hostname: "host1", EventTime: uint32(eventTime.Unix()) + 2, QueryId: "q1", TraceType: 1, ThreadId: 2, Trace: []uint64{3, 2}, Symbols: []string{"bar", "main"}, Lines: []string{"a.cpp:3", "a.cpp:1"}},
+		{Hostname: "host1", EventTime: uint32(eventTime.Unix()) + 3, QueryId: "q1", TraceType: 0, ThreadId: 2, Trace: []uint64{3, 2}, Symbols: []string{"bar", "main"}, Lines: []string{"a.cpp:3", "a.cpp:1"}},
+	}
+	writer := parquet.NewGenericWriter[testParquetTrace](f)
+	if _, err := writer.Write(rows); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	outputs := make([]map[string]string, 0, 2)
+	for _, traceLog := range []string{writeTestFile(t, "host1.tsv", testTraceLog), parquetFile} {
+		opts := Options{OutputDir: t.TempDir(), OutputFormat: "txt"}
+		g, err := NewImportGenerator(opts, ImportOptions{TraceLogFiles: []string{traceLog}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := g.Generate(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		outputs = append(outputs, readOutputFiles(t, opts.OutputDir))
+	}
+	if len(outputs[1]) != len(outputs[0]) {
+		t.Fatalf("expected %d files, got %d", len(outputs[0]), len(outputs[1]))
+	}
+	for name, expected := range outputs[0] {
+		if outputs[1][name] != expected {
+			t.Errorf("%s expected:\n%s\ngot:\n%s", name, expected, outputs[1][name])
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package flamegraph
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/ianlancetaylor/demangle"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// maxBaseCandidates limit brute force for PIE load address detection
+	maxBaseCandidates = 1 << 16
+	// baseDetectSamples addresses count used for PIE load address detection
+	baseDetectSamples = 256
+)
+
+// elfSegment is executable PT_LOAD segment, data used for PIE load address detection
+type elfSegment struct {
+	vaddr uint64
+	data  []byte
+}
+
+// elfSymbolizer resolve addresses via ELF symbols table and DWARF line tables from local clickhouse binary,
+// without addressToSymbol and addressToLine on server, so allow_introspection_functions is not required
+type elfSymbolizer struct {
+	path    string
+	machine elf.Machine
+	pie     bool
+	buildId string
+	// align is max PT_LOAD alignment, kernel maps PIE with this alignment
+	align    uint64
+	segments []elfSegment
+	// funcs sorted by Value
+	funcs []elf.Symbol
+	lines *dwarf.Data
+}
+
+func openELFSymbolizer(path string) (*elfSymbolizer, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't open symbols-binary = %s", path)
+	}
+	defer f.Close()
+	s := &elfSymbolizer{path: path, machine: f.Machine, pie: f.Type == elf.ET_DYN, align: 0x1000}
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_LOAD {
+			continue
+		}
+		if prog.Align > s.align {
+			s.align = prog.Align
+		}
+		if prog.Flags&elf.PF_X == 0 {
+			continue
+		}
+		data := make([]byte, prog.Filesz)
+		if _, err := prog.ReadAt(data, 0); err != nil {
+			return nil, errors.Wrapf(err, "can't read executable segment from %s", path)
+		}
+		s.segments = append(s.segments, elfSegment{vaddr: prog.Vaddr, data: data})
+	}
+	if len(s.segments) == 0 {
+		return nil, errors.Errorf("executable segments not found in %s", path)
+	}
+	if note := f.Section(".note.gnu.build-id"); note != nil {
+		if data, err := note.Data(); err == nil && len(data) > 16 {
+			// Elf_Nhdr namesz, descsz, type, "GNU\0", desc
+			nameSize, descSize := f.ByteOrder.Uint32(data[0:4]), f.ByteOrder.Uint32(data[4:8])
+			descStart := 12 + (nameSize+3)&^3
+			if uint32(len(data)) >= descStart+descSize {
+				s.buildId = hex.EncodeToString(data[descStart : descStart+descSize])
+			}
+		}
+	}
+	symbols, err := f.Symbols()
+	if err != nil && !errors.Is(err, elf.ErrNoSymbols) {
+		return nil, errors.Wrapf(err, "can't read symbols from %s", path)
+	}
+	dynamicSymbols, _ := f.DynamicSymbols()
+	for _, symbol := range append(symbols, dynamicSymbols...) {
+		// zero size symbols are section markers, like runtime.text
+		if elf.ST_TYPE(symbol.Info) == elf.STT_FUNC && symbol.Value != 0 && symbol.Size != 0 {
+			s.funcs = append(s.funcs, symbol)
+		}
+	}
+	if len(s.funcs) == 0 {
+		return nil, errors.Errorf("function symbols not found in %s, binary is stripped", path)
+	}
+	sort.Slice(s.funcs, func(i, j int) bool {
+		return s.funcs[i].Value < s.funcs[j].Value
+	})
+	if s.lines, err = f.DWARF(); err != nil {
+		log.Warn().Err(err).Str("symbolsBinary", path).Msg("DWARF not found, only function names will be resolved")
+		s.lines = nil
+	}
+	log.Info().Str("symbolsBinary", path).Str("buildId", s.buildId).Bool("pie", s.pie).Int("functions", len(s.funcs)).Bool("dwarf", s.lines != nil).Msg("load symbols")
+	return s, nil
+}
+
+// detectBase return load address for PIE binary, 0 for non PIE, brute force all aligned candidates which place addresses inside executable segments
+// and choose candidate with max count of addresses placed right after call instruction, because trace contains return addresses,
+// addresses from other mappings, like vdso or shared libraries, are ignored, but most addresses shall fit into executable segments
+func (s *elfSymbolizer) detectBase(addresses []uint64) (uint64, error) {
+	if !s.pie || len(addresses) == 0 {
+		return 0, nil
+	}
+	samples := make([]uint64, 0, min(len(addresses), baseDetectSamples))
+	if len(addresses) > baseDetectSamples {
+		for i := 0; i < baseDetectSamples; i++ {
+			samples = append(samples, addresses[i*len(addresses)/baseDetectSamples])
+		}
+	} else {
+		samples = append(samples, addresses...)
+	}
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	textStart, textEnd := s.segments[0].vaddr, uint64(0)
+	for _, segment := range s.segments {
+		textStart, textEnd = min(textStart, segment.vaddr), max(textEnd, segment.vaddr+uint64(len(segment.data)))
+	}
+	// samples[first:last] is the largest group of addresses which fit into executable segments size
+	first, last := 0, 0
+	for i, j := 0, 0; i < len(samples); i++ {
+		for j < len(samples) && samples[j]-samples[i] <= textEnd-textStart {
+			j++
+		}
+		if j-i > last-first {
+			first, last = i, j
+		}
+	}
+	inside := samples[first:last]
+	minAddress, maxAddress := inside[0], inside[len(inside)-1]
+	if len(inside)*2 <= len(samples) || minAddress < textStart {
+		return 0, errors.Errorf("only %d of %d addresses fit into %s, wrong binary", len(inside), len(samples), s.path)
+	}
+	if len(inside) < len(samples) {
+		log.Debug().Int("ignored", len(samples)-len(inside)).Int("samples", len(samples)).Msg("addresses outside of symbols-binary ignored")
+	}
+	// base+textStart <= minAddress and maxAddress <= base+textEnd
+	low, high := uint64(0), (minAddress-textStart)/s.align*s.align
+	if maxAddress > textEnd {
+		low = (maxAddress - textEnd + s.align - 1) / s.align * s.align
+	}
+	if low > high {
+		return 0, errors.Errorf("addresses from %#x to %#x don't match %s, wrong binary", minAddress, maxAddress, s.path)
+	}
+	if (high-low)/s.align > maxBaseCandidates {
+		return 0, errors.Errorf("too many PIE load address candidates for %s, pass symbols-base-address", s.path)
+	}
+	bestBase, bestScore, bestCount := uint64(0), -1, 0
+	for base := low; base <= high; base += s.align {
+		score := 0
+		for _, address := range inside {
+			if s.afterCall(address - base) {
+				score++
+			}
+		}
+		if score > bestScore {
+			bestBase, bestScore, bestCount = base, score, 1
+		} else if score == bestScore {
+			bestCount++
+		}
+	}
+	// leaf frames are not return addresses, so not all addresses placed after call instruction
+	if bestCount > 1 || bestScore*2 < len(inside) {
+		return 0, errors.Errorf("can't detect PIE load address for %s, best candidate %#x matched %d of %d addresses, pass symbols-base-address", s.path, bestBase, bestScore, len(inside))
+	}
+	log.Debug().Str("base", fmt.Sprintf("%#x", bestBase)).Int("matched", bestScore).Int("samples", len(inside)).Msg("detect PIE load address")
+	return bestBase, nil
+}
+
+// afterCall check instruction before vaddr is call, only x86_64 and aarch64 supported
+func (s *elfSymbolizer) afterCall(vaddr uint64) bool {
+	for _, segment := range s.segments {
+		if vaddr < segment.vaddr || vaddr > segment.vaddr+uint64(len(segment.data)) {
+			continue
+		}
+		offset := vaddr - segment.vaddr
+		switch s.machine {
+		case elf.EM_X86_64:
+			// call rel32 is e8 xx xx xx xx, indirect call is ff /2 with 2..7 bytes length
+			if offset >= 5 && segment.data[offset-5] == 0xe8 {
+				return true
+			}
+			for length := uint64(2); length <= 7 && length <= offset; length++ {
+				if segment.data[offset-length] == 0xff && (segment.data[offset-length+1]>>3)&7 == 2 {
+					return true
+				}
+			}
+		case elf.EM_AARCH64:
+			// bl and blr, all instructions are 4 bytes
+			if offset >= 4 {
+				instruction := binary.LittleEndian.Uint32(segment.data[offset-4 : offset])
+				return instruction&0xfc000000 == 0x94000000 || instruction&0xfffffc1f == 0xd63f0000
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// resolve return frames in the same format as demangle(addressToSymbol(x)) + '#' + addressToLine(x) on server,
+// addresses are runtime addresses, base is PIE load address
+func (s *elfSymbolizer) resolve(addresses []uint64, base uint64) (map[uint64]string, error) {
+	vaddrs := make([]uint64, 0, len(addresses))
+	for _, address := range addresses {
+		vaddrs = append(vaddrs, address-base)
+	}
+	sort.Slice(vaddrs, func(i, j int) bool { return vaddrs[i] < vaddrs[j] })
+	lines, err := s.resolveLines(vaddrs)
+	if err != nil {
+		return nil, err
+	}
+	frames := make(map[uint64]string, len(addresses))
+	for _, vaddr := range vaddrs {
+		frames[vaddr+base] = s.funcName(vaddr) + "#" + lines[vaddr]
+	}
+	return frames, nil
+}
+
+// funcName return demangled name of function which contains vaddr, empty when not found
+func (s *elfSymbolizer) funcName(vaddr uint64) string {
+	i := sort.Search(len(s.funcs), func(i int) bool { return s.funcs[i].Value > vaddr }) - 1
+	if i < 0 {
+		return ""
+	}
+	symbol := s.funcs[i]
+	if vaddr >= symbol.Value+symbol.Size {
+		return ""
+	}
+	return demangle.Filter(symbol.Name)
+}
+
+// resolveLines scan DWARF line tables once for all sorted vaddrs, return file:line for each found vaddr
+func (s *elfSymbolizer) resolveLines(vaddrs []uint64) (map[uint64]string, error) {
+	lines := make(map[uint64]string, len(vaddrs))
+	if s.lines == nil || len(vaddrs) == 0 {
+		return lines, nil
+	}
+	reader := s.lines.Reader()
+	for {
+		cu, err := reader.Next()
+		if err != nil {
+			return nil, errors.Wrapf(err, "can't read DWARF from %s", s.path)
+		}
+		if cu == nil {
+			break
+		}
+		if cu.Tag != dwarf.TagCompileUnit {
+			reader.SkipChildren()
+			continue
+		}
+		lineReader, err := s.lines.LineReader(cu)
+		reader.SkipChildren()
+		if err != nil || lineReader == nil {
+			continue
+		}
+		var prev dwarf.LineEntry
+		hasPrev := false
+		for {
+			var entry dwarf.LineEntry
+			if err := lineReader.Next(&entry); err != nil {
+				break
+			}
+			if hasPrev && entry.Address > prev.Address && prev.File != nil {
+				// vaddrs in [prev.Address, entry.Address) belong to prev line
+				for i := sort.Search(len(vaddrs), func(i int) bool { return vaddrs[i] >= prev.Address }); i < len(vaddrs) && vaddrs[i] < entry.Address; i++ {
+					lines[vaddrs[i]] = fmt.Sprintf("%s:%d", prev.File.Name, prev.Line)
+				}
+			}
+			prev, hasPrev = entry, !entry.EndSequence
+		}
+	}
+	return lines, nil
+}
+
+// matchBuildId compare server buildId() with local binary build-id, ClickHouse return build-id in upper case
+func (s *elfSymbolizer) matchBuildId(serverBuildId string) bool {
+	return s.buildId == "" || serverBuildId == "" || strings.EqualFold(s.buildId, serverBuildId)
+}
@@ -0,0 +1,76 @@
+package flamegraph
+
+import (
+	"debug/elf"
+	"testing"
+)
+
+// testELFSymbolizer return x86_64 PIE with one executable segment, which contains call rel32 instruction before each of returnOffsets
+func testELFSymbolizer(returnOffsets []uint64) *elfSymbolizer {
+	data := make([]byte, 0x4000)
+	for _, offset := range returnOffsets {
+		data[offset-5] = 0xe8
+	}
+	return &elfSymbolizer{path: "clickhouse", machine: elf.EM_X86_64, pie: true, align: 0x1000, segments: []elfSegment{{vaddr: 0x1000, data: data}}}
+}
+
+func TestDetectBase(t *testing.T) {
+	const base = 0x555555554000
+	returnOffsets := []uint64{0x105, 0x377, 0x1234, 0x2005, 0x3333}
+	binaryAddresses := make([]uint64, 0, len(returnOffsets))
+	for _, offset := range returnOffsets {
+		binaryAddresses = append(binaryAddresses, base+0x1000+offset)
+	}
+	vdso, libc := uint64(0x7ffd12345678), uint64(0x7f0012345678)
+	testCases := []struct {
+		name      string
+		addresses []uint64
+		pie       bool
+		expected  uint64
+		isError   bool
+	}{
+		{name: "non PIE", addresses: binaryAddresses, expected: 0},
+		{name: "only binary", addresses: binaryAddresses, pie: true, expected: base},
+		{name: "vdso and libc ignored", addresses: append([]uint64{vdso, libc}, binaryAddresses...), pie: true, expected: base},
+		// leaf frame isn't a return address
+		{name: "leaf frame", addresses: append([]uint64{base + 0x1000 + 0x2222}, binaryAddresses...), pie: true, expected: base},
+		{name: "most addresses outside", addresses: append([]uint64{vdso, vdso + 8, libc, libc + 8, libc + 16, libc + 24}, binaryAddresses[:2]...), pie: true, isError: true},
+		{name: "wrong binary", addresses: []uint64{vdso, vdso + 0x100, vdso + 0x200}, pie: true, isError: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := testELFSymbolizer(returnOffsets)
+			s.pie = tc.pie
+			actual, err := s.detectBase(tc.addresses)
+			if tc.isError != (err != nil) {
+				t.Fatalf("unexpected error = %v", err)
+			}
+			if actual != tc.expected {
+				t.Errorf("expected %#x, got %#x", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestAfterCall(t *testing.T) {
+	s := testELFSymbolizer([]uint64{0x105})
+	// ff 15 xx xx xx xx is call [rip+rel32]
+	s.segments[0].data[0x200] = 0xff
+	s.segments[0].data[0x201] = 0x15
+	testCases := []struct {
+		vaddr    uint64
+		expected bool
+	}{
+		{0x1105, true},
+		{0x1106, false},
+		{0x1206, true},
+		{0x1003, false},
+		{0x0fff, false},
+		{0x9000, false},
+	}
+	for _, tc := range testCases {
+		if actual := s.afterCall(tc.vaddr); actual != tc.expected {
+			t.Errorf("afterCall(%#x) expected %v, got %v", tc.vaddr, tc.expected, actual)
+		}
+	}
+}
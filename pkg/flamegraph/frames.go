@@ -0,0 +1,94 @@
+package flamegraph
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// frameFilter applied to folded stacks before aggregation, the same way as pprof -focus, -ignore, -hide and -prune_from options,
+// first trace_type or allocate/free frame is never matched
+type frameFilter struct {
+	focus     *regexp.Regexp
+	ignore    *regexp.Regexp
+	hide      *regexp.Regexp
+	pruneFrom *regexp.Regexp
+}
+
+// newFrameFilter compile regexps, return nil when all regexps are empty
+func newFrameFilter(focus, ignore, hide, pruneFrom string) (*frameFilter, error) {
+	if focus == "" && ignore == "" && hide == "" && pruneFrom == "" {
+		return nil, nil
+	}
+	f := &frameFilter{}
+	for name, re := range map[string]struct {
+		value    string
+		compiled **regexp.Regexp
+	}{
+		"focus":      {focus, &f.focus},
+		"ignore":     {ignore, &f.ignore},
+		"hide":       {hide, &f.hide},
+		"prune-from": {pruneFrom, &f.pruneFrom},
+	} {
+		if re.value == "" {
+			continue
+		}
+		compiled, err := regexp.Compile(re.value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s = %s", name, re.value)
+		}
+		*re.compiled = compiled
+	}
+	return f, nil
+}
+
+// apply return false when stack shall be dropped, focus keep only stacks with matched frame, ignore drop stacks with matched frame,
+// prune-from drop frames called from matched frame, hide remove matched frames
+func (f *frameFilter) apply(frames string) (string, bool) {
+	if f == nil {
+		return frames, true
+	}
+	traceTypeFrame, rest, found := strings.Cut(frames, ";")
+	if !found {
+		return frames, f.focus == nil
+	}
+	callStack := strings.Split(rest, ";")
+	if f.focus != nil && !anyFrameMatch(f.focus, callStack) {
+		return "", false
+	}
+	if f.ignore != nil && anyFrameMatch(f.ignore, callStack) {
+		return "", false
+	}
+	if f.pruneFrom != nil {
+		// frames ordered from root to leaf, so the deepest matched frame is kept, the same way as pprof
+		for i := len(callStack) - 1; i >= 0; i-- {
+			if f.pruneFrom.MatchString(callStack[i]) {
+				callStack = callStack[:i+1]
+				break
+			}
+		}
+	}
+	if f.hide != nil {
+		visible := callStack[:0]
+		for _, frame := range callStack {
+			if !f.hide.MatchString(frame) {
+				visible = append(visible, frame)
+			}
+		}
+		callStack = visible
+	}
+	if len(callStack) == 0 {
+		return traceTypeFrame, true
+	}
+	return traceTypeFrame + ";" + strings.Join(callStack, ";"), true
+}
+
+func anyFrameMatch(re *regexp.Regexp, frames []string) bool {
+	for _, frame := range frames {
+		if re.MatchString(frame) {
+			return true
+		}
+	}
+	return false
+}
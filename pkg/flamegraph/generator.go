@@ -0,0 +1,517 @@
+package flamegraph
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	queryIdSQLTemplate = `
+SELECT DISTINCT hostName() AS host_name, {queryField}, {queryIdField}
+FROM {from}
+WHERE {where}
+`
+
+	traceSQLTemplate = `
+SELECT
+	hostName() AS host_name,
+    {queryIdField},
+	trace_type,{threadFields}{bucketFields}
+	sum(abs(size)) AS total_size,
+	count() AS samples,
+	{maxEventTime} AS max_event_time,
+	concat(
+		multiIf(
+			position( toString(trace_type), 'Memory') > 0 AND sum(size) >= 0, 'allocate;',
+			position( toString(trace_type), 'Memory') > 0 AND sum(size) < 0, 'free;',
+			concat( toString(trace_type), ';')
+		),
+		{framesExpr}
+	) AS stack
+FROM {from}
+WHERE {where}
+GROUP BY host_name, query_id, trace_type, trace{threadGroupBy}{bucketGroupBy}
+ORDER BY host_name, query_id,{threadOrderBy}{bucketOrderBy} trace_type
+{settings}
+`
+)
+
+// Generator fetch stacks from system.trace_log and write flamegraphs in Options.OutputFormat into Options.OutputDir
+type Generator struct {
+	opts           Options
+	db             *sql.DB
+	serverTimeZone *time.Location
+	// symbolsBinary loaded once from Options.SymbolsBinary, nil when not set
+	symbolsBinary *elfSymbolizer
+	// dump contains imported system.trace_log and system.query_log rows, db is nil when set
+	dump *traceDump
+	// flusher limit SYSTEM FLUSH LOGS for repeated Generate calls from Watch, nil means flush on each Generate
+	flusher *logFlusher
+}
+
+// NewGenerator open ClickHouse connection and check server version, Close shall be called when Generator is not needed anymore
+func NewGenerator(ctx context.Context, opts Options) (*Generator, error) {
+	if err := validateOutputFormat(opts.OutputFormat); err != nil {
+		return nil, err
+	}
+	if err := validateInvert(opts.OutputFormat, opts.Invert); err != nil {
+		return nil, err
+	}
+	opts = opts.withDefaults()
+	tlsConfig, err := prepareTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openDbConnection(ctx, opts.DSN, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkClickHouseVersion(ctx, db, opts.NormalizeQuery); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	serverTimeZone, err := getServerTimeZone(ctx, db)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	var symbolsBinary *elfSymbolizer
+	if opts.SymbolsBinary != "" {
+		if symbolsBinary, err = openELFSymbolizer(opts.SymbolsBinary); err != nil {
+			_ = db.Close()
+			return nil, err
+		}
+	}
+	return &Generator{opts: opts, db: db, serverTimeZone: serverTimeZone, symbolsBinary: symbolsBinary}, nil
+}
+
+// Options return options with applied defaults
+func (g *Generator) Options() Options {
+	return g.opts
+}
+
+// Close ClickHouse connection
+func (g *Generator) Close() error {
+	if g.db == nil {
+		return nil
+	}
+	return errors.Wrap(g.db.Close(), "can't close ClickHouse connection")
+}
+
+// FlushLogs run SYSTEM FLUSH LOGS, so latest samples become visible in system.trace_log
+func (g *Generator) FlushLogs(ctx context.Context) error {
+	if g.db == nil {
+		return nil
+	}
+	return flushSystemLog(ctx, g.db)
+}
+
+// Generate write outputDir/hostname/queryId.sql for each query and outputDir/hostname/queryId.traceType.* flamegraphs, global means all queries for hostname,
+// when Options.Top is set, only top queries written, outputDir/index.html contains links to all written files
+func (g *Generator) Generate(ctx context.Context) error {
+	flushLogs := g.FlushLogs
+	if g.flusher != nil {
+		flushLogs = g.flusher.flushLogs
+	}
+	if err := flushLogs(ctx); err != nil {
+		return err
+	}
+	if err := g.createOutputDir(); err != nil {
+		return err
+	}
+	frames, err := newFrameFilter(g.opts.Focus, g.opts.Ignore, g.opts.Hide, g.opts.PruneFrom)
+	if err != nil {
+		return err
+	}
+	filter, state := g.opts.Filter, (*runState)(nil)
+	if g.opts.StateFile != "" {
+		if g.opts.Leaks {
+			return errors.New("leaks can't be used with state-file, because allocations freed in next runs would stay leaked")
+		}
+		if state, err = loadState(g.opts.StateFile); err != nil {
+			return err
+		}
+		filter.HostsDateFrom = state.Hosts
+		filter = capClusterDateTo(filter, time.Now())
+	}
+	topQueries, err := g.topQueriesSet(ctx, filter)
+	if err != nil {
+		return err
+	}
+	if err := g.writeQuerySQLFiles(ctx, filter, topQueries); err != nil {
+		return err
+	}
+	stacks := newStackAggregator(g.opts.MaxMemoryStacks)
+	defer func() {
+		if err := stacks.close(); err != nil {
+			log.Warn().Err(err).Send()
+		}
+	}()
+	renderCtx, cancelRender := context.WithCancel(ctx)
+	defer cancelRender()
+	pool := newRenderPool(renderCtx, g.opts.Parallelism, g.renderProfile)
+	submitHost := func(hostName string) {
+		for _, key := range stacks.keys() {
+			if key.hostName == hostName {
+				pool.submit(key, stacks.take(key))
+			}
+		}
+	}
+
+	isTop := func(queryId string) bool {
+		return topQueries == nil || topQueries[queryId]
+	}
+
+	// totals used in index.html, lastEventTimes used in state-file, fetch callback called sequentially
+	totals := make(map[profileKey]uint64)
+	lastEventTimes := make(map[string]time.Time)
+
+	// rows ordered by host_name, query_id, thread_id, trace_type, so profile is complete when next key fetched
+	var lastKey profileKey
+	err = g.FetchStacks(ctx, filter, func(s Stack) error {
+		if s.LastEventTime.After(lastEventTimes[s.HostName]) {
+			lastEventTimes[s.HostName] = s.LastEventTime
+		}
+		key := profileKey{hostName: s.HostName, queryId: s.QueryId, traceType: s.TraceType}
+		globalKey := profileKey{hostName: s.HostName, queryId: "global", traceType: s.TraceType}
+		if g.opts.GroupBy == GroupByThread {
+			key.thread = threadProfileName(s.ThreadName, s.ThreadId, false)
+			globalKey.thread = threadProfileName(s.ThreadName, s.ThreadId, true)
+		}
+		key.bucket = bucketName(g.opts.Bucket, s.Bucket)
+		globalKey.bucket = key.bucket
+		var accepted bool
+		if s.Frames, accepted = frames.apply(s.Frames); !accepted {
+			return nil
+		}
+		if g.opts.Invert {
+			s.Frames = invertFrames(s.Frames, g.opts.GroupBy)
+		}
+		if key != lastKey {
+			if lastKey.queryId != "" && isTop(lastKey.queryId) {
+				pool.submit(lastKey, stacks.take(lastKey))
+			}
+			if lastKey.hostName != "" && lastKey.hostName != s.HostName {
+				submitHost(lastKey.hostName)
+			}
+			lastKey = key
+		}
+		if s.QueryId != "" && isTop(s.QueryId) {
+			if err := stacks.add(key, s.Frames, s.Value); err != nil {
+				return err
+			}
+			totals[key] += s.Value
+		}
+		totals[globalKey] += s.Value
+		return stacks.add(globalKey, s.Frames, s.Value)
+	})
+	if err != nil {
+		cancelRender()
+		pool.wait()
+		return err
+	}
+	for _, key := range stacks.keys() {
+		pool.submit(key, stacks.take(key))
+	}
+	rendered, profileErrors := pool.wait()
+	committed := rendered
+	if state != nil {
+		committed, profileErrors = g.commitStackFiles(state, rendered, profileErrors, lastEventTimes)
+		formatPool := newRenderPool(ctx, g.opts.Parallelism, g.renderFormats)
+		for _, key := range committed {
+			formatPool.submit(key, nil)
+		}
+		var formatErrors ProfileErrors
+		rendered, formatErrors = formatPool.wait()
+		profileErrors = append(profileErrors, formatErrors...)
+	}
+
+	if g.opts.OutputFormat == "speedscope" {
+		speedscope := newSpeedscopeBuilder(
+			fmt.Sprintf("clickhouse-flamegraph from %s to %s", g.formatDate(g.opts.DateFrom), g.formatDate(g.opts.DateTo)),
+			"clickhouse-flamegraph",
+		)
+		for _, key := range rendered {
+			if err := addSpeedscopeProfile(speedscope, key, g.stackFileName(key)); err != nil {
+				return err
+			}
+		}
+		if err := g.writeSpeedscope(speedscope); err != nil {
+			return err
+		}
+	}
+	indexProfiles, indexDateFrom := rendered, g.opts.DateFrom
+	if state != nil {
+		// committed profiles already merged with existing folded files, so totals updated even when some formats failed
+		if state.DateFrom.IsZero() {
+			state.DateFrom = g.opts.DateFrom
+		}
+		indexDateFrom = state.DateFrom
+		indexProfiles, totals = state.merge(committed, totals)
+		if err := state.save(g.opts.StateFile); err != nil {
+			return err
+		}
+	}
+	if err := g.writeIndex(indexProfiles, totals, indexDateFrom); err != nil {
+		return err
+	}
+	if g.opts.Bucket > 0 {
+		if err := g.writeBucketsCSV(indexProfiles, totals); err != nil {
+			return err
+		}
+	}
+	log.Info().Int("processedFiles", len(rendered)).Int("failedFiles", len(profileErrors)).Msg("done processing")
+	if len(profileErrors) > 0 {
+		return profileErrors
+	}
+	return nil
+}
+
+// Stack is one aggregated row from system.trace_log
+type Stack struct {
+	HostName  string
+	QueryId   string
+	TraceType string
+	// ThreadId and ThreadName filled only when Filter.GroupBy is thread or thread-root, ThreadName is empty when system.query_thread_log is not available
+	ThreadId   uint64
+	ThreadName string
+	// Frames separated by ";", first frame is trace_type, or allocate/free for Memory trace types, or leak when Filter.Leaks is set
+	Frames string
+	// Value is bytes for Memory trace types and samples for others
+	Value uint64
+	// LastEventTime is max event_time of aggregated samples, max event_time_microseconds when Filter.HostsDateFrom is set
+	LastEventTime time.Time
+	// Bucket is toStartOfInterval(event_time) filled only when Filter.Bucket is set
+	Bucket time.Time
+}
+
+// FetchStacks run traceSQLTemplate with applied filters and pass each row to fetchCallback
+func (g *Generator) FetchStacks(ctx context.Context, filter Filter, fetchCallback func(s Stack) error) error {
+	filter = g.inServerTimeZone(filter)
+	traceTypes := filter.TraceTypes
+	if len(traceTypes) == 0 {
+		traceTypes = DefaultTraceTypes
+	}
+	if err := validateGroupBy(filter.GroupBy); err != nil {
+		return err
+	}
+	if err := validateBucket(filter.Bucket); err != nil {
+		return err
+	}
+	if g.dump != nil {
+		return g.dump.fetchStacks(filter, traceTypes, fetchCallback)
+	}
+	if err := validateCluster(ctx, g.db, filter.Cluster); err != nil {
+		return err
+	}
+	traceFrom, traceFromArgs, stackWhere, stackArgs, queryIdField, err := traceLogSource(filter, traceTypes)
+	if err != nil {
+		return err
+	}
+	framesExpr, settings := serverFramesExpr, "SETTINGS allow_introspection_functions=1"
+	var symbols *symbolizer
+	if g.opts.ClientSymbolize || g.symbolsBinary != nil {
+		framesExpr, settings = rawFramesExpr, ""
+		if symbols, err = g.newSymbolizer(ctx, filter, traceFrom, traceFromArgs, stackWhere, stackArgs); err != nil {
+			return err
+		}
+	}
+
+	threadFields, threadGroupBy, threadOrderBy := "", "", ""
+	if filter.GroupBy == GroupByThread || filter.GroupBy == GroupByThreadRoot {
+		threadFields, threadGroupBy = "\n\tt.thread_id AS thread_id,\n\t'' AS thread_name,", ", thread_id, thread_name"
+		// thread-root add thread frame into stack, so profile key doesn't contain thread and rows for one profile shall not be split by thread_id
+		if filter.GroupBy == GroupByThread {
+			threadOrderBy = " thread_id,"
+		}
+		threadFrom, threadFromArgs, err := g.threadNameJoin(ctx, filter)
+		if err != nil {
+			return err
+		}
+		if threadFrom != "" {
+			threadFields = "\n\tt.thread_id AS thread_id,\n\tth.thread_name AS thread_name,"
+			traceFrom += threadFrom
+			traceFromArgs = append(traceFromArgs, threadFromArgs...)
+		}
+	}
+
+	sqlTemplate := traceSQLTemplate
+	if filter.Leaks {
+		if err := checkTraceLogPtr(ctx, g.db); err != nil {
+			return err
+		}
+		sqlTemplate, threadFields = leakSQL(threadFields)
+	}
+	bucketFields, bucketGroupBy, bucketOrderBy := bucketSQL(filter.Bucket)
+	// state-file high-water mark require microseconds, see applyHostsDateFrom,
+	// unix timestamps selected instead of DateTime, because chhttp parse DateTime without timezone as UTC
+	maxEventTime, maxEventTimeUnit := "toUnixTimestamp(max(event_time))", time.Second
+	if filter.HostsDateFrom != nil {
+		maxEventTime, maxEventTimeUnit = "toUnixTimestamp64Micro(max(event_time_microseconds))", time.Microsecond
+	}
+	stackSQL := formatSQLTemplate(sqlTemplate, map[string]interface{}{
+		"where":         stackWhere,
+		"from":          traceFrom,
+		"queryIdField":  queryIdField,
+		"framesExpr":    framesExpr,
+		"settings":      settings,
+		"threadFields":  threadFields,
+		"threadGroupBy": threadGroupBy,
+		"threadOrderBy": threadOrderBy,
+		"bucketFields":  bucketFields,
+		"bucketGroupBy": bucketGroupBy,
+		"bucketOrderBy": bucketOrderBy,
+		"maxEventTime":  maxEventTime,
+	})
+	stackArgs = append(traceFromArgs, stackArgs...)
+	stackSQL = formatSQLTemplate(stackSQL, map[string]interface{}{
+		"where": stackWhere,
+	})
+	return fetchQuery(ctx, g.db, stackSQL, stackArgs, func(r map[string]interface{}) error {
+		s := Stack{
+			HostName:      r["host_name"].(string),
+			QueryId:       r["query_id"].(string),
+			TraceType:     r["trace_type"].(string),
+			Frames:        r["stack"].(string),
+			Value:         r["samples"].(uint64),
+			LastEventTime: unixTime(r["max_event_time"], maxEventTimeUnit, g.serverTimeZone),
+		}
+		if strings.Contains(s.TraceType, "Memory") {
+			s.Value = r["total_size"].(uint64)
+		}
+		if symbols != nil {
+			s.Frames = symbols.symbolize(s.HostName, s.Frames)
+		}
+		if bucketFields != "" {
+			s.Bucket = unixTime(r["bucket"], time.Second, g.serverTimeZone)
+		}
+		if threadGroupBy != "" {
+			s.ThreadId = r["thread_id"].(uint64)
+			s.ThreadName = r["thread_name"].(string)
+			if filter.GroupBy == GroupByThreadRoot {
+				s.Frames = addThreadFrame(s.Frames, s.ThreadName, s.ThreadId)
+			}
+		}
+		return fetchCallback(s)
+	})
+}
+
+// traceLogSource return system.trace_log JOIN system.query_log with {where} placeholder inside query_log subquery,
+// the same where shall be applied twice, because query_log columns used in filters not available before JOIN
+func traceLogSource(filter Filter, traceTypes []string) (traceFrom string, traceFromArgs []interface{}, where string, whereArgs []interface{}, queryIdField string, err error) {
+	traceTypesIn, traceTypesArgs := inPlaceholders(traceTypes)
+	where, whereArgs = addWhereArgs(" trace_type IN "+traceTypesIn, " AND event_time >= ? AND event_time <= ?", traceTypesArgs, filter.earliestDateFrom(), filter.DateTo)
+	where, whereArgs = applyHostsDateFrom(filter, where, whereArgs)
+	where, whereArgs, err = applyQueryFilter(filter, where, whereArgs)
+	if err != nil {
+		return "", nil, "", nil, "", err
+	}
+
+	if filter.NormalizeQuery {
+		queryIdField = "toString(normalizedQueryHash(q.query)) AS query_id"
+	} else {
+		queryIdField = "replaceAll(t.query_id,':','_') AS query_id"
+	}
+
+	// arguments order shall be the same as placeholders order in result SQL
+	traceLogTable, traceFromArgs := systemTable(filter, "trace_log")
+	queryLogTable, queryLogArgs := systemTable(filter, "query_log")
+	// query_log columns used in filters shall be selected, because the same {where} applied to trace_log JOIN query_log
+	queryLogFields := strings.Join(append([]string{"query_id", "query", "? AS trace_type"}, queryLogColumns(filter)...), ", ")
+	traceFrom = traceLogTable + " AS t ANY LEFT JOIN (SELECT " + queryLogFields + " FROM " + queryLogTable + " WHERE {where}) AS q ON q.query_id=t.query_id"
+	traceFromArgs = append(traceFromArgs, traceTypes[0])
+	traceFromArgs = append(traceFromArgs, queryLogArgs...)
+	traceFromArgs = append(traceFromArgs, whereArgs...)
+	return traceFrom, traceFromArgs, where, whereArgs, queryIdField, nil
+}
+
+// inServerTimeZone convert filter dates, because event_time compared in ClickHouse server timezone
+func (g *Generator) inServerTimeZone(filter Filter) Filter {
+	filter.DateFrom = filter.DateFrom.In(g.serverTimeZone)
+	filter.DateTo = filter.DateTo.In(g.serverTimeZone)
+	if len(filter.HostsDateFrom) > 0 {
+		hostsDateFrom := make(map[string]time.Time, len(filter.HostsDateFrom))
+		for hostName, dateFrom := range filter.HostsDateFrom {
+			hostsDateFrom[hostName] = dateFrom.In(g.serverTimeZone)
+		}
+		filter.HostsDateFrom = hostsDateFrom
+	}
+	return filter
+}
+
+func (g *Generator) formatDate(t time.Time) string {
+	return t.In(g.serverTimeZone).Format("2006-01-02 15:04:05 -0700")
+}
+
+func (g *Generator) createOutputDir() error {
+	if err := os.MkdirAll(g.opts.OutputDir, 0755); err != nil {
+		return errors.Wrapf(err, "failed create output-dir = %s", g.opts.OutputDir)
+	}
+	return nil
+}
+
+// writeQuerySQLFiles write outputDir/hostname/queryId.sql for each query from system.query_log, only for queryIds when not nil
+func (g *Generator) writeQuerySQLFiles(ctx context.Context, filter Filter, queryIds map[string]bool) error {
+	filter = g.inServerTimeZone(filter)
+	if g.dump != nil {
+		return g.dump.writeQuerySQLFiles(g.opts.OutputDir, filter, queryIds)
+	}
+	var queryField, queryIdField string
+	if err := validateCluster(ctx, g.db, filter.Cluster); err != nil {
+		return err
+	}
+	queryLogTable, queryIdArgs := systemTable(filter, "query_log")
+
+	if filter.NormalizeQuery {
+		queryField = "normalizeQuery(q.query) AS query"
+		queryIdField = "toString(normalizedQueryHash(q.query)) AS query_id"
+	} else {
+		queryField = "q.query"
+		queryIdField = "q.query_id"
+	}
+
+	queryIdWhere, queryIdArgs, err := applyQueryFilter(filter, "event_time >= ? AND event_time <= ?", append(queryIdArgs, filter.earliestDateFrom(), filter.DateTo))
+	if err != nil {
+		return err
+	}
+	queryIdSQL := formatSQLTemplate(
+		queryIdSQLTemplate,
+		map[string]interface{}{
+			"where":        queryIdWhere,
+			"from":         queryLogTable + " AS q",
+			"queryField":   queryField,
+			"queryIdField": queryIdField,
+		},
+	)
+
+	sqlFiles := 0
+	err = fetchQuery(ctx, g.db, queryIdSQL, queryIdArgs, func(r map[string]interface{}) error {
+		// trace_log query_id contains ":" replaced to "_"
+		if queryIds != nil && !queryIds[strings.ReplaceAll(r["query_id"].(string), ":", "_")] {
+			return nil
+		}
+		sqlDir := filepath.Join(g.opts.OutputDir, r["host_name"].(string))
+		if err := os.MkdirAll(sqlDir, 0755); err != nil {
+			return errors.Wrapf(err, "can't create %s", sqlDir)
+		}
+		sqlFile := filepath.Join(sqlDir, r["query_id"].(string)+".sql")
+		if err := os.WriteFile(sqlFile, []byte(r["query"].(string)), 0644); err != nil {
+			return errors.Wrapf(err, "can't write %s", sqlFile)
+		}
+		sqlFiles++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Info().Int("sqlFiles", sqlFiles).Msg("write .sql files")
+	return nil
+}
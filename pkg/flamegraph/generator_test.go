@@ -0,0 +1,207 @@
+package flamegraph
+
+import (
+	"context"
+	"database/sql/driver"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTraceLog is system.trace_log export in TSVWithNames format used by tests without ClickHouse
+const testTraceLog = `hostname	event_time	query_id	trace_type	thread_id	size	trace	symbols	lines
+host1	2026-10-01 10:00:00	q1	CPU	1	0	[1,2]	['foo','main']	['a.cpp:2','a.cpp:1']
+host1	2026-10-01 10:00:01	q1	CPU	1	0	[1,2]	['foo','main']	['a.cpp:2','a.cpp:1']
+host1	2026-10-01 10:00:01	q1	Real	1	0	[1,2]	['foo','main']	['a.cpp:2','a.cpp:1']
+host1	2026-10-01 10:00:02	q1	CPU	2	0	[3,2]	['bar','main']	['a.cpp:3','a.cpp:1']
+host1	2026-10-01 10:00:03	q1	Real	2	0	[3,2]	['bar','main']	['a.cpp:3','a.cpp:1']
+`
+
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	fileName := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(fileName, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+// readOutputFiles return outputDir/host/*.txt content, key is file path relative to outputDir
+func readOutputFiles(t *testing.T, outputDir string) map[string]string {
+	t.Helper()
+	fileNames, err := filepath.Glob(filepath.Join(outputDir, "*", "*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string, len(fileNames))
+	for _, fileName := range fileNames {
+		data, err := os.ReadFile(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		relName, _ := filepath.Rel(outputDir, fileName)
+		files[filepath.ToSlash(relName)] = string(data)
+	}
+	return files
+}
+
+func TestGenerateProfileBoundaries(t *testing.T) {
+	traceLog := writeTestFile(t, "host1.tsv", testTraceLog)
+	testCases := []struct {
+		groupBy  string
+		expected map[string]string
+	}{
+		{
+			groupBy: GroupByQuery,
+			expected: map[string]string{
+				"host1/q1.CPU.txt":      "CPU;main#a.cpp:1;bar#a.cpp:3 1\nCPU;main#a.cpp:1;foo#a.cpp:2 2\n",
+				"host1/q1.Real.txt":     "Real;main#a.cpp:1;bar#a.cpp:3 1\nReal;main#a.cpp:1;foo#a.cpp:2 1\n",
+				"host1/global.CPU.txt":  "CPU;main#a.cpp:1;bar#a.cpp:3 1\nCPU;main#a.cpp:1;foo#a.cpp:2 2\n",
+				"host1/global.Real.txt": "Real;main#a.cpp:1;bar#a.cpp:3 1\nReal;main#a.cpp:1;foo#a.cpp:2 1\n",
+			},
+		},
+		{
+			groupBy: GroupByThread,
+			expected: map[string]string{
+				"host1/q1.thread_1.CPU.txt":    "CPU;main#a.cpp:1;foo#a.cpp:2 2\n",
+				"host1/q1.thread_1.Real.txt":   "Real;main#a.cpp:1;foo#a.cpp:2 1\n",
+				"host1/q1.thread_2.CPU.txt":    "CPU;main#a.cpp:1;bar#a.cpp:3 1\n",
+				"host1/q1.thread_2.Real.txt":   "Real;main#a.cpp:1;bar#a.cpp:3 1\n",
+				"host1/global.thread.CPU.txt":  "CPU;main#a.cpp:1;bar#a.cpp:3 1\nCPU;main#a.cpp:1;foo#a.cpp:2 2\n",
+				"host1/global.thread.Real.txt": "Real;main#a.cpp:1;bar#a.cpp:3 1\nReal;main#a.cpp:1;foo#a.cpp:2 1\n",
+			},
+		},
+		{
+			// one profile for each query_id, rows of all threads shall be rendered into the same file
+			groupBy: GroupByThreadRoot,
+			expected: map[string]string{
+				"host1/q1.CPU.txt":      "CPU;thread [1];main#a.cpp:1;foo#a.cpp:2 2\nCPU;thread [2];main#a.cpp:1;bar#a.cpp:3 1\n",
+				"host1/q1.Real.txt":     "Real;thread [1];main#a.cpp:1;foo#a.cpp:2 1\nReal;thread [2];main#a.cpp:1;bar#a.cpp:3 1\n",
+				"host1/global.CPU.txt":  "CPU;thread [1];main#a.cpp:1;foo#a.cpp:2 2\nCPU;thread [2];main#a.cpp:1;bar#a.cpp:3 1\n",
+				"host1/global.Real.txt": "Real;thread [1];main#a.cpp:1;foo#a.cpp:2 1\nReal;thread [2];main#a.cpp:1;bar#a.cpp:3 1\n",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.groupBy, func(t *testing.T) {
+			opts := Options{OutputDir: t.TempDir(), OutputFormat: "txt"}
+			opts.GroupBy = tc.groupBy
+			g, err := NewImportGenerator(opts, ImportOptions{TraceLogFiles: []string{traceLog}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := g.Generate(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			files := readOutputFiles(t, opts.OutputDir)
+			if len(files) != len(tc.expected) {
+				names := make([]string, 0, len(files))
+				for name := range files {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				t.Fatalf("expected %d files, got %s", len(tc.expected), strings.Join(names, ", "))
+			}
+			for name, expected := range tc.expected {
+				if files[name] != expected {
+					t.Errorf("%s expected:\n%s\ngot:\n%s", name, expected, files[name])
+				}
+			}
+		})
+	}
+}
+
+func TestNewGeneratorOutputFormat(t *testing.T) {
+	traceLog := writeTestFile(t, "host1.tsv", testTraceLog)
+	testCases := []struct {
+		outputFormat string
+		isError      bool
+	}{
+		{"", false},
+		{"svg", false},
+		{"speedscope", false},
+		{"png", true},
+		{"SVG", true},
+	}
+	for _, tc := range testCases {
+		opts := Options{OutputDir: t.TempDir(), OutputFormat: tc.outputFormat}
+		if _, err := NewImportGenerator(opts, ImportOptions{TraceLogFiles: []string{traceLog}}); tc.isError != (err != nil) {
+			t.Errorf("NewImportGenerator output-format = %s unexpected error = %v", tc.outputFormat, err)
+		}
+		// validated before connect, so ClickHouse is not required
+		if tc.isError {
+			if _, err := NewGenerator(context.Background(), opts); err == nil || !strings.Contains(err.Error(), "output-format") {
+				t.Errorf("NewGenerator output-format = %s expected output-format error, got %v", tc.outputFormat, err)
+			}
+		}
+	}
+}
+
+// TestFetchStacksSQLArgs check user values passed as SQL arguments in the same order as placeholders, and never inlined into SQL
+func TestFetchStacksSQLArgs(t *testing.T) {
+	const dates = "event_time >= '2026-10-01 10:00:00' AND event_time <= '2026-10-01 11:00:00'"
+	testCases := []struct {
+		name     string
+		cluster  string
+		expected []string
+	}{
+		{
+			name: "local",
+			expected: []string{
+				"FROM system.trace_log AS t ANY LEFT JOIN (SELECT query_id, query, 'CPU' AS trace_type FROM system.query_log WHERE  trace_type IN ('CPU','Real') AND " + dates + " AND query_id IN ('q1','q\\'2') ) AS q",
+				"WHERE  trace_type IN ('CPU','Real') AND " + dates + " AND query_id IN ('q1','q\\'2') \nGROUP BY",
+			},
+		},
+		{
+			name:    "cluster",
+			cluster: "eu",
+			expected: []string{
+				"FROM clusterAllReplicas('eu', system.trace_log) AS t ANY LEFT JOIN (SELECT query_id, query, 'CPU' AS trace_type FROM clusterAllReplicas('eu', system.query_log) WHERE  trace_type IN ('CPU','Real') AND " + dates + " AND query_id IN ('q1','q\\'2') ) AS q",
+				"WHERE  trace_type IN ('CPU','Real') AND " + dates + " AND query_id IN ('q1','q\\'2') \nGROUP BY",
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			g, ch := newFakeGenerator(t, Options{}, time.UTC, func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+				if strings.Contains(query, "system.clusters") {
+					return []string{"cnt"}, [][]driver.Value{{uint64(1)}}
+				}
+				return nil, nil
+			})
+			filter := Filter{
+				TraceTypes: []string{"CPU", "Real"},
+				QueryIds:   []string{"q1", "q'2"},
+				Cluster:    tc.cluster,
+				DateFrom:   time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC),
+				DateTo:     time.Date(2026, 10, 1, 11, 0, 0, 0, time.UTC),
+			}
+			if err := g.FetchStacks(context.Background(), filter, func(s Stack) error { return nil }); err != nil {
+				t.Fatal(err)
+			}
+			q := ch.findQuery(t, "AS stack")
+			for _, value := range []string{"q1", "q'2", "Real", "2026-10-01"} {
+				if strings.Contains(q.sql, value) {
+					t.Errorf("expected %s passed as SQL argument, got %s", value, q.sql)
+				}
+			}
+			if tc.cluster != "" && strings.Contains(q.sql, "'"+tc.cluster+"'") {
+				t.Errorf("expected cluster passed as SQL argument, got %s", q.sql)
+			}
+			sql := interpolateSQL(q.sql, q.args)
+			for _, expected := range tc.expected {
+				if !strings.Contains(sql, expected) {
+					t.Errorf("expected %s in:\n%s", expected, sql)
+				}
+			}
+			if tc.cluster != "" {
+				if clusters := ch.findQuery(t, "system.clusters"); interpolateSQL(clusters.sql, clusters.args) != "SELECT count() AS cnt FROM system.clusters WHERE cluster = 'eu'" {
+					t.Errorf("unexpected cluster validation %s %v", clusters.sql, clusters.args)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,539 @@
+package flamegraph
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// ImportOptions contains system.trace_log and system.query_log exports used instead of ClickHouse connection
+type ImportOptions struct {
+	// TraceLogFiles exported via SELECT * FROM system.trace_log INTO OUTFILE, required columns: trace_type, query_id, trace,
+	// optional columns: event_time, event_time_microseconds, thread_id, size, ptr, hostname, symbols and lines (when trace_log symbolize=1),
+	// file name without extension used as hostname when hostname column doesn't exist
+	TraceLogFiles []string
+	// QueryLogFiles exported via SELECT * FROM system.query_log INTO OUTFILE, optional, required for .sql files and query_log filters
+	QueryLogFiles []string
+	// InputFormat accept values: DumpFormatTSV, DumpFormatJSONEachRow, DumpFormatNative, DumpFormatParquet, detected by file extension when empty
+	InputFormat string
+}
+
+// traceTypeEnumValues is system.trace_log trace_type Enum8 values, Parquet export contains Enum8 as Int8
+var traceTypeEnumValues = map[string]string{"0": "Real", "1": "CPU", "2": "Memory", "3": "MemorySample", "4": "MemoryPeak", "5": "ProfileEvent"}
+
+// importedTrace is one system.trace_log row, stack already symbolized and ordered from root to leaf
+type importedTrace struct {
+	hostName  string
+	queryId   string
+	traceType string
+	threadId  uint64
+	eventTime time.Time
+	size      int64
+	ptr       uint64
+	stack     string
+}
+
+// traceDump contains all rows from exported files, filters applied in memory the same way as SQL conditions
+type traceDump struct {
+	traces []importedTrace
+	// queries format = query_id -> system.query_log row, QueryFinish and exception rows preferred over QueryStart
+	queries map[string]map[string]interface{}
+	// queryHosts format = query_id -> hostname
+	queryHosts map[string]string
+	// hasPtr is true when trace_log files contain ptr column, required for Filter.Leaks
+	hasPtr bool
+}
+
+// importedStackKey is the same as GROUP BY in traceSQLTemplate
+type importedStackKey struct {
+	hostName  string
+	queryId   string
+	threadId  uint64
+	bucket    time.Time
+	traceType string
+	stack     string
+}
+
+type importedStackValue struct {
+	samples       uint64
+	size          int64
+	totalSize     uint64
+	lastEventTime time.Time
+}
+
+// NewImportGenerator read exported system.trace_log and system.query_log files, Generator works without ClickHouse connection,
+// zero Filter.DateFrom and Filter.DateTo means all rows, NormalizeQuery and Cluster are not supported, thread names are not resolved,
+// event_time from text formats parsed in local time zone
+func NewImportGenerator(opts Options, importOpts ImportOptions) (*Generator, error) {
+	if opts.NormalizeQuery {
+		return nil, errors.New("normalize-query is not supported for imported files, normalizedQueryHash can't be calculated without ClickHouse")
+	}
+	if opts.Cluster != "" {
+		log.Warn().Str("cluster", opts.Cluster).Msg("cluster is ignored for imported files")
+		opts.Cluster = ""
+	}
+	if len(importOpts.TraceLogFiles) == 0 {
+		return nil, errors.New("trace-log files are required")
+	}
+	if err := validateOutputFormat(opts.OutputFormat); err != nil {
+		return nil, err
+	}
+	if err := validateInvert(opts.OutputFormat, opts.Invert); err != nil {
+		return nil, err
+	}
+	dateFrom, dateTo := opts.DateFrom, opts.DateTo
+	opts = opts.withDefaults()
+	opts.DateFrom, opts.DateTo = dateFrom, dateTo
+	g := &Generator{opts: opts, serverTimeZone: time.Local}
+	if opts.SymbolsBinary != "" {
+		var err error
+		if g.symbolsBinary, err = openELFSymbolizer(opts.SymbolsBinary); err != nil {
+			return nil, err
+		}
+	}
+	dump, err := g.loadDump(importOpts)
+	if err != nil {
+		return nil, err
+	}
+	g.dump = dump
+	return g, nil
+}
+
+func (g *Generator) loadDump(importOpts ImportOptions) (*traceDump, error) {
+	dump := &traceDump{
+		queries:    make(map[string]map[string]interface{}),
+		queryHosts: make(map[string]string),
+	}
+	for _, fileName := range importOpts.QueryLogFiles {
+		defaultHostName := strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+		err := readDumpFile(fileName, importOpts.InputFormat, func(r map[string]interface{}) error {
+			queryId, exists := dumpString(r, "query_id")
+			if !exists {
+				return errors.New("query_id column not found")
+			}
+			if previous, exists := dump.queries[queryId]; exists {
+				if queryType, _ := dumpString(r, "type"); queryType == "QueryStart" || queryType == "1" {
+					return nil
+				}
+				if previousType, _ := dumpString(previous, "type"); previousType != "QueryStart" && previousType != "1" {
+					return nil
+				}
+			}
+			dump.queries[queryId] = r
+			dump.queryHosts[queryId] = dumpHostName(r, defaultHostName)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// addresses resolved after all files read, because unique addresses required for PIE load address detection
+	var rawTraces [][]uint64
+	hostAddresses := make(map[string][]string)
+	uniqueAddresses := make(map[string]map[uint64]bool)
+	minTime, maxTime := time.Time{}, time.Time{}
+	for _, fileName := range importOpts.TraceLogFiles {
+		defaultHostName := strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+		err := readDumpFile(fileName, importOpts.InputFormat, func(r map[string]interface{}) error {
+			t := importedTrace{hostName: dumpHostName(r, defaultHostName)}
+			var exists bool
+			if t.traceType, exists = dumpString(r, "trace_type"); !exists {
+				return errors.New("trace_type column not found")
+			}
+			if traceType, isEnumValue := traceTypeEnumValues[t.traceType]; isEnumValue {
+				t.traceType = traceType
+			}
+			if t.queryId, exists = dumpString(r, "query_id"); !exists {
+				return errors.New("query_id column not found")
+			}
+			t.threadId, _ = dumpUint64(r, "thread_id")
+			t.size, _ = dumpInt64(r, "size")
+			if t.ptr, exists = dumpUint64(r, "ptr"); exists {
+				dump.hasPtr = true
+			}
+			// event_time_microseconds preferred, because leaks require order of allocation and free with the same ptr
+			if t.eventTime, exists = dumpTime(r, "event_time_microseconds", g.serverTimeZone); !exists {
+				t.eventTime, exists = dumpTime(r, "event_time", g.serverTimeZone)
+			}
+			if exists {
+				if minTime.IsZero() || t.eventTime.Before(minTime) {
+					minTime = t.eventTime
+				}
+				if t.eventTime.After(maxTime) {
+					maxTime = t.eventTime
+				}
+			}
+			trace, exists := dumpUint64Array(r, "trace")
+			if !exists {
+				return errors.New("trace column not found or has wrong format")
+			}
+			symbols, hasSymbols := dumpStringArray(r, "symbols")
+			lines, _ := dumpStringArray(r, "lines")
+			if hasSymbols && len(symbols) == len(trace) {
+				frames := make([]string, len(trace))
+				for i := range trace {
+					frames[len(trace)-1-i] = symbols[i] + "#"
+					if i < len(lines) {
+						frames[len(trace)-1-i] += lines[i]
+					}
+				}
+				t.stack = strings.Join(frames, ";")
+				rawTraces = append(rawTraces, nil)
+			} else {
+				rawTraces = append(rawTraces, trace)
+				if _, exists := uniqueAddresses[t.hostName]; !exists {
+					uniqueAddresses[t.hostName] = make(map[uint64]bool)
+				}
+				for _, address := range trace {
+					if !uniqueAddresses[t.hostName][address] {
+						uniqueAddresses[t.hostName][address] = true
+						hostAddresses[t.hostName] = append(hostAddresses[t.hostName], strconv.FormatUint(address, 10))
+					}
+				}
+			}
+			dump.traces = append(dump.traces, t)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var symbols *symbolizer
+	if len(hostAddresses) > 0 {
+		if g.symbolsBinary != nil {
+			symbols = &symbolizer{hostBuilds: make(map[string]string), symbols: make(map[string]map[string]string)}
+			if err := g.resolveLocal(symbols, map[string]string{}, hostAddresses); err != nil {
+				return nil, err
+			}
+		} else {
+			log.Warn().Msg("trace_log files don't contain symbols and lines columns and symbols-binary is not set, frames will contain raw addresses")
+		}
+	}
+	for i, trace := range rawTraces {
+		if trace == nil {
+			continue
+		}
+		frames := make([]string, len(trace))
+		for j, address := range trace {
+			frames[len(trace)-1-j] = strconv.FormatUint(address, 10)
+		}
+		stack := strings.Join(frames, ";")
+		if symbols != nil {
+			// symbolize skip first frame, because it's trace_type in SQL result
+			stack = strings.TrimPrefix(symbols.symbolize(dump.traces[i].hostName, ";"+stack), ";")
+		} else {
+			for j := range frames {
+				address, _ := strconv.ParseUint(frames[j], 10, 64)
+				frames[j] = fmt.Sprintf("0x%x", address)
+			}
+			stack = strings.Join(frames, ";")
+		}
+		dump.traces[i].stack = stack
+	}
+	if g.opts.DateFrom.IsZero() {
+		g.opts.DateFrom = minTime
+	}
+	if g.opts.DateTo.IsZero() {
+		g.opts.DateTo = maxTime
+	}
+	log.Info().Int("traces", len(dump.traces)).Int("queries", len(dump.queries)).Msg("import files")
+	return dump, nil
+}
+
+// dumpHostName return hostname column, or hostName column, added via SELECT hostName(), * INTO OUTFILE, or defaultHostName
+func dumpHostName(r map[string]interface{}, defaultHostName string) string {
+	for _, name := range []string{"hostname", "hostName()", "host_name"} {
+		if hostName, exists := dumpString(r, name); exists && hostName != "" {
+			return hostName
+		}
+	}
+	return defaultHostName
+}
+
+// hasQueryLogFilter return true when filter contains conditions for system.query_log columns besides query_id
+func hasQueryLogFilter(filter Filter) bool {
+	return filter.QueryFilter != "" || len(queryLogColumns(filter)) > 0
+}
+
+// matchQuery apply the same conditions as applyQueryFilter to system.query_log row
+func matchQuery(filter Filter, queryFilter *regexp.Regexp, r map[string]interface{}) bool {
+	if queryFilter != nil {
+		if query, _ := dumpString(r, "query"); !queryFilter.MatchString(query) {
+			return false
+		}
+	}
+	if len(filter.QueryIds) != 0 {
+		if queryId, _ := dumpString(r, "query_id"); !slices.Contains(filter.QueryIds, queryId) {
+			return false
+		}
+	}
+	if len(filter.Users) != 0 {
+		user, _ := dumpString(r, "user")
+		initialUser, _ := dumpString(r, "initial_user")
+		if !slices.Contains(filter.Users, user) && !slices.Contains(filter.Users, initialUser) {
+			return false
+		}
+	}
+	for _, c := range []struct {
+		column string
+		values []string
+	}{{"databases", filter.Databases}, {"tables", filter.Tables}} {
+		if len(c.values) == 0 {
+			continue
+		}
+		values, _ := dumpStringArray(r, c.column)
+		matched := false
+		for _, value := range values {
+			matched = matched || slices.Contains(c.values, value)
+		}
+		if !matched {
+			return false
+		}
+	}
+	if len(filter.QueryKinds) != 0 {
+		if queryKind, _ := dumpString(r, "query_kind"); !slices.Contains(filter.QueryKinds, queryKind) {
+			return false
+		}
+	}
+	for _, c := range []struct {
+		column string
+		min    uint64
+	}{{"query_duration_ms", filter.MinQueryDurationMs}, {"memory_usage", filter.MinMemoryUsage}, {"read_rows", filter.MinReadRows}} {
+		if c.min == 0 {
+			continue
+		}
+		if value, _ := dumpUint64(r, c.column); value < c.min {
+			return false
+		}
+	}
+	if len(filter.ExceptionCodes) != 0 {
+		code, _ := dumpInt64(r, "exception_code")
+		matched := false
+		for _, exceptionCode := range filter.ExceptionCodes {
+			matched = matched || code == exceptionCode
+		}
+		if !matched {
+			return false
+		}
+	}
+	if filter.LogComment != "" {
+		if logComment, _ := dumpString(r, "log_comment"); logComment != filter.LogComment {
+			return false
+		}
+	}
+	return true
+}
+
+func inDateRange(filter Filter, t time.Time) bool {
+	if t.IsZero() {
+		return true
+	}
+	return (filter.DateFrom.IsZero() || !t.Before(filter.DateFrom)) && (filter.DateTo.IsZero() || !t.After(filter.DateTo))
+}
+
+// matchTraces return traces matched with filter and traceTypes
+func (d *traceDump) matchTraces(filter Filter, traceTypes []string) ([]importedTrace, error) {
+	var queryFilter *regexp.Regexp
+	if filter.QueryFilter != "" {
+		var err error
+		if queryFilter, err = regexp.Compile(filter.QueryFilter); err != nil {
+			return nil, errors.Wrapf(err, "Invalid regexp query-filter = %s", filter.QueryFilter)
+		}
+	}
+	withQueryLog := hasQueryLogFilter(filter)
+	var matched []importedTrace
+	for _, t := range d.traces {
+		if !slices.Contains(traceTypes, t.traceType) {
+			continue
+		}
+		// the same as applyHostsDateFrom
+		if hostDateFrom, exists := filter.HostsDateFrom[t.hostName]; !exists && !inDateRange(filter, t.eventTime) {
+			continue
+		} else if exists && !t.eventTime.IsZero() && (!t.eventTime.After(hostDateFrom) || (!filter.DateTo.IsZero() && t.eventTime.After(filter.DateTo))) {
+			continue
+		}
+		if len(filter.QueryIds) != 0 && !slices.Contains(filter.QueryIds, t.queryId) {
+			continue
+		}
+		if withQueryLog {
+			// the same as ANY LEFT JOIN with default values for not found queries, which never match query_log conditions
+			q, exists := d.queries[t.queryId]
+			if !exists || !matchQuery(filter, queryFilter, q) {
+				continue
+			}
+		}
+		matched = append(matched, t)
+	}
+	return matched, nil
+}
+
+// fetchStacks aggregate and order stacks the same way as traceSQLTemplate
+func (d *traceDump) fetchStacks(filter Filter, traceTypes []string, fetchCallback func(s Stack) error) error {
+	traces, err := d.matchTraces(filter, traceTypes)
+	if err != nil {
+		return err
+	}
+	if filter.Leaks {
+		if !d.hasPtr {
+			return errors.New("leaks require ptr column in trace-log files")
+		}
+		traces = leakTraces(traces)
+	}
+	threads := filter.GroupBy == GroupByThread || filter.GroupBy == GroupByThreadRoot
+	stacks := make(map[importedStackKey]*importedStackValue)
+	for _, t := range traces {
+		key := importedStackKey{hostName: t.hostName, queryId: strings.ReplaceAll(t.queryId, ":", "_"), traceType: t.traceType, stack: t.stack}
+		if threads {
+			key.threadId = t.threadId
+		}
+		if filter.Bucket > 0 {
+			key.bucket = bucketStart(t.eventTime, filter.Bucket)
+		}
+		value, exists := stacks[key]
+		if !exists {
+			value = &importedStackValue{}
+			stacks[key] = value
+		}
+		value.samples++
+		if t.eventTime.After(value.lastEventTime) {
+			value.lastEventTime = t.eventTime
+		}
+		value.size += t.size
+		if t.size < 0 {
+			value.totalSize += uint64(-t.size)
+		} else {
+			value.totalSize += uint64(t.size)
+		}
+	}
+	keys := make([]importedStackKey, 0, len(stacks))
+	for key := range stacks {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.hostName != b.hostName {
+			return a.hostName < b.hostName
+		}
+		if a.queryId != b.queryId {
+			return a.queryId < b.queryId
+		}
+		// the same as threadOrderBy in FetchStacks
+		if filter.GroupBy == GroupByThread && a.threadId != b.threadId {
+			return a.threadId < b.threadId
+		}
+		if !a.bucket.Equal(b.bucket) {
+			return a.bucket.Before(b.bucket)
+		}
+		if a.traceType != b.traceType {
+			return a.traceType < b.traceType
+		}
+		if a.threadId != b.threadId {
+			return a.threadId < b.threadId
+		}
+		return a.stack < b.stack
+	})
+	for _, key := range keys {
+		value := stacks[key]
+		s := Stack{HostName: key.hostName, QueryId: key.queryId, TraceType: key.traceType, ThreadId: key.threadId, Value: value.samples, LastEventTime: value.lastEventTime, Bucket: key.bucket}
+		traceTypeFrame := key.traceType
+		if strings.Contains(key.traceType, "Memory") {
+			s.Value = value.totalSize
+			traceTypeFrame = "allocate"
+			if strings.HasSuffix(key.traceType, leakedSuffix) {
+				traceTypeFrame = "leak"
+			} else if value.size < 0 {
+				traceTypeFrame = "free"
+			}
+		}
+		s.Frames = traceTypeFrame + ";" + key.stack
+		if filter.GroupBy == GroupByThreadRoot {
+			s.Frames = addThreadFrame(s.Frames, "", s.ThreadId)
+		}
+		if err := fetchCallback(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// topQueries rank the same way as topQueriesSQLTemplate
+func (d *traceDump) topQueries(filter Filter, traceTypes []string, n int, rankBy string) ([]string, error) {
+	traces, err := d.matchTraces(filter, traceTypes)
+	if err != nil {
+		return nil, err
+	}
+	rank := make(map[string]uint64)
+	for _, t := range traces {
+		if t.queryId == "" {
+			continue
+		}
+		queryId := strings.ReplaceAll(t.queryId, ":", "_")
+		switch {
+		case rankBy != RankByMemory:
+			rank[queryId]++
+		case t.size < 0:
+			rank[queryId] += uint64(-t.size)
+		default:
+			rank[queryId] += uint64(t.size)
+		}
+	}
+	queryIds := make([]string, 0, len(rank))
+	for queryId := range rank {
+		queryIds = append(queryIds, queryId)
+	}
+	sort.Slice(queryIds, func(i, j int) bool {
+		if rank[queryIds[i]] != rank[queryIds[j]] {
+			return rank[queryIds[i]] > rank[queryIds[j]]
+		}
+		return queryIds[i] < queryIds[j]
+	})
+	if len(queryIds) > n {
+		queryIds = queryIds[:n]
+	}
+	return queryIds, nil
+}
+
+// writeQuerySQLFiles the same as Generator.writeQuerySQLFiles for imported system.query_log
+func (d *traceDump) writeQuerySQLFiles(outputDir string, filter Filter, queryIds map[string]bool) error {
+	var queryFilter *regexp.Regexp
+	if filter.QueryFilter != "" {
+		var err error
+		if queryFilter, err = regexp.Compile(filter.QueryFilter); err != nil {
+			return errors.Wrapf(err, "Invalid regexp query-filter = %s", filter.QueryFilter)
+		}
+	}
+	filter.DateFrom = filter.earliestDateFrom()
+	sqlFiles := 0
+	for queryId, q := range d.queries {
+		if queryIds != nil && !queryIds[strings.ReplaceAll(queryId, ":", "_")] {
+			continue
+		}
+		eventTime, _ := dumpTime(q, "event_time", time.Local)
+		if !inDateRange(filter, eventTime) || !matchQuery(filter, queryFilter, q) {
+			continue
+		}
+		query, _ := dumpString(q, "query")
+		sqlDir := filepath.Join(outputDir, d.queryHosts[queryId])
+		if err := os.MkdirAll(sqlDir, 0755); err != nil {
+			return errors.Wrapf(err, "can't create %s", sqlDir)
+		}
+		sqlFile := filepath.Join(sqlDir, queryId+".sql")
+		if err := os.WriteFile(sqlFile, []byte(query), 0644); err != nil {
+			return errors.Wrapf(err, "can't write %s", sqlFile)
+		}
+		sqlFiles++
+	}
+	log.Info().Int("sqlFiles", sqlFiles).Msg("write .sql files")
+	return nil
+}
@@ -0,0 +1,179 @@
+package flamegraph
+
+import (
+	"bufio"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// indexProfile is one cell in index.html, link to rendered flamegraph with samples count or bytes
+type indexProfile struct {
+	Link  string
+	Value uint64
+	Unit  string
+}
+
+// indexRow is one host/query/thread/bucket in index.html
+type indexRow struct {
+	HostName string
+	QueryId  string
+	Thread   string
+	Bucket   string
+	SQL      string
+	SQLLink  string
+	Profiles []*indexProfile
+}
+
+// writeIndex write outputDir/index.html with all rendered profiles grouped by host, query and thread, trace types as columns,
+// totals contains samples count or bytes for each profile, dateFrom differs from Options.DateFrom for cumulative profiles from Options.StateFile
+func (g *Generator) writeIndex(rendered []profileKey, totals map[profileKey]uint64, dateFrom time.Time) error {
+	traceTypeIdx := make(map[string]int)
+	var traceTypes []string
+	for _, key := range rendered {
+		if _, exists := traceTypeIdx[key.traceType]; !exists {
+			traceTypeIdx[key.traceType] = 0
+			traceTypes = append(traceTypes, key.traceType)
+		}
+	}
+	sort.Strings(traceTypes)
+	for i, traceType := range traceTypes {
+		traceTypeIdx[traceType] = i
+	}
+
+	ext := g.opts.OutputFormat
+	switch ext {
+	case "pprof":
+		ext = "pb.gz"
+	case "speedscope":
+		ext = "txt"
+	}
+	var rows []*indexRow
+	rowIdx := make(map[profileKey]*indexRow)
+	// rendered sorted by key, so rows sorted by host, query, thread, bucket
+	for _, key := range rendered {
+		rowKey := profileKey{hostName: key.hostName, queryId: key.queryId, thread: key.thread, bucket: key.bucket}
+		row, exists := rowIdx[rowKey]
+		if !exists {
+			row = &indexRow{HostName: key.hostName, QueryId: key.queryId, Thread: key.thread, Profiles: make([]*indexProfile, len(traceTypes))}
+			if bucketStart, err := parseBucket(key.bucket); err == nil {
+				row.Bucket = g.formatDate(bucketStart)
+			}
+			sqlName := filepath.Join(key.hostName, key.queryId+".sql")
+			if firstLine, err := readFirstLine(filepath.Join(g.opts.OutputDir, sqlName)); err == nil {
+				row.SQL, row.SQLLink = firstLine, filepath.ToSlash(sqlName)
+			}
+			rowIdx[rowKey] = row
+			rows = append(rows, row)
+		}
+		unit := "samples"
+		if strings.Contains(key.traceType, "Memory") {
+			unit = "bytes"
+		}
+		row.Profiles[traceTypeIdx[key.traceType]] = &indexProfile{
+			Link:  filepath.ToSlash(key.fileName(ext)),
+			Value: totals[key],
+			Unit:  unit,
+		}
+	}
+
+	fileName := filepath.Join(g.opts.OutputDir, "index.html")
+	if err := writeFile(fileName, func(w io.Writer) error {
+		return indexFileTemplate.Execute(w, map[string]interface{}{
+			"Title":      "clickhouse-flamegraph from " + g.formatDate(dateFrom) + " to " + g.formatDate(g.opts.DateTo),
+			"TraceTypes": traceTypes,
+			"Rows":       rows,
+			"Speedscope": g.opts.OutputFormat == "speedscope",
+			"Buckets":    g.opts.Bucket > 0,
+		})
+	}); err != nil {
+		return err
+	}
+	log.Info().Str("fileName", fileName).Int("rows", len(rows)).Msg("write index file")
+	return nil
+}
+
+// readFirstLine return first non-empty line from .sql file
+func readFirstLine(fileName string) (string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			return line, nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+var indexFileTemplate = template.Must(template.New("index.html").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+	body { font-family: Verdana, sans-serif; font-size: 13px; margin: 10px; }
+	table { border-collapse: collapse; }
+	th, td { border: 1px solid #ccc; padding: 3px 6px; text-align: left; vertical-align: top; }
+	th { background: #eee; cursor: pointer; user-select: none; }
+	td.value { text-align: right; white-space: nowrap; }
+	td.sql { max-width: 600px; overflow: hidden; text-overflow: ellipsis; white-space: nowrap; font-family: monospace; }
+</style>
+</head>
+<body>
+<h3>{{.Title}}</h3>
+{{if .Speedscope}}<p><a href="profile.speedscope.json">profile.speedscope.json</a>, open it in <a href="https://www.speedscope.app/">speedscope</a></p>{{end}}
+{{if .Buckets}}<p><a href="buckets.csv">buckets.csv</a> contains total for each bucket</p>{{end}}
+<p>click on column header for sort</p>
+<table id="profiles">
+<thead>
+<tr>
+	<th data-type="string">host</th>
+	<th data-type="string">query_id</th>
+	<th data-type="string">thread</th>
+	{{if .Buckets}}<th data-type="string">bucket</th>{{end}}
+	<th data-type="string">query</th>
+	{{range .TraceTypes}}<th data-type="number">{{.}}</th>{{end}}
+</tr>
+</thead>
+<tbody>
+{{range .Rows}}<tr>
+	<td>{{.HostName}}</td>
+	<td>{{.QueryId}}</td>
+	<td>{{.Thread}}</td>
+	{{if $.Buckets}}<td>{{.Bucket}}</td>{{end}}
+	<td class="sql" title="{{.SQL}}">{{if .SQLLink}}<a href="{{.SQLLink}}">{{.SQL}}</a>{{end}}</td>
+	{{range .Profiles}}<td class="value" data-value="{{if .}}{{.Value}}{{else}}0{{end}}">{{if .}}<a href="{{.Link}}">{{.Value}} {{.Unit}}</a>{{end}}</td>{{end}}
+</tr>
+{{end}}</tbody>
+</table>
+<script>
+document.querySelectorAll("#profiles th").forEach(function(th, column) {
+	var desc = false;
+	th.addEventListener("click", function() {
+		var numeric = th.dataset.type === "number";
+		desc = !desc;
+		var tbody = document.querySelector("#profiles tbody");
+		var rows = Array.prototype.slice.call(tbody.rows);
+		rows.sort(function(a, b) {
+			var x = a.cells[column], y = b.cells[column];
+			var result = numeric ? Number(x.dataset.value) - Number(y.dataset.value) : x.textContent.localeCompare(y.textContent);
+			return desc ? -result : result;
+		});
+		rows.forEach(function(row) { tbody.appendChild(row); });
+	});
+});
+</script>
+</body>
+</html>
+`))
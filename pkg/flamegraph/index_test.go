@@ -0,0 +1,75 @@
+package flamegraph
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWriteIndex check index.html rows grouped by host, query and thread, links use extension of output format
+func TestWriteIndex(t *testing.T) {
+	rendered := []profileKey{
+		{hostName: "host1", queryId: "global", traceType: "CPU"},
+		{hostName: "host1", queryId: "q1", traceType: "CPU"},
+		{hostName: "host1", queryId: "q1", traceType: "MemorySample"},
+		{hostName: "host2", queryId: "q2", thread: "QueryPipelineEx", traceType: "Real"},
+	}
+	totals := map[profileKey]uint64{rendered[0]: 5, rendered[1]: 42, rendered[2]: 1024, rendered[3]: 7}
+	testCases := []struct {
+		outputFormat string
+		links        []string
+		speedscope   bool
+	}{
+		{outputFormat: "svg", links: []string{"host1/global.CPU.svg", "host1/q1.CPU.svg", "host1/q1.MemorySample.svg", "host2/q2.QueryPipelineEx.Real.svg"}},
+		{outputFormat: "pprof", links: []string{"host1/global.CPU.pb.gz", "host1/q1.CPU.pb.gz", "host1/q1.MemorySample.pb.gz", "host2/q2.QueryPipelineEx.Real.pb.gz"}},
+		{outputFormat: "speedscope", links: []string{"host1/global.CPU.txt", "host1/q1.CPU.txt", "host1/q1.MemorySample.txt", "host2/q2.QueryPipelineEx.Real.txt"}, speedscope: true},
+	}
+	for _, tc := range testCases {
+		outputDir := t.TempDir()
+		if err := os.MkdirAll(filepath.Join(outputDir, "host1"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(outputDir, "host1", "q1.sql"), []byte("\nSELECT count() FROM numbers(10)\nFORMAT Null\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		dateFrom := time.Date(2024, 1, 2, 3, 0, 0, 0, time.UTC)
+		g := &Generator{opts: Options{OutputDir: outputDir, OutputFormat: tc.outputFormat, Filter: Filter{DateTo: dateFrom.Add(time.Hour)}}, serverTimeZone: time.UTC}
+		if err := g.writeIndex(rendered, totals, dateFrom); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(filepath.Join(outputDir, "index.html"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		index := string(data)
+		if !strings.Contains(index, "from 2024-01-02 03:00:00 &#43;0000 to 2024-01-02 04:00:00 &#43;0000") {
+			t.Errorf("output-format = %s expected dates in title", tc.outputFormat)
+		}
+		for i, link := range tc.links {
+			if !strings.Contains(index, `href="`+link+`"`) {
+				t.Errorf("output-format = %s expected link %s", tc.outputFormat, link)
+			}
+			// rows sorted by host, query, thread
+			if i > 0 && strings.Index(index, tc.links[i-1]) > strings.Index(index, link) {
+				t.Errorf("output-format = %s expected %s before %s", tc.outputFormat, tc.links[i-1], link)
+			}
+		}
+		for _, expected := range []string{">5 samples<", ">42 samples<", ">1024 bytes<", ">7 samples<", `<a href="host1/q1.sql">SELECT count() FROM numbers(10)</a>`, `<th data-type="number">CPU</th><th data-type="number">MemorySample</th><th data-type="number">Real</th>`} {
+			if !strings.Contains(index, expected) {
+				t.Errorf("output-format = %s expected %s in index.html", tc.outputFormat, expected)
+			}
+		}
+		// host1 global and host2 q2 have no .sql files
+		if strings.Count(index, `.sql"`) != 1 {
+			t.Errorf("output-format = %s expected only one .sql link", tc.outputFormat)
+		}
+		if strings.Count(index, "<tr>") != 4 {
+			t.Errorf("output-format = %s expected header and 3 rows, got %d", tc.outputFormat, strings.Count(index, "<tr>"))
+		}
+		if tc.speedscope != strings.Contains(index, `href="profile.speedscope.json"`) {
+			t.Errorf("output-format = %s expected speedscope link = %v", tc.outputFormat, tc.speedscope)
+		}
+	}
+}
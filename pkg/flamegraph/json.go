@@ -0,0 +1,34 @@
+package flamegraph
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// d3FlameNode is node format expected by d3-flame-graph, see https://github.com/spiermar/d3-flame-graph/#input-format
+type d3FlameNode struct {
+	Name     string         `json:"name"`
+	Value    uint64         `json:"value"`
+	Children []*d3FlameNode `json:"children"`
+}
+
+func newD3FlameNode(name string, node *stackNode) *d3FlameNode {
+	d3Node := &d3FlameNode{
+		Name:     name,
+		Value:    node.Value,
+		Children: make([]*d3FlameNode, 0, len(node.Children)),
+	}
+	for _, child := range node.sortedChildren() {
+		d3Node.Children = append(d3Node.Children, newD3FlameNode(child.Name, child))
+	}
+	return d3Node
+}
+
+// writeFlameJSON write stack tree as nested {name, value, children} JSON
+func writeFlameJSON(w io.Writer, root *stackNode) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return errors.Wrap(encoder.Encode(newD3FlameNode("all", root)), "can't write json")
+}
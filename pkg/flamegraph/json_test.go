@@ -0,0 +1,46 @@
+package flamegraph
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWriteFlameJSON(t *testing.T) {
+	const folded = "CPU;main;foo 5\nCPU;main;bar 3\nCPU;main 1\nReal;std::vector<int>::push_back 2\n"
+	const expected = `{"name": "all", "value": 11, "children": [
+		{"name": "CPU", "value": 9, "children": [
+			{"name": "main", "value": 9, "children": [
+				{"name": "bar", "value": 3, "children": []},
+				{"name": "foo", "value": 5, "children": []}
+			]}
+		]},
+		{"name": "Real", "value": 2, "children": [
+			{"name": "std::vector<int>::push_back", "value": 2, "children": []}
+		]}
+	]}`
+	root, err := readFoldedStacks(strings.NewReader(folded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := writeFlameJSON(&buf, root); err != nil {
+		t.Fatal(err)
+	}
+	// frames with < and > are not escaped, so file stays readable
+	if !strings.Contains(buf.String(), "std::vector<int>::push_back") {
+		t.Errorf("expected unescaped frame, got %s", buf.String())
+	}
+	var actualTree, expectedTree interface{}
+	if err := json.Unmarshal(buf.Bytes(), &actualTree); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(expected), &expectedTree); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(actualTree, expectedTree) {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
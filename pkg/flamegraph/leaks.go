@@ -0,0 +1,135 @@
+package flamegraph
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// trace_type suffixes for Filter.Leaks, for example MemorySampleLeaked, profiles still contain Memory in trace_type, so units are bytes
+const (
+	leakedSuffix    = "Leaked"
+	allocatedSuffix = "Allocated"
+	freedSuffix     = "Freed"
+)
+
+// leakSQLTemplate split Memory trace types into allocated and freed samples, and add leaked samples,
+// which are allocations where last sample with the same ptr inside date range is not free,
+// samples CTE is inlined by ClickHouse, so system.trace_log read twice
+var leakSQLTemplate = `
+WITH samples AS (
+	SELECT
+		hostName() AS host_name,
+		{queryIdField},
+		toString(t.trace_type) AS sample_trace_type,{sampleThreadFields}
+		t.event_time AS event_time,
+		t.event_time_microseconds AS event_time_microseconds,
+		t.size AS size,
+		t.ptr AS ptr,
+		t.trace AS trace
+	FROM {from}
+	WHERE {where}
+)
+SELECT
+	host_name,
+	query_id,
+	trace_type,{threadFields}{bucketFields}
+	sum(abs(size)) AS total_size,
+	count() AS samples,
+	{maxEventTime} AS max_event_time,
+	concat(
+		multiIf(
+			endsWith(trace_type, '` + leakedSuffix + `'), 'leak;',
+			endsWith(trace_type, '` + allocatedSuffix + `'), 'allocate;',
+			endsWith(trace_type, '` + freedSuffix + `'), 'free;',
+			concat(trace_type, ';')
+		),
+		{framesExpr}
+	) AS stack
+FROM (
+	SELECT
+		host_name, query_id, thread_id, thread_name, event_time, size, trace,
+		if(position(sample_trace_type, 'Memory') > 0, concat(sample_trace_type, if(size < 0, '` + freedSuffix + `', '` + allocatedSuffix + `')), sample_trace_type) AS trace_type
+	FROM samples
+	UNION ALL
+	SELECT
+		host_name, last.1 AS query_id, last.2 AS thread_id, last.3 AS thread_name, last.4 AS event_time, last.5 AS size, last.6 AS trace,
+		concat(sample_trace_type, '` + leakedSuffix + `') AS trace_type
+	FROM (
+		SELECT host_name, sample_trace_type, ptr, argMax((query_id, thread_id, thread_name, event_time, size, trace), event_time_microseconds) AS last
+		FROM samples
+		WHERE position(sample_trace_type, 'Memory') > 0 AND ptr != 0
+		GROUP BY host_name, sample_trace_type, ptr
+	)
+	WHERE last.5 > 0
+)
+GROUP BY host_name, query_id, trace_type, trace{threadGroupBy}{bucketGroupBy}
+ORDER BY host_name, query_id,{threadOrderBy}{bucketOrderBy} trace_type
+{settings}
+`
+
+// leakSQL return leakSQLTemplate and threadFields for outer query, samples always contain thread_id and thread_name, because UNION ALL requires the same columns
+func leakSQL(threadFields string) (string, string) {
+	sampleThreadFields, outerThreadFields := "\n\t\tt.thread_id AS thread_id,\n\t\t'' AS thread_name,", ""
+	if threadFields != "" {
+		sampleThreadFields, outerThreadFields = strings.ReplaceAll(threadFields, "\n\t", "\n\t\t"), "\n\tthread_id,\n\tthread_name,"
+	}
+	return strings.ReplaceAll(leakSQLTemplate, "{sampleThreadFields}", sampleThreadFields), outerThreadFields
+}
+
+// checkTraceLogPtr check system.trace_log contains ptr column, which exists only on newer ClickHouse servers
+func checkTraceLogPtr(ctx context.Context, db *sql.DB) error {
+	exists := false
+	err := fetchQuery(ctx, db, "SELECT count() AS cnt FROM system.columns WHERE database='system' AND table='trace_log' AND name='ptr'", nil, func(r map[string]interface{}) error {
+		exists = r["cnt"].(uint64) > 0
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errors.New("leaks require ptr column in system.trace_log, upgrade ClickHouse server")
+	}
+	return nil
+}
+
+// leakPtrKey is the same as GROUP BY for leaked samples in leakSQLTemplate
+type leakPtrKey struct {
+	hostName  string
+	traceType string
+	ptr       uint64
+}
+
+// leakTraces the same as leakSQLTemplate for imported traces, traces with equal event_time ordered as in files
+func leakTraces(traces []importedTrace) []importedTrace {
+	result := make([]importedTrace, 0, len(traces))
+	last := make(map[leakPtrKey]int)
+	for i, t := range traces {
+		if !strings.Contains(t.traceType, "Memory") {
+			result = append(result, t)
+			continue
+		}
+		if t.ptr != 0 {
+			key := leakPtrKey{hostName: t.hostName, traceType: t.traceType, ptr: t.ptr}
+			if previous, exists := last[key]; !exists || !t.eventTime.Before(traces[previous].eventTime) {
+				last[key] = i
+			}
+		}
+		if t.size < 0 {
+			t.traceType += freedSuffix
+		} else {
+			t.traceType += allocatedSuffix
+		}
+		result = append(result, t)
+	}
+	for _, i := range last {
+		if traces[i].size > 0 {
+			t := traces[i]
+			t.traceType += leakedSuffix
+			result = append(result, t)
+		}
+	}
+	return result
+}
@@ -0,0 +1,109 @@
+package flamegraph
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// TestLeakTraces check alloc/free pairing by host, trace_type and ptr, result compared as sorted "traceType ptr size" lines
+func TestLeakTraces(t *testing.T) {
+	eventTime := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	trace := func(traceType string, seconds int, ptr uint64, size int64) importedTrace {
+		return importedTrace{hostName: "host1", queryId: "q1", traceType: traceType, eventTime: eventTime.Add(time.Duration(seconds) * time.Second), ptr: ptr, size: size}
+	}
+	testCases := []struct {
+		name     string
+		traces   []importedTrace
+		expected []string
+	}{
+		{
+			name:     "alloc without free",
+			traces:   []importedTrace{trace("MemorySample", 1, 0xa, 100)},
+			expected: []string{"MemorySampleAllocated 10 100", "MemorySampleLeaked 10 100"},
+		},
+		{
+			name:     "alloc and free",
+			traces:   []importedTrace{trace("MemorySample", 1, 0xa, 100), trace("MemorySample", 2, 0xa, -100)},
+			expected: []string{"MemorySampleAllocated 10 100", "MemorySampleFreed 10 -100"},
+		},
+		{
+			name:     "free without alloc",
+			traces:   []importedTrace{trace("MemorySample", 1, 0xb, -50)},
+			expected: []string{"MemorySampleFreed 11 -50"},
+		},
+		{
+			name:     "ptr reused after free",
+			traces:   []importedTrace{trace("MemorySample", 1, 0xa, 100), trace("MemorySample", 2, 0xa, -100), trace("MemorySample", 3, 0xa, 200)},
+			expected: []string{"MemorySampleAllocated 10 100", "MemorySampleAllocated 10 200", "MemorySampleFreed 10 -100", "MemorySampleLeaked 10 200"},
+		},
+		{
+			name:     "ptr reused and freed again",
+			traces:   []importedTrace{trace("MemorySample", 1, 0xa, 100), trace("MemorySample", 2, 0xa, -100), trace("MemorySample", 3, 0xa, 200), trace("MemorySample", 4, 0xa, -200)},
+			expected: []string{"MemorySampleAllocated 10 100", "MemorySampleAllocated 10 200", "MemorySampleFreed 10 -100", "MemorySampleFreed 10 -200"},
+		},
+		{
+			name:     "unordered samples paired by event_time",
+			traces:   []importedTrace{trace("MemorySample", 2, 0xa, -100), trace("MemorySample", 1, 0xa, 100)},
+			expected: []string{"MemorySampleAllocated 10 100", "MemorySampleFreed 10 -100"},
+		},
+		{
+			name:     "equal event_time ordered as in files",
+			traces:   []importedTrace{trace("MemorySample", 1, 0xa, -100), trace("MemorySample", 1, 0xa, 100)},
+			expected: []string{"MemorySampleAllocated 10 100", "MemorySampleFreed 10 -100", "MemorySampleLeaked 10 100"},
+		},
+		{
+			name:     "negative and zero sizes without ptr",
+			traces:   []importedTrace{trace("Memory", 1, 0, -4096), trace("Memory", 2, 0, 0), trace("Memory", 3, 0, 4096)},
+			expected: []string{"MemoryAllocated 0 0", "MemoryAllocated 0 4096", "MemoryFreed 0 -4096"},
+		},
+		{
+			name:     "last sample with zero size isn't leaked",
+			traces:   []importedTrace{trace("MemorySample", 1, 0xa, 100), trace("MemorySample", 2, 0xa, 0)},
+			expected: []string{"MemorySampleAllocated 10 0", "MemorySampleAllocated 10 100"},
+		},
+		{
+			name:     "free of other trace_type isn't paired",
+			traces:   []importedTrace{trace("MemorySample", 1, 0xa, 100), trace("MemoryPeak", 2, 0xa, -100)},
+			expected: []string{"MemoryPeakFreed 10 -100", "MemorySampleAllocated 10 100", "MemorySampleLeaked 10 100"},
+		},
+		{
+			name:     "not memory trace_type unchanged",
+			traces:   []importedTrace{trace("CPU", 1, 0xa, 0), trace("Real", 2, 0, 0)},
+			expected: []string{"CPU 10 0", "Real 0 0"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var actual []string
+			for _, r := range leakTraces(tc.traces) {
+				actual = append(actual, fmt.Sprintf("%s %d %d", r.traceType, r.ptr, r.size))
+			}
+			sort.Strings(actual)
+			if !reflect.DeepEqual(actual, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+// TestLeakTracesHosts check the same ptr on different hosts is paired separately
+func TestLeakTracesHosts(t *testing.T) {
+	eventTime := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	traces := []importedTrace{
+		{hostName: "host1", traceType: "MemorySample", eventTime: eventTime, ptr: 0xa, size: 100},
+		{hostName: "host2", traceType: "MemorySample", eventTime: eventTime, ptr: 0xa, size: 200},
+		{hostName: "host2", traceType: "MemorySample", eventTime: eventTime.Add(time.Second), ptr: 0xa, size: -200},
+	}
+	var leaked []string
+	for _, r := range leakTraces(traces) {
+		if r.traceType == "MemorySample"+leakedSuffix {
+			leaked = append(leaked, fmt.Sprintf("%s %d", r.hostName, r.size))
+		}
+	}
+	if !reflect.DeepEqual(leaked, []string{"host1 100"}) {
+		t.Errorf("expected only host1 leaked, got %v", leaked)
+	}
+}
@@ -0,0 +1,155 @@
+package flamegraph
+
+import (
+	"time"
+
+	"github.com/araddon/dateparse"
+	"github.com/pkg/errors"
+)
+
+// DefaultTraceTypes used when Filter.TraceTypes is empty
+var DefaultTraceTypes = []string{"Real", "CPU", "Memory", "MemorySample"}
+
+// Filter contains parameters applied to system.trace_log and system.query_log
+type Filter struct {
+	DateFrom time.Time
+	DateTo   time.Time
+	// QueryFilter is regexp applied to system.query_log query field, see https://github.com/google/re2/wiki/Syntax
+	QueryFilter string
+	QueryIds    []string
+	TraceTypes  []string
+	// Users match system.query_log user or initial_user
+	Users []string
+	// Databases and Tables match any of system.query_log databases and tables, tables shall be passed as database.table
+	Databases []string
+	Tables    []string
+	// QueryKinds match system.query_log query_kind, for example Select, Insert
+	QueryKinds         []string
+	MinQueryDurationMs uint64
+	MinMemoryUsage     uint64
+	MinReadRows        uint64
+	ExceptionCodes     []int64
+	LogComment         string
+	// Cluster is cluster name from system.clusters, when not empty all stacks fetched via clusterAllReplicas()
+	Cluster string
+	// NormalizeQuery group stacks by normalizedQueryHash instead of query_id
+	NormalizeQuery bool
+	// GroupBy accept values: GroupByQuery (default), GroupByThread, GroupByThreadRoot
+	GroupBy string
+	// Bucket when greater than 0, stacks grouped by toStartOfInterval(event_time), one profile written for each bucket, shall be whole seconds
+	Bucket time.Duration
+	// Leaks pair Memory and MemorySample allocations with frees by system.trace_log ptr column, Memory trace types split into
+	// Allocated, Freed and Leaked profiles, for example MemorySampleLeaked contains only allocations not freed before DateTo,
+	// samples with zero ptr can't be paired and counted only in Allocated and Freed profiles
+	Leaks bool
+	// HostsDateFrom overrides DateFrom for listed hosts, only samples with event_time_microseconds greater than value fetched, filled from Options.StateFile
+	HostsDateFrom map[string]time.Time
+}
+
+// Options contains connection, filter and output parameters for Generator
+type Options struct {
+	// DSN http:// and https:// use HTTP protocol, clickhouse:// and tcp:// use native protocol
+	DSN            string
+	TLSCertificate string
+	TLSKey         string
+	TLSCA          string
+
+	Filter
+
+	// OutputDir destination path for generated files
+	OutputDir string
+	// OutputFormat accept values: svg, txt, json, pprof, speedscope
+	OutputFormat string
+	// Width of SVG image
+	Width int
+	// Height of each frame in SVG image
+	Height int
+	// MaxMemoryStacks unique stacks count aggregated in memory before spill to temporary files, DefaultMaxMemoryStacks when not set
+	MaxMemoryStacks int
+	// Parallelism count of profiles rendered concurrently, runtime.NumCPU() when not set
+	Parallelism int
+	// Focus, Ignore, Hide and PruneFrom are regexps applied to frames the same way as pprof options with the same names,
+	// Focus keep only stacks with matched frame, Ignore drop stacks with matched frame, Hide remove matched frames, PruneFrom drop frames called from matched frame
+	Focus     string
+	Ignore    string
+	Hide      string
+	PruneFrom string
+	// Invert reverse stacks before rendering, so leaf functions become root frames after trace_type frame
+	Invert bool
+	// Top when greater than 0, only N queries ranked by RankBy written, global profiles still contain all queries
+	Top int
+	// RankBy accept values: RankByCPU (default), RankByReal, RankByMemory
+	RankBy string
+	// ClientSymbolize fetch raw addresses from system.trace_log and resolve each unique address only once, instead of resolve each frame on server
+	ClientSymbolize bool
+	// SymbolCacheDir contains resolved addresses for each server build_id and version, DefaultSymbolCacheDir() when not set
+	SymbolCacheDir string
+	// SymbolsBinary is local clickhouse binary with the same build_id as server, addresses resolved via ELF symbols and DWARF line tables,
+	// allow_introspection_functions is not required on server
+	SymbolsBinary string
+	// SymbolsBaseAddress is load address for PIE SymbolsBinary, detected automatically when not set
+	SymbolsBaseAddress uint64
+	// StateFile contains last processed event_time_microseconds for each host and totals of written profiles, when set,
+	// next run fetch only newer samples for known hosts and merge them into existing folded files in OutputDir
+	StateFile string
+	// FlameGraphScript optional flamegraph.pl compatible script used instead of built-in SVG renderer
+	FlameGraphScript string
+}
+
+// ParseDate accept any format parsable by https://github.com/araddon/dateparse or time duration before current time, "15m" and "-15m" both means 15 minutes ago
+func ParseDate(dateValue string) (time.Time, error) {
+	parsedDate, err := dateparse.ParseAny(dateValue)
+	if err == nil {
+		return parsedDate, nil
+	}
+	duration, err := time.ParseDuration(dateValue)
+	if err != nil {
+		return parsedDate, err
+	}
+	if duration < 0 {
+		duration = -duration
+	}
+	return time.Now().Add(-duration), nil
+}
+
+// validateOutputFormat accept empty format, which means svg
+func validateOutputFormat(outputFormat string) error {
+	switch outputFormat {
+	case "", "svg", "txt", "json", "pprof", "speedscope":
+		return nil
+	}
+	return errors.Errorf("unsupported output-format = %s, accept values: svg, txt, json, pprof, speedscope", outputFormat)
+}
+
+// validateInvert reject invert for pprof, because pprof flat time belongs to leaf frames, after invert it would belong to root frames
+func validateInvert(outputFormat string, invert bool) error {
+	if invert && outputFormat == "pprof" {
+		return errors.New("invert can't be used with pprof output-format, because pprof flat time shall belong to leaf frames")
+	}
+	return nil
+}
+
+func (o Options) withDefaults() Options {
+	if o.DSN == "" {
+		o.DSN = "http://localhost:8123/default"
+	}
+	if o.DateTo.IsZero() {
+		o.DateTo = time.Now()
+	}
+	if o.DateFrom.IsZero() {
+		o.DateFrom = o.DateTo.Add(-5 * time.Minute)
+	}
+	if o.OutputDir == "" {
+		o.OutputDir = "./clickhouse-flamegraphs/"
+	}
+	if o.OutputFormat == "" {
+		o.OutputFormat = "svg"
+	}
+	if o.Width <= 0 {
+		o.Width = 1200
+	}
+	if o.Height <= 0 {
+		o.Height = 16
+	}
+	return o
+}
@@ -0,0 +1,165 @@
+package flamegraph
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+func (g *Generator) writeSVG(ctx context.Context, key profileKey, stackName string) error {
+	queryId := key.queryId
+	if key.thread != "" {
+		queryId += " thread " + key.thread
+	}
+	dateFrom, dateTo := g.opts.DateFrom, g.opts.DateTo
+	if bucketStart, err := parseBucket(key.bucket); err == nil {
+		dateFrom, dateTo = bucketStart, bucketStart.Add(g.opts.Bucket)
+	}
+	title := fmt.Sprintf("hostName %s queryId %s (%s) from %s to %s", key.hostName, queryId, key.traceType, g.formatDate(dateFrom), g.formatDate(dateTo))
+	if g.opts.Invert {
+		title += " inverted"
+	}
+	countName := "samples"
+	colors := "hot"
+	if strings.Contains(key.traceType, "Memory") {
+		countName = "bytes"
+		colors = "mem"
+	}
+	stackFile, err := os.Open(stackName)
+	if err != nil {
+		return errors.Wrapf(err, "can't open %s", stackName)
+	}
+	defer stackFile.Close()
+	var svg []byte
+	if g.opts.FlameGraphScript != "" {
+		if svg, err = g.runFlameGraphScript(ctx, stackFile, title, countName, key.traceType); err != nil {
+			return err
+		}
+	} else {
+		root, err := readFoldedStacks(stackFile)
+		if err != nil {
+			return errors.Wrapf(err, "stackName = %s", stackName)
+		}
+		var buf bytes.Buffer
+		if err := renderSVG(&buf, root, svgOptions{
+			Title:     title,
+			Width:     g.opts.Width,
+			Height:    g.opts.Height,
+			CountName: countName,
+			NameType:  key.traceType,
+			Colors:    colors,
+		}); err != nil {
+			return errors.Wrapf(err, "stackName = %s", stackName)
+		}
+		svg = buf.Bytes()
+	}
+
+	fileName := filepath.Join(g.opts.OutputDir, key.fileName("svg"))
+	return errors.Wrapf(os.WriteFile(fileName, svg, 0644), "can't write %s", fileName)
+}
+
+func (g *Generator) writeJSON(key profileKey, stackName string) error {
+	stackFile, err := os.Open(stackName)
+	if err != nil {
+		return errors.Wrapf(err, "can't open %s", stackName)
+	}
+	root, err := readFoldedStacks(stackFile)
+	_ = stackFile.Close()
+	if err != nil {
+		return errors.Wrapf(err, "stackName = %s", stackName)
+	}
+	fileName := filepath.Join(g.opts.OutputDir, key.fileName("json"))
+	return writeFile(fileName, func(w io.Writer) error {
+		return writeFlameJSON(w, root)
+	})
+}
+
+func (g *Generator) writePprofFile(key profileKey, stackName string) error {
+	stackFile, err := os.Open(stackName)
+	if err != nil {
+		return errors.Wrapf(err, "can't open %s", stackName)
+	}
+	defer stackFile.Close()
+	fileName := filepath.Join(g.opts.OutputDir, key.fileName("pb.gz"))
+	return writeFile(fileName, func(w io.Writer) error {
+		return writePprof(w, stackFile, key.hostName, key.queryId, key.thread, key.bucket, key.traceType)
+	})
+}
+
+func addSpeedscopeProfile(speedscope *speedscopeBuilder, key profileKey, stackName string) error {
+	stackFile, err := os.Open(stackName)
+	if err != nil {
+		return errors.Wrapf(err, "can't open %s", stackName)
+	}
+	defer stackFile.Close()
+	return errors.Wrapf(speedscope.addProfile(stackFile, key.hostName+" "+key.name(" "), key.traceType), "stackName = %s", stackName)
+}
+
+// writeSpeedscope write all profiles from one Generate run into outputDir/profile.speedscope.json
+func (g *Generator) writeSpeedscope(speedscope *speedscopeBuilder) error {
+	fileName := filepath.Join(g.opts.OutputDir, "profile.speedscope.json")
+	if err := writeFile(fileName, speedscope.write); err != nil {
+		return err
+	}
+	log.Info().Str("fileName", fileName).Int("profiles", len(speedscope.file.Profiles)).Msg("write speedscope file")
+	return nil
+}
+
+// writeFile create fileName and close it after write, close error is not ignored
+func writeFile(fileName string, write func(w io.Writer) error) error {
+	f, err := os.Create(fileName)
+	if err != nil {
+		return errors.Wrapf(err, "can't create %s", fileName)
+	}
+	if err := write(f); err != nil {
+		_ = f.Close()
+		return errors.Wrapf(err, "fileName = %s", fileName)
+	}
+	return errors.Wrapf(f.Close(), "can't close %s", fileName)
+}
+
+func findFlameGraphScript(script string) (string, error) {
+	log.Debug().Msgf("set flamegraph-script: %s", script)
+	if _, err := os.Stat(script); err == nil {
+		return script, nil
+	}
+	path, err := exec.LookPath(script)
+	if err != nil {
+		return "", errors.Wrapf(err, "%s is not found in $PATH", script)
+	}
+	return path, nil
+}
+
+// runFlameGraphScript render SVG via external flamegraph.pl compatible script, when Options.FlameGraphScript passed
+func (g *Generator) runFlameGraphScript(ctx context.Context, stackFile io.Reader, title, countName, traceType string) ([]byte, error) {
+	args := []string{
+		"--title", title,
+		"--width", fmt.Sprintf("%d", g.opts.Width),
+		"--height", fmt.Sprintf("%d", g.opts.Height),
+		"--countname", countName,
+		"--nametype", traceType,
+		//"--colors", "aqua",
+	}
+	script, err := findFlameGraphScript(g.opts.FlameGraphScript)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug().Str("script", script).Strs("args", args).Send()
+	cmd := exec.CommandContext(ctx, script, args...)
+	cmd.Stdin = stackFile
+	cmd.Stderr = os.Stderr
+
+	svg, err := cmd.Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to run script %s", script)
+	}
+	return svg, nil
+}
@@ -0,0 +1,146 @@
+package flamegraph
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/google/pprof/profile"
+	"github.com/pkg/errors"
+)
+
+// pprofBuilder convert folded stacks produced by traceSQLTemplate into profile.proto, see https://github.com/google/pprof/blob/main/proto/profile.proto
+type pprofBuilder struct {
+	profile   *profile.Profile
+	mapping   *profile.Mapping
+	functions map[string]*profile.Function
+	locations map[string]*profile.Location
+	labels    map[string][]string
+}
+
+func newPprofBuilder(hostName, queryId, thread, bucket, traceType string) *pprofBuilder {
+	sampleType := &profile.ValueType{Type: "samples", Unit: "count"}
+	if strings.Contains(traceType, "Memory") {
+		sampleType = &profile.ValueType{Type: "bytes", Unit: "bytes"}
+	}
+	// addresses are already symbolized on server side, so single mapping just describe clickhouse binary
+	mapping := &profile.Mapping{ID: 1, File: "clickhouse", HasFunctions: true, HasFilenames: true, HasLineNumbers: true}
+	b := &pprofBuilder{
+		profile: &profile.Profile{
+			SampleType:        []*profile.ValueType{sampleType},
+			DefaultSampleType: sampleType.Type,
+			Mapping:           []*profile.Mapping{mapping},
+		},
+		mapping:   mapping,
+		functions: make(map[string]*profile.Function),
+		locations: make(map[string]*profile.Location),
+		labels: map[string][]string{
+			"host":       {hostName},
+			"query_id":   {queryId},
+			"trace_type": {traceType},
+		},
+	}
+	if thread != "" {
+		b.labels["thread"] = []string{thread}
+	}
+	if bucket != "" {
+		b.labels["bucket"] = []string{bucket}
+	}
+	return b
+}
+
+// addStack add one folded stack, first frame is trace_type or allocate/free prefix and stored as sample label
+func (b *pprofBuilder) addStack(frames []string, value uint64) {
+	if len(frames) == 0 {
+		return
+	}
+	labels := b.labels
+	if frames[0] == "allocate" || frames[0] == "free" {
+		labels = make(map[string][]string, len(b.labels)+1)
+		for k, v := range b.labels {
+			labels[k] = v
+		}
+		labels["memory_operation"] = []string{frames[0]}
+	}
+	frames = frames[1:]
+	sample := &profile.Sample{
+		Value:    []int64{int64(value)},
+		Label:    labels,
+		Location: make([]*profile.Location, 0, len(frames)),
+	}
+	// profile.proto expects leaf first
+	for i := len(frames) - 1; i >= 0; i-- {
+		sample.Location = append(sample.Location, b.location(frames[i]))
+	}
+	b.profile.Sample = append(b.profile.Sample, sample)
+}
+
+// location return unique location for "symbol#file:line" frame produced by addressToSymbol and addressToLine
+func (b *pprofBuilder) location(frame string) *profile.Location {
+	if loc, exists := b.locations[frame]; exists {
+		return loc
+	}
+	symbol, fileName, line := parseFrame(frame)
+	fn, exists := b.functions[symbol+"#"+fileName]
+	if !exists {
+		fn = &profile.Function{
+			ID:         uint64(len(b.profile.Function) + 1),
+			Name:       symbol,
+			SystemName: symbol,
+			Filename:   fileName,
+		}
+		b.functions[symbol+"#"+fileName] = fn
+		b.profile.Function = append(b.profile.Function, fn)
+	}
+	loc := &profile.Location{
+		ID:      uint64(len(b.profile.Location) + 1),
+		Mapping: b.mapping,
+		Line:    []profile.Line{{Function: fn, Line: line}},
+	}
+	b.locations[frame] = loc
+	b.profile.Location = append(b.profile.Location, loc)
+	return loc
+}
+
+// parseFrame split "symbol#file:line", addressToLine could return only binary path without line
+func parseFrame(frame string) (symbol, fileName string, line int64) {
+	hashPos := strings.LastIndexByte(frame, '#')
+	if hashPos < 0 {
+		return frame, "", 0
+	}
+	symbol, fileName = frame[:hashPos], frame[hashPos+1:]
+	if colonPos := strings.LastIndexByte(fileName, ':'); colonPos > 0 {
+		if parsedLine, err := strconv.ParseInt(fileName[colonPos+1:], 10, 64); err == nil {
+			fileName, line = fileName[:colonPos], parsedLine
+		}
+	}
+	if symbol == "" {
+		symbol = "??"
+	}
+	return symbol, fileName, line
+}
+
+// writePprof read folded stacks and write gzipped profile.proto
+func writePprof(w io.Writer, r io.Reader, hostName, queryId, thread, bucket, traceType string) error {
+	b := newPprofBuilder(hostName, queryId, thread, bucket, traceType)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		frames, value, err := parseFoldedLine(scanner.Text())
+		if err != nil {
+			return err
+		}
+		b.addStack(frames, value)
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "can't read folded stacks")
+	}
+	if err := b.profile.CheckValid(); err != nil {
+		return errors.Wrap(err, "invalid pprof profile")
+	}
+	return errors.Wrap(b.profile.Write(w), "can't write pprof profile")
+}
@@ -0,0 +1,108 @@
+package flamegraph
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestParseFrame(t *testing.T) {
+	testCases := []struct {
+		frame    string
+		symbol   string
+		fileName string
+		line     int64
+	}{
+		{"DB::Aggregator::execute#/src/Aggregator.cpp:123", "DB::Aggregator::execute", "/src/Aggregator.cpp", 123},
+		{"memcpy#/usr/bin/clickhouse", "memcpy", "/usr/bin/clickhouse", 0},
+		{"operator()#a.cpp:x", "operator()", "a.cpp:x", 0},
+		{"#a.cpp:1", "??", "a.cpp", 1},
+		{"main", "main", "", 0},
+	}
+	for _, tc := range testCases {
+		symbol, fileName, line := parseFrame(tc.frame)
+		if symbol != tc.symbol || fileName != tc.fileName || line != tc.line {
+			t.Errorf("parseFrame(%s) expected %s %s %d, got %s %s %d", tc.frame, tc.symbol, tc.fileName, tc.line, symbol, fileName, line)
+		}
+	}
+}
+
+// pprofSample is decoded sample with leaf first function names
+type pprofSample struct {
+	functions []string
+	value     int64
+	labels    map[string][]string
+}
+
+func decodePprof(t *testing.T, folded, traceType string) (*profile.Profile, []pprofSample) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := writePprof(&buf, strings.NewReader(folded), "host1", "q1", "", "", traceType); err != nil {
+		t.Fatal(err)
+	}
+	p, err := profile.Parse(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := make([]pprofSample, 0, len(p.Sample))
+	for _, s := range p.Sample {
+		sample := pprofSample{value: s.Value[0], labels: s.Label}
+		for _, loc := range s.Location {
+			sample.functions = append(sample.functions, loc.Line[0].Function.Name)
+		}
+		samples = append(samples, sample)
+	}
+	return p, samples
+}
+
+func TestWritePprof(t *testing.T) {
+	p, samples := decodePprof(t, "CPU;main#a.cpp:1;foo#a.cpp:2 5\n\nCPU;main#a.cpp:1;bar#b.cpp:3 3\nCPU;main#a.cpp:1 1\n", "CPU")
+	if len(p.SampleType) != 1 || p.SampleType[0].Type != "samples" || p.SampleType[0].Unit != "count" {
+		t.Errorf("expected samples/count sample type, got %v", p.SampleType)
+	}
+	labels := map[string][]string{"host": {"host1"}, "query_id": {"q1"}, "trace_type": {"CPU"}}
+	expected := []pprofSample{
+		{functions: []string{"foo", "main"}, value: 5, labels: labels},
+		{functions: []string{"bar", "main"}, value: 3, labels: labels},
+		{functions: []string{"main"}, value: 1, labels: labels},
+	}
+	if !reflect.DeepEqual(samples, expected) {
+		t.Errorf("expected samples %v, got %v", expected, samples)
+	}
+	// locations and functions shared between samples
+	if len(p.Location) != 3 || len(p.Function) != 3 {
+		t.Errorf("expected 3 locations and functions, got %d and %d", len(p.Location), len(p.Function))
+	}
+	for _, fn := range p.Function {
+		if fn.Name == "bar" && (fn.Filename != "b.cpp" || p.Sample[1].Location[0].Line[0].Line != 3) {
+			t.Errorf("expected bar at b.cpp:3, got %s:%d", fn.Filename, p.Sample[1].Location[0].Line[0].Line)
+		}
+	}
+}
+
+func TestWritePprofMemory(t *testing.T) {
+	p, samples := decodePprof(t, "allocate;main#a.cpp:1;alloc#b.cpp:9 1024\nfree;main#a.cpp:1;dealloc#b.cpp:19 512\n", "MemorySample")
+	if len(p.SampleType) != 1 || p.SampleType[0].Type != "bytes" || p.SampleType[0].Unit != "bytes" {
+		t.Errorf("expected bytes sample type, got %v", p.SampleType)
+	}
+	if len(samples) != 2 {
+		t.Fatalf("expected 2 samples, got %v", samples)
+	}
+	for i, operation := range []string{"allocate", "free"} {
+		if !reflect.DeepEqual(samples[i].labels["memory_operation"], []string{operation}) || samples[i].labels["trace_type"][0] != "MemorySample" {
+			t.Errorf("expected memory_operation = %s, got %v", operation, samples[i].labels)
+		}
+	}
+	if samples[0].value != 1024 || !reflect.DeepEqual(samples[0].functions, []string{"alloc", "main"}) {
+		t.Errorf("unexpected allocate sample %v", samples[0])
+	}
+}
+
+func TestWritePprofInvalid(t *testing.T) {
+	if err := writePprof(&bytes.Buffer{}, strings.NewReader("CPU;main x\n"), "host1", "q1", "", "", "CPU"); err == nil {
+		t.Error("expected error for invalid folded line")
+	}
+}
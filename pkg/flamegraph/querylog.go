@@ -0,0 +1,91 @@
+package flamegraph
+
+import (
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// applyQueryFilter append system.query_log filters, the same conditions used for .sql files and for JOIN with system.trace_log
+func applyQueryFilter(filter Filter, where string, args []interface{}) (string, []interface{}, error) {
+	if filter.QueryFilter != "" {
+		if _, err := regexp.Compile(filter.QueryFilter); err != nil {
+			return where, args, errors.Wrapf(err, "Invalid regexp query-filter = %s", filter.QueryFilter)
+		}
+		where, args = addWhereArgs(where, " AND match(query, ?) ", args, filter.QueryFilter)
+	}
+	if len(filter.QueryIds) != 0 {
+		queryIdsIn, queryIdsArgs := inPlaceholders(filter.QueryIds)
+		where, args = addWhereArgs(where, " AND query_id IN "+queryIdsIn+" ", args, queryIdsArgs...)
+	}
+	if len(filter.Users) != 0 {
+		usersIn, usersArgs := inPlaceholders(filter.Users)
+		where, args = addWhereArgs(where, " AND (user IN "+usersIn+" OR initial_user IN "+usersIn+") ", args, append(usersArgs, usersArgs...)...)
+	}
+	if len(filter.Databases) != 0 {
+		_, databasesArgs := inPlaceholders(filter.Databases)
+		where, args = addWhereArgs(where, " AND hasAny(databases, ["+placeholders(len(databasesArgs))+"]) ", args, databasesArgs...)
+	}
+	if len(filter.Tables) != 0 {
+		_, tablesArgs := inPlaceholders(filter.Tables)
+		where, args = addWhereArgs(where, " AND hasAny(tables, ["+placeholders(len(tablesArgs))+"]) ", args, tablesArgs...)
+	}
+	if len(filter.QueryKinds) != 0 {
+		queryKindsIn, queryKindsArgs := inPlaceholders(filter.QueryKinds)
+		where, args = addWhereArgs(where, " AND query_kind IN "+queryKindsIn+" ", args, queryKindsArgs...)
+	}
+	if filter.MinQueryDurationMs > 0 {
+		where, args = addWhereArgs(where, " AND query_duration_ms >= ? ", args, filter.MinQueryDurationMs)
+	}
+	if filter.MinMemoryUsage > 0 {
+		where, args = addWhereArgs(where, " AND memory_usage >= ? ", args, filter.MinMemoryUsage)
+	}
+	if filter.MinReadRows > 0 {
+		where, args = addWhereArgs(where, " AND read_rows >= ? ", args, filter.MinReadRows)
+	}
+	if len(filter.ExceptionCodes) != 0 {
+		codesArgs := make([]interface{}, len(filter.ExceptionCodes))
+		for i, code := range filter.ExceptionCodes {
+			codesArgs[i] = code
+		}
+		where, args = addWhereArgs(where, " AND exception_code IN ("+placeholders(len(codesArgs))+") ", args, codesArgs...)
+	}
+	if filter.LogComment != "" {
+		where, args = addWhereArgs(where, " AND log_comment = ? ", args, filter.LogComment)
+	}
+	return where, args, nil
+}
+
+// queryLogColumns return system.query_log columns used by applyQueryFilter besides query_id and query,
+// only used columns are selected, because query_kind and log_comment not exists in old ClickHouse versions
+func queryLogColumns(filter Filter) []string {
+	var columns []string
+	if len(filter.Users) != 0 {
+		columns = append(columns, "user", "initial_user")
+	}
+	if len(filter.Databases) != 0 {
+		columns = append(columns, "databases")
+	}
+	if len(filter.Tables) != 0 {
+		columns = append(columns, "tables")
+	}
+	if len(filter.QueryKinds) != 0 {
+		columns = append(columns, "query_kind")
+	}
+	if filter.MinQueryDurationMs > 0 {
+		columns = append(columns, "query_duration_ms")
+	}
+	if filter.MinMemoryUsage > 0 {
+		columns = append(columns, "memory_usage")
+	}
+	if filter.MinReadRows > 0 {
+		columns = append(columns, "read_rows")
+	}
+	if len(filter.ExceptionCodes) != 0 {
+		columns = append(columns, "exception_code")
+	}
+	if filter.LogComment != "" {
+		columns = append(columns, "log_comment")
+	}
+	return columns
+}
@@ -0,0 +1,76 @@
+package flamegraph
+
+import (
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestApplyQueryFilter(t *testing.T) {
+	testCases := []struct {
+		name     string
+		filter   Filter
+		expected string
+		columns  []string
+		isError  bool
+	}{
+		{name: "empty", filter: Filter{}, expected: "1"},
+		{name: "query filter", filter: Filter{QueryFilter: "^INSERT"}, expected: "1 AND match(query, '^INSERT') "},
+		{name: "invalid query filter", filter: Filter{QueryFilter: "("}, isError: true},
+		{
+			name:     "users match user or initial_user",
+			filter:   Filter{Users: []string{"default", "etl"}},
+			expected: "1 AND (user IN ('default','etl') OR initial_user IN ('default','etl')) ",
+			columns:  []string{"user", "initial_user"},
+		},
+		{
+			name:     "databases and tables match any",
+			filter:   Filter{Databases: []string{"db1"}, Tables: []string{"db1.t1", "db2.t2"}},
+			expected: "1 AND hasAny(databases, ['db1'])  AND hasAny(tables, ['db1.t1','db2.t2']) ",
+			columns:  []string{"databases", "tables"},
+		},
+		{
+			name:     "query kinds and exception codes",
+			filter:   Filter{QueryKinds: []string{"Select", "Insert"}, ExceptionCodes: []int64{0, 241}},
+			expected: "1 AND query_kind IN ('Select','Insert')  AND exception_code IN (0,241) ",
+			columns:  []string{"query_kind", "exception_code"},
+		},
+		{
+			name:     "thresholds and log comment",
+			filter:   Filter{MinQueryDurationMs: 1000, MinMemoryUsage: 1 << 30, MinReadRows: 1e6, LogComment: "nightly"},
+			expected: "1 AND query_duration_ms >= 1000  AND memory_usage >= 1073741824  AND read_rows >= 1000000  AND log_comment = 'nightly' ",
+			columns:  []string{"query_duration_ms", "memory_usage", "read_rows", "log_comment"},
+		},
+		{
+			name:     "all lists in order",
+			filter:   Filter{QueryIds: []string{"q1"}, Users: []string{"u1"}, Databases: []string{"db1"}, Tables: []string{"db1.t1"}, QueryKinds: []string{"Select"}},
+			expected: "1 AND query_id IN ('q1')  AND (user IN ('u1') OR initial_user IN ('u1'))  AND hasAny(databases, ['db1'])  AND hasAny(tables, ['db1.t1'])  AND query_kind IN ('Select') ",
+			columns:  []string{"user", "initial_user", "databases", "tables", "query_kind"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			where, args, err := applyQueryFilter(tc.filter, "1", nil)
+			if tc.isError != (err != nil) {
+				t.Fatalf("unexpected error = %v", err)
+			}
+			if tc.isError {
+				return
+			}
+			if placeholders := strings.Count(where, "?"); placeholders != len(args) {
+				t.Fatalf("%d placeholders, but %d args in %s", placeholders, len(args), where)
+			}
+			values := make([]driver.Value, len(args))
+			for i, arg := range args {
+				values[i] = arg
+			}
+			if actual := interpolateSQL(where, values); actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+			if columns := queryLogColumns(tc.filter); !reflect.DeepEqual(columns, tc.columns) {
+				t.Errorf("expected columns %v, got %v", tc.columns, columns)
+			}
+		})
+	}
+}
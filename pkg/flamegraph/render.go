@@ -0,0 +1,148 @@
+package flamegraph
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// ProfileError contains error for one hostName/queryId.traceType profile
+type ProfileError struct {
+	HostName  string
+	QueryId   string
+	Thread    string
+	TraceType string
+	Bucket    string
+	Err       error
+}
+
+func (e ProfileError) Error() string {
+	return fmt.Sprintf("%s: %v", profileKey{e.HostName, e.QueryId, e.Thread, e.TraceType, e.Bucket}.fileName("*"), e.Err)
+}
+
+func (e ProfileError) Unwrap() error {
+	return e.Err
+}
+
+// ProfileErrors returned by Generator.Generate when some profiles failed, other profiles are written successfully
+type ProfileErrors []ProfileError
+
+func (e ProfileErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d profiles failed: %s", len(e), strings.Join(messages, "; "))
+}
+
+// renderJob is one profile which all rows already fetched
+type renderJob struct {
+	key     profileKey
+	profile *aggregatedProfile
+}
+
+// renderPool render profiles via bounded count of workers, while stacks for next profiles are still fetched
+type renderPool struct {
+	jobs     chan renderJob
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	rendered []profileKey
+	errs     ProfileErrors
+}
+
+func newRenderPool(ctx context.Context, parallelism int, render func(ctx context.Context, key profileKey, profile *aggregatedProfile) error) *renderPool {
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+	p := &renderPool{jobs: make(chan renderJob, parallelism)}
+	for i := 0; i < parallelism; i++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for job := range p.jobs {
+				err := ctx.Err()
+				if err == nil {
+					err = render(ctx, job.key, job.profile)
+				}
+				p.mu.Lock()
+				if err != nil {
+					log.Error().Err(err).Str("hostName", job.key.hostName).Str("queryId", job.key.queryId).Str("thread", job.key.thread).Str("traceType", job.key.traceType).Msg("profile failed")
+					p.errs = append(p.errs, ProfileError{HostName: job.key.hostName, QueryId: job.key.queryId, Thread: job.key.thread, TraceType: job.key.traceType, Bucket: job.key.bucket, Err: err})
+				} else {
+					p.rendered = append(p.rendered, job.key)
+				}
+				p.mu.Unlock()
+			}
+		}()
+	}
+	return p
+}
+
+func (p *renderPool) submit(key profileKey, profile *aggregatedProfile) {
+	p.jobs <- renderJob{key: key, profile: profile}
+}
+
+// wait all submitted jobs, return successfully rendered profiles sorted by key and failed profiles
+func (p *renderPool) wait() ([]profileKey, ProfileErrors) {
+	close(p.jobs)
+	p.wg.Wait()
+	sort.Slice(p.rendered, func(i, j int) bool {
+		return p.rendered[i].less(p.rendered[j])
+	})
+	sort.Slice(p.errs, func(i, j int) bool {
+		return profileKey{p.errs[i].HostName, p.errs[i].QueryId, p.errs[i].Thread, p.errs[i].TraceType, p.errs[i].Bucket}.less(profileKey{p.errs[j].HostName, p.errs[j].QueryId, p.errs[j].Thread, p.errs[j].TraceType, p.errs[j].Bucket})
+	})
+	return p.rendered, p.errs
+}
+
+// renderProfile write outputDir/hostname/queryId.traceType.txt sorted, other formats rendered from it,
+// speedscope profiles added after all profiles rendered, to keep profiles order and shared frames deterministic
+func (g *Generator) renderProfile(ctx context.Context, key profileKey, profile *aggregatedProfile) error {
+	hostDir := filepath.Join(g.opts.OutputDir, key.hostName)
+	if err := os.MkdirAll(hostDir, 0755); err != nil {
+		return errors.Wrapf(err, "can't create %s", hostDir)
+	}
+	stackName := g.stackFileName(key)
+	if g.opts.StateFile != "" {
+		// other formats rendered after commitStackFiles, because merged file is not committed when other profiles of the same host failed
+		return mergeStackFile(stackName, profile)
+	}
+	if err := writeFile(stackName, profile.writeFolded); err != nil {
+		return err
+	}
+	return g.renderFormats(ctx, key, nil)
+}
+
+// renderFormats render Options.OutputFormat from already written outputDir/hostname/queryId.traceType.txt, profile is not used
+func (g *Generator) renderFormats(ctx context.Context, key profileKey, _ *aggregatedProfile) error {
+	stackName := g.stackFileName(key)
+	switch g.opts.OutputFormat {
+	case "svg":
+		return g.writeSVG(ctx, key, stackName)
+	case "json":
+		return g.writeJSON(key, stackName)
+	case "pprof":
+		return g.writePprofFile(key, stackName)
+	}
+	return nil
+}
+
+// mergeStackFile write new stacks merged with existing sorted folded file into temporary file, which renamed by commitStackFiles
+func mergeStackFile(stackName string, profile *aggregatedProfile) error {
+	if _, err := os.Stat(stackName); err == nil {
+		profile.spills = append(profile.spills, spillRun{fileName: stackName, size: -1})
+	}
+	return writeFile(stackName+".tmp", profile.writeFolded)
+}
+
+func (g *Generator) stackFileName(key profileKey) string {
+	return filepath.Join(g.opts.OutputDir, key.fileName("txt"))
+}
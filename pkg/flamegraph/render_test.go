@@ -0,0 +1,38 @@
+package flamegraph
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+// TestRenderPool check all submitted profiles are rendered or failed, results sorted by key regardless of workers order
+func TestRenderPool(t *testing.T) {
+	keys := []profileKey{
+		{hostName: "host2", queryId: "global", traceType: "CPU"},
+		{hostName: "host1", queryId: "q2", traceType: "CPU"},
+		{hostName: "host1", queryId: "q1", traceType: "Real"},
+		{hostName: "host1", queryId: "q1", traceType: "CPU"},
+	}
+	for _, parallelism := range []int{1, 3} {
+		pool := newRenderPool(context.Background(), parallelism, func(ctx context.Context, key profileKey, profile *aggregatedProfile) error {
+			if key.traceType == "Real" {
+				return errors.New("render failed")
+			}
+			return nil
+		})
+		for _, key := range keys {
+			pool.submit(key, &aggregatedProfile{})
+		}
+		rendered, errs := pool.wait()
+		expected := []profileKey{keys[3], keys[1], keys[0]}
+		if !reflect.DeepEqual(rendered, expected) {
+			t.Errorf("parallelism = %d expected rendered %v, got %v", parallelism, expected, rendered)
+		}
+		if len(errs) != 1 || errs[0].QueryId != "q1" || errs[0].TraceType != "Real" {
+			t.Errorf("parallelism = %d expected q1.Real error, got %v", parallelism, errs)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+package flamegraph
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// Handler return HTTP handler with web UI on / and flamegraphs generated on demand on /flamegraph,
+// for example /flamegraph?query_id=...&from=-15m&trace_type=CPU&format=svg&invert=1, Options used as default values for request parameters
+func (g *Generator) Handler() http.Handler {
+	mux := http.NewServeMux()
+	flusher := &logFlusher{interval: systemLogFlushInterval, flush: g.FlushLogs}
+	mux.HandleFunc("/", g.handleIndex)
+	mux.HandleFunc("/flamegraph", func(w http.ResponseWriter, r *http.Request) {
+		g.handleFlamegraph(w, r, flusher)
+	})
+	return mux
+}
+
+// logFlusher run SYSTEM FLUSH LOGS at most once per interval, because server flushes system logs itself every flush_interval_milliseconds,
+// concurrent requests wait for running flush
+type logFlusher struct {
+	mu        sync.Mutex
+	interval  time.Duration
+	lastFlush time.Time
+	flush     func(ctx context.Context) error
+}
+
+func (f *logFlusher) flushLogs(ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if time.Since(f.lastFlush) < f.interval {
+		return nil
+	}
+	if err := f.flush(ctx); err != nil {
+		return err
+	}
+	f.lastFlush = time.Now()
+	return nil
+}
+
+// flamegraphRequest contains parsed HTTP request parameters, names are the same as CLI flags
+type flamegraphRequest struct {
+	filter Filter
+	host   string
+	format string
+	invert bool
+	frames *frameFilter
+	width  int
+	height int
+	title  string
+}
+
+// requestParam return first non-empty value for parameter name and aliases
+func requestParam(q url.Values, names ...string) string {
+	for _, name := range names {
+		if v := q.Get(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// requestSliceParam accept repeated and comma separated values
+func requestSliceParam(q url.Values, names ...string) []string {
+	var values []string
+	for _, name := range names {
+		for _, v := range q[name] {
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					values = append(values, item)
+				}
+			}
+		}
+	}
+	return values
+}
+
+// traceTypes return configured trace types, DefaultTraceTypes when not set
+func (g *Generator) traceTypes() []string {
+	if len(g.opts.TraceTypes) == 0 {
+		return DefaultTraceTypes
+	}
+	return g.opts.TraceTypes
+}
+
+func (g *Generator) parseRequest(q url.Values) (flamegraphRequest, error) {
+	req := flamegraphRequest{
+		host:   requestParam(q, "host"),
+		format: requestParam(q, "format", "output-format", "output_format"),
+		invert: g.opts.Invert,
+		width:  g.opts.Width,
+		height: g.opts.Height,
+	}
+	if req.format == "" {
+		req.format = "svg"
+	}
+	if req.format != "svg" && req.format != "json" && req.format != "txt" && req.format != "pprof" {
+		return req, errors.Errorf("unsupported format = %s, accept values: svg, json, txt, pprof", req.format)
+	}
+	for name, value := range map[string]*int{"width": &req.width, "height": &req.height} {
+		if v := requestParam(q, name); v != "" {
+			parsed, err := strconv.Atoi(v)
+			if err != nil || parsed <= 0 {
+				return req, errors.Errorf("invalid %s = %s", name, v)
+			}
+			*value = parsed
+		}
+	}
+
+	dateFromValue := requestParam(q, "from", "date-from", "date_from")
+	if dateFromValue == "" {
+		dateFromValue = "5m"
+	}
+	dateToValue := requestParam(q, "to", "date-to", "date_to")
+	if dateToValue == "" {
+		dateToValue = "0s"
+	}
+	dateFrom, err := ParseDate(dateFromValue)
+	if err != nil {
+		return req, errors.Wrapf(err, "invalid from = %s", dateFromValue)
+	}
+	dateTo, err := ParseDate(dateToValue)
+	if err != nil {
+		return req, errors.Wrapf(err, "invalid to = %s", dateToValue)
+	}
+
+	req.filter = g.opts.Filter
+	req.filter.DateFrom, req.filter.DateTo = dateFrom, dateTo
+	if v := requestParam(q, "query_filter", "query-filter", "query_regexp", "query-regexp"); v != "" {
+		req.filter.QueryFilter = v
+	}
+	if v := requestSliceParam(q, "query_id", "query_ids", "query-id", "query-ids"); len(v) > 0 {
+		req.filter.QueryIds = v
+	}
+	// response contains one profile, CPU samples and Memory bytes can't be summed, so configured trace type used as default only when it's single
+	req.filter.TraceTypes = requestSliceParam(q, "trace_type", "trace_types", "trace-type", "trace-types")
+	if len(req.filter.TraceTypes) == 0 {
+		if traceTypes := g.traceTypes(); len(traceTypes) != 1 {
+			return req, errors.Errorf("trace_type is required, because trace-types = %s configured", strings.Join(traceTypes, ","))
+		}
+		req.filter.TraceTypes = g.traceTypes()
+	}
+	if len(req.filter.TraceTypes) > 1 {
+		return req, errors.Errorf("only one trace_type accepted, got %s", strings.Join(req.filter.TraceTypes, ","))
+	}
+	if v := requestParam(q, "cluster", "clickhouse-cluster", "clickhouse_cluster"); v != "" {
+		req.filter.Cluster = v
+	}
+	// response contains one profile, so split by thread is not possible and thread frames added instead
+	if v := requestParam(q, "group_by", "group-by"); v != "" {
+		if err := validateGroupBy(v); err != nil {
+			return req, err
+		}
+		req.filter.GroupBy = v
+	}
+	if req.filter.GroupBy == GroupByThread {
+		req.filter.GroupBy = GroupByThreadRoot
+	}
+	// the same for time buckets and leaks
+	req.filter.Bucket = 0
+	req.filter.Leaks = false
+	if v := requestParam(q, "normalize", "normalize-query", "normalize_query"); v != "" {
+		if req.filter.NormalizeQuery, err = strconv.ParseBool(v); err != nil {
+			return req, errors.Errorf("invalid normalize = %s", v)
+		}
+	}
+	if v := requestParam(q, "invert"); v != "" {
+		if req.invert, err = strconv.ParseBool(v); err != nil {
+			return req, errors.Errorf("invalid invert = %s", v)
+		}
+	}
+	if err := validateInvert(req.format, req.invert); err != nil {
+		return req, err
+	}
+	focus, ignore, hide, pruneFrom := g.opts.Focus, g.opts.Ignore, g.opts.Hide, g.opts.PruneFrom
+	for value, names := range map[*string][]string{
+		&focus:     {"focus"},
+		&ignore:    {"ignore"},
+		&hide:      {"hide"},
+		&pruneFrom: {"prune_from", "prune-from"},
+	} {
+		if v := requestParam(q, names...); v != "" {
+			*value = v
+		}
+	}
+	if req.frames, err = newFrameFilter(focus, ignore, hide, pruneFrom); err != nil {
+		return req, err
+	}
+	hostName, queryIds := req.host, strings.Join(req.filter.QueryIds, ",")
+	if hostName == "" {
+		hostName = "all"
+	}
+	if queryIds == "" {
+		queryIds = "global"
+	}
+	req.title = fmt.Sprintf("hostName %s queryId %s (%s) from %s to %s", hostName, queryIds, strings.Join(req.filter.TraceTypes, ","), dateFromValue, dateToValue)
+	if req.invert {
+		req.title += " inverted"
+	}
+	return req, nil
+}
+
+func (g *Generator) handleFlamegraph(w http.ResponseWriter, r *http.Request, flusher *logFlusher) {
+	req, err := g.parseRequest(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := flusher.flushLogs(r.Context()); err != nil {
+		log.Error().Stack().Err(err).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	stacks := make(map[string]uint64)
+	err = g.FetchStacks(r.Context(), req.filter, func(s Stack) error {
+		if req.host == "" || req.host == s.HostName {
+			var accepted bool
+			if s.Frames, accepted = req.frames.apply(s.Frames); !accepted {
+				return nil
+			}
+			if req.invert {
+				s.Frames = invertFrames(s.Frames, req.filter.GroupBy)
+			}
+			stacks[s.Frames] += s.Value
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error().Stack().Err(err).Str("url", r.URL.String()).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var buf bytes.Buffer
+	contentType := "text/plain; charset=utf-8"
+	switch req.format {
+	case "txt":
+		err = writeFoldedStacks(&buf, stacks)
+	case "svg":
+		contentType = "image/svg+xml"
+		err = renderSVG(&buf, newStackTree(stacks), req.svgOptions())
+	case "json":
+		contentType = "application/json"
+		err = writeFlameJSON(&buf, newStackTree(stacks))
+	case "pprof":
+		contentType = "application/octet-stream"
+		w.Header().Set("Content-Disposition", "attachment; filename=\"profile.pb.gz\"")
+		var folded bytes.Buffer
+		if err = writeFoldedStacks(&folded, stacks); err == nil {
+			err = writePprof(&buf, &folded, req.host, strings.Join(req.filter.QueryIds, ","), "", "", strings.Join(req.filter.TraceTypes, ","))
+		}
+	}
+	if err != nil {
+		log.Error().Stack().Err(err).Str("url", r.URL.String()).Send()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		log.Warn().Err(err).Str("url", r.URL.String()).Msg("can't write HTTP response")
+	}
+}
+
+func (req flamegraphRequest) svgOptions() svgOptions {
+	opts := svgOptions{
+		Title:     req.title,
+		Width:     req.width,
+		Height:    req.height,
+		CountName: "samples",
+		NameType:  strings.Join(req.filter.TraceTypes, ","),
+		Colors:    "hot",
+	}
+	allMemory := true
+	for _, traceType := range req.filter.TraceTypes {
+		allMemory = allMemory && strings.Contains(traceType, "Memory")
+	}
+	if allMemory {
+		opts.CountName = "bytes"
+		opts.Colors = "mem"
+	}
+	return opts
+}
+
+func (g *Generator) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := indexTemplate.Execute(w, map[string]interface{}{
+		"QueryIds":    strings.Join(g.opts.QueryIds, ","),
+		"QueryFilter": g.opts.QueryFilter,
+		"Cluster":     g.opts.Cluster,
+		"Normalize":   g.opts.NormalizeQuery,
+		"Invert":      g.opts.Invert,
+		"Focus":       g.opts.Focus,
+		"Ignore":      g.opts.Ignore,
+		"Hide":        g.opts.Hide,
+		"PruneFrom":   g.opts.PruneFrom,
+		"TraceTypes":  g.traceTypes(),
+	}); err != nil {
+		log.Warn().Err(err).Msg("can't write HTTP response")
+	}
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>clickhouse-flamegraph</title>
+<style>
+	body { font-family: Verdana, sans-serif; font-size: 13px; margin: 10px; }
+	form { display: flex; flex-wrap: wrap; gap: 8px; align-items: end; }
+	label { display: flex; flex-direction: column; }
+	iframe { width: 100%; height: 80vh; border: 1px solid #ccc; margin-top: 10px; }
+	#link { margin-top: 8px; display: block; word-break: break-all; }
+</style>
+</head>
+<body>
+<form id="params">
+	<label>from <input name="from" value="-15m"></label>
+	<label>to <input name="to" value="0s"></label>
+	<label>query_id <input name="query_id" value="{{.QueryIds}}" placeholder="comma separated"></label>
+	<label>query_filter <input name="query_filter" value="{{.QueryFilter}}" placeholder="regexp"></label>
+	<label>host <input name="host"></label>
+	<label>cluster <input name="cluster" value="{{.Cluster}}"></label>
+	<label>trace_type <select name="trace_type">{{range .TraceTypes}}<option>{{.}}</option>{{end}}</select></label>
+	<label>format <select name="format"><option>svg</option><option>json</option><option>txt</option><option>pprof</option></select></label>
+	<label>group_by <select name="group_by"><option>query</option><option>thread-root</option></select></label>
+	<label>normalize <input type="checkbox" name="normalize" value="1"{{if .Normalize}} checked{{end}}></label>
+	<label>focus <input name="focus" value="{{.Focus}}" placeholder="regexp"></label>
+	<label>ignore <input name="ignore" value="{{.Ignore}}" placeholder="regexp"></label>
+	<label>hide <input name="hide" value="{{.Hide}}" placeholder="regexp"></label>
+	<label>prune_from <input name="prune_from" value="{{.PruneFrom}}" placeholder="regexp"></label>
+	<label>invert <input type="checkbox" name="invert" value="1"{{if .Invert}} checked{{end}}></label>
+	<button type="submit">Show</button>
+</form>
+<a id="link" href="#"></a>
+<iframe id="result"></iframe>
+<script>
+document.getElementById("params").addEventListener("submit", function(e) {
+	e.preventDefault();
+	var params = new URLSearchParams();
+	new FormData(e.target).forEach(function(value, key) {
+		if (value !== "") params.append(key, value);
+	});
+	var url = "flamegraph?" + params.toString();
+	var link = document.getElementById("link");
+	link.href = url;
+	link.textContent = new URL(url, window.location.href).href;
+	document.getElementById("result").src = url;
+});
+</script>
+</body>
+</html>
+`))
@@ -0,0 +1,69 @@
+package flamegraph
+
+import (
+	"context"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestParseRequestTraceType(t *testing.T) {
+	testCases := []struct {
+		traceTypes []string
+		query      string
+		expected   []string
+		isError    bool
+	}{
+		{traceTypes: []string{"MemorySample"}, query: "", expected: []string{"MemorySample"}},
+		{traceTypes: []string{"CPU", "Real"}, query: "", isError: true},
+		{traceTypes: nil, query: "", isError: true},
+		{traceTypes: []string{"CPU", "Real"}, query: "trace_type=Real", expected: []string{"Real"}},
+		{traceTypes: []string{"CPU"}, query: "trace_type=MemorySample", expected: []string{"MemorySample"}},
+		{traceTypes: []string{"CPU"}, query: "trace_type=CPU,Memory", isError: true},
+		{traceTypes: []string{"CPU"}, query: "trace_type=CPU&trace_type=Real", isError: true},
+	}
+	for _, tc := range testCases {
+		q, err := url.ParseQuery(tc.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := &Generator{opts: Options{Width: 1200, Height: 16, Filter: Filter{TraceTypes: tc.traceTypes}}}
+		req, err := g.parseRequest(q)
+		if tc.isError != (err != nil) {
+			t.Errorf("trace-types = %v, %s unexpected error = %v", tc.traceTypes, tc.query, err)
+			continue
+		}
+		if !tc.isError && !reflect.DeepEqual(req.filter.TraceTypes, tc.expected) {
+			t.Errorf("trace-types = %v, %s expected %v, got %v", tc.traceTypes, tc.query, tc.expected, req.filter.TraceTypes)
+		}
+	}
+}
+
+func TestLogFlusher(t *testing.T) {
+	flushes, flushErr := 0, error(nil)
+	f := &logFlusher{interval: time.Hour, flush: func(ctx context.Context) error {
+		flushes++
+		return flushErr
+	}}
+	flushErr = errors.New("flush failed")
+	if err := f.flushLogs(context.Background()); err == nil {
+		t.Error("expected flush error")
+	}
+	flushErr = nil
+	for i := 0; i < 3; i++ {
+		if err := f.flushLogs(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// failed flush is retried by next request, successful flush is not repeated inside interval
+	if flushes != 2 {
+		t.Errorf("expected 2 flushes, got %d", flushes)
+	}
+	f.lastFlush = time.Now().Add(-2 * time.Hour)
+	if err := f.flushLogs(context.Background()); err != nil || flushes != 3 {
+		t.Errorf("expected flush after interval, got %d flushes, error = %v", flushes, err)
+	}
+}
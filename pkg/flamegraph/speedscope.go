@@ -0,0 +1,113 @@
+package flamegraph
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// speedscopeFile see https://github.com/jlfwong/speedscope/wiki/Importing-from-custom-sources#speedscopes-file-format
+type speedscopeFile struct {
+	Schema             string              `json:"$schema"`
+	Shared             speedscopeShared    `json:"shared"`
+	Profiles           []speedscopeProfile `json:"profiles"`
+	Name               string              `json:"name,omitempty"`
+	ActiveProfileIndex int                 `json:"activeProfileIndex"`
+	Exporter           string              `json:"exporter,omitempty"`
+}
+
+type speedscopeShared struct {
+	Frames []speedscopeFrame `json:"frames"`
+}
+
+type speedscopeFrame struct {
+	Name string `json:"name"`
+	File string `json:"file,omitempty"`
+	Line int64  `json:"line,omitempty"`
+}
+
+type speedscopeProfile struct {
+	Type       string   `json:"type"`
+	Name       string   `json:"name"`
+	Unit       string   `json:"unit"`
+	StartValue uint64   `json:"startValue"`
+	EndValue   uint64   `json:"endValue"`
+	Samples    [][]int  `json:"samples"`
+	Weights    []uint64 `json:"weights"`
+}
+
+// speedscopeBuilder collect profiles for all host/query_id/trace_type into one file with shared frame table
+type speedscopeBuilder struct {
+	file   speedscopeFile
+	frames map[string]int
+}
+
+func newSpeedscopeBuilder(name, exporter string) *speedscopeBuilder {
+	return &speedscopeBuilder{
+		file: speedscopeFile{
+			Schema:   "https://www.speedscope.app/file-format-schema.json",
+			Shared:   speedscopeShared{Frames: make([]speedscopeFrame, 0)},
+			Profiles: make([]speedscopeProfile, 0),
+			Name:     name,
+			Exporter: exporter,
+		},
+		frames: make(map[string]int),
+	}
+}
+
+func (b *speedscopeBuilder) frameIndex(frame string) int {
+	if idx, exists := b.frames[frame]; exists {
+		return idx
+	}
+	symbol, fileName, line := parseFrame(frame)
+	idx := len(b.file.Shared.Frames)
+	b.file.Shared.Frames = append(b.file.Shared.Frames, speedscopeFrame{Name: symbol, File: fileName, Line: line})
+	b.frames[frame] = idx
+	return idx
+}
+
+// addProfile read folded stacks as one sampled profile
+func (b *speedscopeBuilder) addProfile(r io.Reader, name, traceType string) error {
+	profile := speedscopeProfile{
+		Type:    "sampled",
+		Name:    name,
+		Unit:    "none",
+		Samples: make([][]int, 0),
+		Weights: make([]uint64, 0),
+	}
+	if strings.Contains(traceType, "Memory") {
+		profile.Unit = "bytes"
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		frames, value, err := parseFoldedLine(scanner.Text())
+		if err != nil {
+			return err
+		}
+		sample := make([]int, len(frames))
+		for i, frame := range frames {
+			sample[i] = b.frameIndex(frame)
+		}
+		profile.Samples = append(profile.Samples, sample)
+		profile.Weights = append(profile.Weights, value)
+		profile.EndValue += value
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "can't read folded stacks")
+	}
+	b.file.Profiles = append(b.file.Profiles, profile)
+	return nil
+}
+
+func (b *speedscopeBuilder) write(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	return errors.Wrap(encoder.Encode(b.file), "can't write speedscope json")
+}
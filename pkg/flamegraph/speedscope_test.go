@@ -0,0 +1,50 @@
+package flamegraph
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestSpeedscopeBuilder check profiles share frame table, samples are root first frame indexes and weights are folded values
+func TestSpeedscopeBuilder(t *testing.T) {
+	b := newSpeedscopeBuilder("clickhouse-flamegraph", "clickhouse-flamegraph 1.0")
+	if err := b.addProfile(strings.NewReader("CPU;main#a.cpp:1;foo#a.cpp:2 5\n\nCPU;main#a.cpp:1 1\n"), "host1 q1 CPU", "CPU"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.addProfile(strings.NewReader("allocate;main#a.cpp:1;alloc#/usr/bin/clickhouse 1024\n"), "host1 q1 MemorySample", "MemorySample"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.addProfile(strings.NewReader("CPU;main x\n"), "host1 q2 CPU", "CPU"); err == nil {
+		t.Error("expected error for invalid folded line")
+	}
+	var buf bytes.Buffer
+	if err := b.write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var actual speedscopeFile
+	if err := json.Unmarshal(buf.Bytes(), &actual); err != nil {
+		t.Fatal(err)
+	}
+	expected := speedscopeFile{
+		Schema: "https://www.speedscope.app/file-format-schema.json",
+		Shared: speedscopeShared{Frames: []speedscopeFrame{
+			{Name: "CPU"},
+			{Name: "main", File: "a.cpp", Line: 1},
+			{Name: "foo", File: "a.cpp", Line: 2},
+			{Name: "allocate"},
+			{Name: "alloc", File: "/usr/bin/clickhouse"},
+		}},
+		Profiles: []speedscopeProfile{
+			{Type: "sampled", Name: "host1 q1 CPU", Unit: "none", EndValue: 6, Samples: [][]int{{0, 1, 2}, {0, 1}}, Weights: []uint64{5, 1}},
+			{Type: "sampled", Name: "host1 q1 MemorySample", Unit: "bytes", EndValue: 1024, Samples: [][]int{{3, 1, 4}}, Weights: []uint64{1024}},
+		},
+		Name:     "clickhouse-flamegraph",
+		Exporter: "clickhouse-flamegraph 1.0",
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+}
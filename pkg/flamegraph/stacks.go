@@ -0,0 +1,168 @@
+package flamegraph
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// stackNode is prefix tree of folded stacks, root node has empty name and contains total value
+type stackNode struct {
+	Name     string
+	Value    uint64
+	Children map[string]*stackNode
+	// Delta is difference between comparison and baseline for stacks ended on this node, filled only for differential flamegraphs
+	Delta int64
+}
+
+func newStackNode(name string) *stackNode {
+	return &stackNode{Name: name, Children: make(map[string]*stackNode)}
+}
+
+// add increase value for each frame from root to leaf, return leaf node
+func (n *stackNode) add(frames []string, value uint64) *stackNode {
+	n.Value += value
+	node := n
+	for _, frame := range frames {
+		child, exists := node.Children[frame]
+		if !exists {
+			child = newStackNode(frame)
+			node.Children[frame] = child
+		}
+		child.Value += value
+		node = child
+	}
+	return node
+}
+
+// addDiff add stack with comparison value as width and difference with baseline as leaf delta, the same way as flamegraph.pl for difffolded.pl output
+func (n *stackNode) addDiff(frames []string, baseValue, value uint64) {
+	leaf := n.add(frames, value)
+	leaf.Delta += int64(value) - int64(baseValue)
+}
+
+// maxAbsDelta return max absolute Delta in tree, used for color intensity in differential flamegraphs
+func (n *stackNode) maxAbsDelta() int64 {
+	maxDelta := n.Delta
+	if maxDelta < 0 {
+		maxDelta = -maxDelta
+	}
+	for _, child := range n.Children {
+		if d := child.maxAbsDelta(); d > maxDelta {
+			maxDelta = d
+		}
+	}
+	return maxDelta
+}
+
+// sortedChildren return children ordered by name, the same way as flamegraph.pl merge sorted stacks
+func (n *stackNode) sortedChildren() []*stackNode {
+	children := make([]*stackNode, 0, len(n.Children))
+	for _, child := range n.Children {
+		children = append(children, child)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].Name < children[j].Name
+	})
+	return children
+}
+
+// depth return max depth of tree, node without children has zero depth
+func (n *stackNode) depth() int {
+	maxDepth := 0
+	for _, child := range n.Children {
+		if d := child.depth() + 1; d > maxDepth {
+			maxDepth = d
+		}
+	}
+	return maxDepth
+}
+
+// parseFoldedLine split "frame1;frame2;frame3 value" line, see https://github.com/brendangregg/FlameGraph#2-fold-stacks
+func parseFoldedLine(line string) ([]string, uint64, error) {
+	stack, value, err := splitFoldedLine(line)
+	if err != nil {
+		return nil, 0, err
+	}
+	return strings.Split(stack, ";"), value, nil
+}
+
+// splitFoldedLine split folded line into stack and value, without splitting stack into frames
+func splitFoldedLine(line string) (string, uint64, error) {
+	line = strings.TrimSpace(line)
+	spacePos := strings.LastIndexByte(line, ' ')
+	if spacePos <= 0 {
+		return "", 0, errors.Errorf("invalid folded stack line: '%s'", line)
+	}
+	value, err := strconv.ParseUint(line[spacePos+1:], 10, 64)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "invalid folded stack value: '%s'", line)
+	}
+	return line[:spacePos], value, nil
+}
+
+// readFoldedStacks build stackNode tree from folded stacks
+func readFoldedStacks(r io.Reader) (*stackNode, error) {
+	root := newStackNode("")
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		frames, value, err := parseFoldedLine(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		root.add(frames, value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "can't read folded stacks")
+	}
+	return root, nil
+}
+
+// newStackTree build stackNode tree from aggregated folded stacks
+func newStackTree(stacks map[string]uint64) *stackNode {
+	root := newStackNode("")
+	for stack, value := range stacks {
+		root.add(strings.Split(stack, ";"), value)
+	}
+	return root
+}
+
+// writeFoldedStacks write aggregated stacks sorted by name in folded format
+func writeFoldedStacks(w io.Writer, stacks map[string]uint64) error {
+	stackKeys := make([]string, 0, len(stacks))
+	for stack := range stacks {
+		stackKeys = append(stackKeys, stack)
+	}
+	sort.Strings(stackKeys)
+	for _, stack := range stackKeys {
+		if _, err := fmt.Fprintf(w, "%s %d\n", stack, stacks[stack]); err != nil {
+			return errors.Wrap(err, "can't write folded stacks")
+		}
+	}
+	return nil
+}
+
+// invertFrames reverse call stack frames, so leaf functions become root, and time spent in the same function summed regardless of callers,
+// first trace_type or allocate/free frame and thread frame added for GroupByThreadRoot are kept at root
+func invertFrames(frames string, groupBy string) string {
+	rootFrames := 1
+	if groupBy == GroupByThreadRoot {
+		rootFrames = 2
+	}
+	parts := strings.Split(frames, ";")
+	if len(parts) <= rootFrames {
+		return frames
+	}
+	slices.Reverse(parts[rootFrames:])
+	return strings.Join(parts, ";")
+}
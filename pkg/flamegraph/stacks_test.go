@@ -0,0 +1,56 @@
+package flamegraph
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+)
+
+func TestInvertFrames(t *testing.T) {
+	testCases := []struct {
+		frames   string
+		groupBy  string
+		expected string
+	}{
+		{"CPU;main;foo;bar", GroupByQuery, "CPU;bar;foo;main"},
+		{"allocate;main;malloc", GroupByThread, "allocate;malloc;main"},
+		{"CPU", GroupByQuery, "CPU"},
+		{"CPU;main", GroupByQuery, "CPU;main"},
+		{"CPU;thread [1];main;foo;bar", GroupByThreadRoot, "CPU;thread [1];bar;foo;main"},
+		{"leak;QueryPipelineEx [42];main;malloc", GroupByThreadRoot, "leak;QueryPipelineEx [42];malloc;main"},
+		{"CPU;thread [1]", GroupByThreadRoot, "CPU;thread [1]"},
+	}
+	for _, tc := range testCases {
+		if actual := invertFrames(tc.frames, tc.groupBy); actual != tc.expected {
+			t.Errorf("invertFrames(%s, %s) expected %s, got %s", tc.frames, tc.groupBy, tc.expected, actual)
+		}
+	}
+}
+
+// TestInvertPprof check invert rejected for pprof in CLI and serve, because pprof flat time shall belong to leaf frames
+func TestInvertPprof(t *testing.T) {
+	traceLog := writeTestFile(t, "host1.tsv", testTraceLog)
+	testCases := []struct {
+		outputFormat string
+		invert       bool
+		isError      bool
+	}{
+		{outputFormat: "svg", invert: true},
+		{outputFormat: "speedscope", invert: true},
+		{outputFormat: "pprof", invert: false},
+		{outputFormat: "pprof", invert: true, isError: true},
+	}
+	for _, tc := range testCases {
+		opts := Options{OutputDir: t.TempDir(), OutputFormat: tc.outputFormat, Invert: tc.invert}
+		if _, err := NewImportGenerator(opts, ImportOptions{TraceLogFiles: []string{traceLog}}); tc.isError != (err != nil) {
+			t.Errorf("output-format = %s, invert = %v unexpected error = %v", tc.outputFormat, tc.invert, err)
+		}
+		if tc.outputFormat == "speedscope" {
+			continue
+		}
+		g := &Generator{opts: Options{Width: 1200, Height: 16}}
+		if _, err := g.parseRequest(url.Values{"format": {tc.outputFormat}, "invert": {strconv.FormatBool(tc.invert)}, "trace_type": {"CPU"}}); tc.isError != (err != nil) {
+			t.Errorf("format = %s, invert = %v unexpected request error = %v", tc.outputFormat, tc.invert, err)
+		}
+	}
+}
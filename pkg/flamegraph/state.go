@@ -0,0 +1,225 @@
+package flamegraph
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// runState is Options.StateFile content, high-water marks allow build cumulative profiles from repeated runs without missing or double counted samples
+type runState struct {
+	// DateFrom of the first run, used in index.html title
+	DateFrom time.Time `json:"date_from"`
+	// Hosts format = hostname -> last processed event_time_microseconds
+	Hosts map[string]time.Time `json:"hosts"`
+	// Profiles contains totals of all written profiles, because index.html shall contain profiles without new samples
+	Profiles []stateProfile `json:"profiles"`
+}
+
+type stateProfile struct {
+	HostName  string `json:"host_name"`
+	QueryId   string `json:"query_id"`
+	Thread    string `json:"thread,omitempty"`
+	TraceType string `json:"trace_type"`
+	Bucket    string `json:"bucket,omitempty"`
+	Total     uint64 `json:"total"`
+}
+
+// loadState return empty state when stateFile doesn't exist
+func loadState(stateFile string) (*runState, error) {
+	state := &runState{Hosts: make(map[string]time.Time)}
+	data, err := os.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't read state-file = %s", stateFile)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, errors.Wrapf(err, "can't parse state-file = %s", stateFile)
+	}
+	if state.Hosts == nil {
+		state.Hosts = make(map[string]time.Time)
+	}
+	return state, nil
+}
+
+// save write state into temporary file and rename it, so state-file is never partially written
+func (s *runState) save(stateFile string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "can't marshal state")
+	}
+	tmpFile := stateFile + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return errors.Wrapf(err, "can't write %s", tmpFile)
+	}
+	if err := os.Rename(tmpFile, stateFile); err != nil {
+		return errors.Wrapf(err, "can't rename %s to %s", tmpFile, stateFile)
+	}
+	log.Info().Str("stateFile", stateFile).Int("hosts", len(s.Hosts)).Int("profiles", len(s.Profiles)).Msg("save state")
+	return nil
+}
+
+// merge add totals of current run to previous totals, return all profiles sorted by key and summed totals
+func (s *runState) merge(rendered []profileKey, totals map[profileKey]uint64) ([]profileKey, map[profileKey]uint64) {
+	merged := make(map[profileKey]uint64, len(s.Profiles)+len(rendered))
+	for _, p := range s.Profiles {
+		merged[profileKey{hostName: p.HostName, queryId: p.QueryId, thread: p.Thread, traceType: p.TraceType, bucket: p.Bucket}] = p.Total
+	}
+	for _, key := range rendered {
+		merged[key] += totals[key]
+	}
+	keys := make([]profileKey, 0, len(merged))
+	for key := range merged {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].less(keys[j])
+	})
+	s.Profiles = s.Profiles[:0]
+	for _, key := range keys {
+		s.Profiles = append(s.Profiles, stateProfile{HostName: key.hostName, QueryId: key.queryId, Thread: key.thread, TraceType: key.traceType, Bucket: key.bucket, Total: merged[key]})
+	}
+	return keys, merged
+}
+
+// earliestDateFrom return min of DateFrom and HostsDateFrom, used as partition pruning condition
+func (f Filter) earliestDateFrom() time.Time {
+	dateFrom := f.DateFrom
+	for _, hostDateFrom := range f.HostsDateFrom {
+		if hostDateFrom.Before(dateFrom) {
+			dateFrom = hostDateFrom
+		}
+	}
+	return dateFrom
+}
+
+// applyHostsDateFrom add event_time_microseconds > hostDateFrom condition for each known host and event_time >= DateFrom for other hosts,
+// event_time >= hostDateFrom seconds is kept for partition pruning and primary key, samples flushed later within the same second are not skipped,
+// high-water marks passed as unix timestamps, so they don't depend on server and client timezones
+func applyHostsDateFrom(filter Filter, where string, whereArgs []interface{}) (string, []interface{}) {
+	if len(filter.HostsDateFrom) == 0 {
+		return where, whereArgs
+	}
+	hostNames := make([]string, 0, len(filter.HostsDateFrom))
+	for hostName := range filter.HostsDateFrom {
+		hostNames = append(hostNames, hostName)
+	}
+	sort.Strings(hostNames)
+	hostNamesIn, hostNamesArgs := inPlaceholders(hostNames)
+	conditions := []string{"(hostName() NOT IN " + hostNamesIn + " AND event_time >= ?)"}
+	whereArgs = append(append(whereArgs, hostNamesArgs...), filter.DateFrom)
+	for _, hostName := range hostNames {
+		hostDateFrom := filter.HostsDateFrom[hostName]
+		conditions = append(conditions, "(hostName() = ? AND event_time >= toDateTime(?) AND toUnixTimestamp64Micro(event_time_microseconds) > ?)")
+		whereArgs = append(whereArgs, hostName, hostDateFrom.Unix(), hostDateFrom.UnixMicro())
+	}
+	return where + " AND (" + strings.Join(conditions, " OR ") + ")", whereArgs
+}
+
+// capClusterDateTo limit DateTo by now - systemLogFlushInterval when Filter.Cluster is set, because SYSTEM FLUSH LOGS flushes only the local server,
+// and samples not flushed yet by other servers would be skipped forever after high-water marks advanced
+func capClusterDateTo(filter Filter, now time.Time) Filter {
+	if flushedDateTo := now.Add(-systemLogFlushInterval); filter.Cluster != "" && filter.DateTo.After(flushedDateTo) {
+		log.Info().Time("dateTo", flushedDateTo).Msg("samples not flushed by cluster servers left for next run")
+		filter.DateTo = flushedDateTo
+	}
+	return filter
+}
+
+// commitStackFiles replace stack files by merged .txt.tmp files and advance high-water marks only for hosts where all profiles are replaced,
+// merged files of hosts with failed profiles are removed, so next run fetch all samples of these hosts again without double counting
+func (g *Generator) commitStackFiles(state *runState, merged []profileKey, errs ProfileErrors, lastEventTimes map[string]time.Time) ([]profileKey, ProfileErrors) {
+	failedHosts := make(map[string]bool)
+	for _, err := range errs {
+		failedHosts[err.HostName] = true
+	}
+	var hostNames []string
+	hostKeys := make(map[string][]profileKey)
+	for _, key := range merged {
+		if _, exists := hostKeys[key.hostName]; !exists {
+			hostNames = append(hostNames, key.hostName)
+		}
+		hostKeys[key.hostName] = append(hostKeys[key.hostName], key)
+	}
+	committed := make([]profileKey, 0, len(merged))
+	for _, hostName := range hostNames {
+		if !failedHosts[hostName] {
+			err := g.replaceStackFiles(hostKeys[hostName])
+			if err == nil {
+				committed = append(committed, hostKeys[hostName]...)
+				continue
+			}
+			failedHosts[hostName] = true
+			errs = append(errs, *err)
+		}
+		for _, key := range hostKeys[hostName] {
+			if err := os.Remove(g.stackFileName(key) + ".tmp"); err != nil && !os.IsNotExist(err) {
+				log.Warn().Err(err).Send()
+			}
+		}
+	}
+	for hostName, lastEventTime := range lastEventTimes {
+		if failedHosts[hostName] {
+			log.Warn().Str("hostName", hostName).Msg("state not advanced, because some profiles failed, samples will be fetched again by next run")
+			continue
+		}
+		state.Hosts[hostName] = lastEventTime
+	}
+	return committed, errs
+}
+
+// replaceStackFiles rename .txt.tmp files of one host over stack files, previous stack files kept as .txt.bak until all files are renamed,
+// when some rename failed, already replaced files are rolled back, so stack files always correspond to high-water mark of the host
+func (g *Generator) replaceStackFiles(keys []profileKey) *ProfileError {
+	type replacedFile struct {
+		stackName string
+		backup    bool
+	}
+	replaced := make([]replacedFile, 0, len(keys))
+	for _, key := range keys {
+		stackName := g.stackFileName(key)
+		err := os.Rename(stackName, stackName+".bak")
+		backup := err == nil
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		if err == nil {
+			if err = os.Rename(stackName+".tmp", stackName); err != nil && backup {
+				if restoreErr := os.Rename(stackName+".bak", stackName); restoreErr != nil {
+					log.Error().Err(restoreErr).Str("stackName", stackName).Msg("can't restore stack file")
+				}
+			}
+		}
+		if err != nil {
+			for i := len(replaced) - 1; i >= 0; i-- {
+				r := replaced[i]
+				restoreErr := error(nil)
+				if r.backup {
+					restoreErr = os.Rename(r.stackName+".bak", r.stackName)
+				} else {
+					restoreErr = os.Remove(r.stackName)
+				}
+				if restoreErr != nil {
+					log.Error().Err(restoreErr).Str("stackName", r.stackName).Msg("can't restore stack file")
+				}
+			}
+			return &ProfileError{HostName: key.hostName, QueryId: key.queryId, Thread: key.thread, TraceType: key.traceType, Bucket: key.bucket, Err: errors.Wrapf(err, "can't replace %s by %s.tmp", stackName, stackName)}
+		}
+		replaced = append(replaced, replacedFile{stackName: stackName, backup: backup})
+	}
+	for _, r := range replaced {
+		if r.backup {
+			if err := os.Remove(r.stackName + ".bak"); err != nil {
+				log.Warn().Err(err).Send()
+			}
+		}
+	}
+	return nil
+}
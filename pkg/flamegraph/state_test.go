@@ -0,0 +1,227 @@
+package flamegraph
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyHostsDateFrom(t *testing.T) {
+	dateFrom := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	hostDateFrom := time.Date(2026, 10, 1, 10, 0, 1, 500000000, time.UTC)
+	where, whereArgs := applyHostsDateFrom(Filter{DateFrom: dateFrom, HostsDateFrom: map[string]time.Time{"host1": hostDateFrom}}, "1", nil)
+	expectedWhere := "1 AND ((hostName() NOT IN (?) AND event_time >= ?) OR (hostName() = ? AND event_time >= toDateTime(?) AND toUnixTimestamp64Micro(event_time_microseconds) > ?))"
+	if where != expectedWhere {
+		t.Errorf("expected %s, got %s", expectedWhere, where)
+	}
+	expectedArgs := []interface{}{"host1", dateFrom, "host1", hostDateFrom.Unix(), hostDateFrom.UnixMicro()}
+	if !reflect.DeepEqual(whereArgs, expectedArgs) {
+		t.Errorf("expected %v, got %v", expectedArgs, whereArgs)
+	}
+	if where, whereArgs = applyHostsDateFrom(Filter{DateFrom: dateFrom}, "1", nil); where != "1" || whereArgs != nil {
+		t.Errorf("expected unchanged where without HostsDateFrom, got %s %v", where, whereArgs)
+	}
+}
+
+// TestFetchStacksServerTimeZone check max_event_time and high-water marks are passed as unix timestamps and don't depend on server timezone
+func TestFetchStacksServerTimeZone(t *testing.T) {
+	msk := time.FixedZone("MSK", 3*60*60)
+	lastEventTime := time.Date(2026, 10, 1, 10, 0, 1, 700000000, time.UTC)
+	hostDateFrom := time.Date(2026, 10, 1, 10, 0, 1, 500000000, time.UTC)
+	testCases := []struct {
+		name          string
+		hostsDateFrom map[string]time.Time
+		maxEventTime  driver.Value
+		expected      time.Time
+	}{
+		{name: "seconds", maxEventTime: uint32(lastEventTime.Unix()), expected: lastEventTime.Truncate(time.Second)},
+		{name: "state microseconds", hostsDateFrom: map[string]time.Time{"host1": hostDateFrom}, maxEventTime: lastEventTime.UnixMicro(), expected: lastEventTime},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			g, ch := newFakeGenerator(t, Options{}, msk, func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+				return []string{"host_name", "query_id", "trace_type", "stack", "samples", "total_size", "max_event_time"},
+					[][]driver.Value{{"host1", "q1", "CPU", "CPU;main", uint64(1), uint64(0), tc.maxEventTime}}
+			})
+			filter := Filter{TraceTypes: []string{"CPU"}, DateFrom: hostDateFrom.Add(-time.Hour), DateTo: hostDateFrom.Add(time.Hour), HostsDateFrom: tc.hostsDateFrom}
+			var stacks []Stack
+			if err := g.FetchStacks(context.Background(), filter, func(s Stack) error {
+				stacks = append(stacks, s)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if len(stacks) != 1 || !stacks[0].LastEventTime.Equal(tc.expected) {
+				t.Fatalf("expected LastEventTime %s, got %v", tc.expected, stacks)
+			}
+			q := ch.findQuery(t, "max_event_time")
+			if tc.hostsDateFrom == nil {
+				if !strings.Contains(q.sql, "toUnixTimestamp(max(event_time)) AS max_event_time") {
+					t.Errorf("expected max_event_time in seconds, got %s", q.sql)
+				}
+				return
+			}
+			if !strings.Contains(q.sql, "toUnixTimestamp64Micro(max(event_time_microseconds)) AS max_event_time") {
+				t.Errorf("expected max_event_time in microseconds, got %s", q.sql)
+			}
+			if !slices.Contains(q.args, driver.Value(hostDateFrom.Unix())) || !slices.Contains(q.args, driver.Value(hostDateFrom.UnixMicro())) {
+				t.Errorf("expected unix high-water mark args, got %v", q.args)
+			}
+		})
+	}
+}
+
+// TestGenerateStateFile check samples flushed later within the same second are not skipped, and state is not advanced when some profile of the host failed
+func TestGenerateStateFile(t *testing.T) {
+	const header = "hostname\tevent_time\tevent_time_microseconds\tquery_id\ttrace_type\tthread_id\tsize\ttrace\tsymbols\tlines\n"
+	const cpuRow = "host1\t2026-10-01 10:00:01\t2026-10-01 10:00:01.%s\tq1\tCPU\t1\t0\t[1,2]\t['foo','main']\t['a.cpp:2','a.cpp:1']\n"
+	const realRow = "host1\t2026-10-01 10:00:01\t2026-10-01 10:00:01.%s\tq1\tReal\t1\t0\t[1,2]\t['foo','main']\t['a.cpp:2','a.cpp:1']\n"
+	outputDir, stateFile := t.TempDir(), filepath.Join(t.TempDir(), "state.json")
+	generate := func(traceLog string) error {
+		opts := Options{OutputDir: outputDir, OutputFormat: "txt", StateFile: stateFile}
+		g, err := NewImportGenerator(opts, ImportOptions{TraceLogFiles: []string{writeTestFile(t, "host1.tsv", traceLog)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return g.Generate(context.Background())
+	}
+	checkOutput := func(expected map[string]string, expectedLastEventTime string) {
+		t.Helper()
+		files := readOutputFiles(t, outputDir)
+		for name, content := range expected {
+			if files[name] != content {
+				t.Errorf("%s expected:\n%s\ngot:\n%s", name, content, files[name])
+			}
+		}
+		state, err := loadState(stateFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := state.Hosts["host1"].Format("15:04:05.000000"); actual != expectedLastEventTime {
+			t.Errorf("expected state %s, got %s", expectedLastEventTime, actual)
+		}
+	}
+
+	traceLog := header + fmt.Sprintf(cpuRow, "200000") + fmt.Sprintf(cpuRow, "500000")
+	if err := generate(traceLog); err != nil {
+		t.Fatal(err)
+	}
+	checkOutput(map[string]string{"host1/q1.CPU.txt": "CPU;main#a.cpp:1;foo#a.cpp:2 2\n"}, "10:00:01.500000")
+
+	// sample of the same second flushed after previous run
+	traceLog += fmt.Sprintf(cpuRow, "700000")
+	if err := generate(traceLog); err != nil {
+		t.Fatal(err)
+	}
+	checkOutput(map[string]string{"host1/q1.CPU.txt": "CPU;main#a.cpp:1;foo#a.cpp:2 3\n"}, "10:00:01.700000")
+
+	// Real profile can't be merged, CPU profile of the same host shall not be committed
+	blocker := filepath.Join(outputDir, "host1", "q1.Real.txt.tmp")
+	if err := os.MkdirAll(filepath.Join(blocker, "blocker"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	traceLog += fmt.Sprintf(cpuRow, "800000") + fmt.Sprintf(realRow, "900000")
+	var profileErrors ProfileErrors
+	if err := generate(traceLog); !errors.As(err, &profileErrors) {
+		t.Fatalf("expected ProfileErrors, got %v", err)
+	}
+	checkOutput(map[string]string{"host1/q1.CPU.txt": "CPU;main#a.cpp:1;foo#a.cpp:2 3\n"}, "10:00:01.700000")
+	if _, err := os.Stat(filepath.Join(outputDir, "host1", "q1.CPU.txt.tmp")); !os.IsNotExist(err) {
+		t.Errorf("expected removed q1.CPU.txt.tmp, got %v", err)
+	}
+
+	if err := os.RemoveAll(blocker); err != nil {
+		t.Fatal(err)
+	}
+	if err := generate(traceLog); err != nil {
+		t.Fatal(err)
+	}
+	checkOutput(map[string]string{
+		"host1/q1.CPU.txt":  "CPU;main#a.cpp:1;foo#a.cpp:2 4\n",
+		"host1/q1.Real.txt": "Real;main#a.cpp:1;foo#a.cpp:2 1\n",
+	}, "10:00:01.900000")
+}
+
+func TestCapClusterDateTo(t *testing.T) {
+	now := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		cluster  string
+		dateTo   time.Time
+		expected time.Time
+	}{
+		{cluster: "", dateTo: now, expected: now},
+		{cluster: "default", dateTo: now, expected: now.Add(-systemLogFlushInterval)},
+		{cluster: "default", dateTo: now.Add(time.Hour), expected: now.Add(-systemLogFlushInterval)},
+		{cluster: "default", dateTo: now.Add(-time.Hour), expected: now.Add(-time.Hour)},
+	}
+	for _, tc := range testCases {
+		if actual := capClusterDateTo(Filter{Cluster: tc.cluster, DateTo: tc.dateTo}, now).DateTo; !actual.Equal(tc.expected) {
+			t.Errorf("cluster = %q, dateTo = %s expected %s, got %s", tc.cluster, tc.dateTo, tc.expected, actual)
+		}
+	}
+}
+
+// TestCommitStackFiles check stack files of the host are rolled back and state is not advanced when some rename failed
+func TestCommitStackFiles(t *testing.T) {
+	outputDir := t.TempDir()
+	g := &Generator{opts: Options{OutputDir: outputDir, OutputFormat: "txt"}}
+	cpuKey := profileKey{hostName: "host1", queryId: "q1", traceType: "CPU"}
+	realKey := profileKey{hostName: "host1", queryId: "q1", traceType: "Real"}
+	newKey := profileKey{hostName: "host1", queryId: "q2", traceType: "CPU"}
+	otherKey := profileKey{hostName: "host2", queryId: "q1", traceType: "CPU"}
+	files := map[string]string{
+		"host1/q1.CPU.txt":      "a 1\n",
+		"host1/q1.CPU.txt.tmp":  "a 2\n",
+		"host1/q1.Real.txt":     "b 1\n",
+		"host1/q1.Real.txt.tmp": "b 2\n",
+		"host1/q2.CPU.txt.tmp":  "c 1\n",
+		"host2/q1.CPU.txt.tmp":  "d 1\n",
+	}
+	for name, content := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(outputDir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(outputDir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// q1.Real.txt can't be moved to backup, q2.CPU.txt and q1.CPU.txt already replaced shall be rolled back
+	if err := os.MkdirAll(filepath.Join(outputDir, "host1", "q1.Real.txt.bak", "blocker"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	lastEventTime := time.Date(2026, 10, 1, 10, 0, 1, 0, time.UTC)
+	state := &runState{Hosts: map[string]time.Time{}}
+	committed, errs := g.commitStackFiles(state, []profileKey{cpuKey, newKey, realKey, otherKey}, nil, map[string]time.Time{"host1": lastEventTime, "host2": lastEventTime})
+	if !reflect.DeepEqual(committed, []profileKey{otherKey}) {
+		t.Errorf("expected only host2 committed, got %v", committed)
+	}
+	if len(errs) != 1 || errs[0].HostName != "host1" || errs[0].TraceType != "Real" {
+		t.Errorf("expected host1 q1.Real error, got %v", errs)
+	}
+	if _, exists := state.Hosts["host1"]; exists || !state.Hosts["host2"].Equal(lastEventTime) {
+		t.Errorf("expected state advanced only for host2, got %v", state.Hosts)
+	}
+	actual := readOutputFiles(t, outputDir)
+	expected := map[string]string{"host1/q1.CPU.txt": "a 1\n", "host1/q1.Real.txt": "b 1\n", "host2/q1.CPU.txt": "d 1\n"}
+	for name, content := range expected {
+		if actual[name] != content {
+			t.Errorf("%s expected %q, got %q", name, content, actual[name])
+		}
+	}
+	for name := range actual {
+		if _, exists := expected[name]; !exists {
+			t.Errorf("unexpected file %s", name)
+		}
+	}
+	if tmpFiles, _ := filepath.Glob(filepath.Join(outputDir, "*", "*.tmp")); len(tmpFiles) > 0 {
+		t.Errorf("expected removed .tmp files, got %v", tmpFiles)
+	}
+}
@@ -0,0 +1,375 @@
+package flamegraph
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// svgOptions the same meaning as flamegraph.pl options, see https://github.com/brendangregg/FlameGraph#options
+type svgOptions struct {
+	Title     string
+	Width     int
+	Height    int
+	CountName string
+	NameType  string
+	Colors    string
+}
+
+const (
+	svgFontSize  = 12
+	svgFontWidth = 0.59
+	svgMinWidth  = 0.1
+	svgXPad      = 10
+	svgYPad1     = svgFontSize * 3
+	svgYPad2     = svgFontSize*2 + 10
+)
+
+// renderSVG write interactive SVG flamegraph, layout and behavior follows flamegraph.pl
+func renderSVG(w io.Writer, root *stackNode, opts svgOptions) error {
+	if opts.Width <= 0 {
+		opts.Width = 1200
+	}
+	if opts.Height <= 0 {
+		opts.Height = 16
+	}
+	if opts.CountName == "" {
+		opts.CountName = "samples"
+	}
+	if opts.NameType == "" {
+		opts.NameType = "Function:"
+	} else if !strings.HasSuffix(opts.NameType, ":") {
+		opts.NameType += ":"
+	}
+	if opts.Colors == "" {
+		opts.Colors = "hot"
+	}
+	maxDepth := root.depth()
+	imageHeight := (maxDepth+1)*opts.Height + svgYPad1 + svgYPad2
+	buf := bufio.NewWriter(w)
+	r := &svgRenderer{w: buf, opts: opts, imageHeight: imageHeight, total: root.Value}
+	if opts.Colors == "diff" {
+		r.maxDelta = root.maxAbsDelta()
+	}
+
+	r.printf(svgHeader, opts.Width, imageHeight, opts.Width, imageHeight)
+	r.printf(svgStyle, svgFontSize)
+	r.printf("<script type=\"text/ecmascript\">\n<![CDATA[\nvar nametype = %s, fontsize = %d, fontwidth = %g, xpad = %d;\n%s]]>\n</script>\n",
+		strconv.Quote(opts.NameType), svgFontSize, svgFontWidth, svgXPad, svgScript)
+	r.printf("<rect x=\"0.0\" y=\"0\" width=\"%d.0\" height=\"%d.0\" fill=\"url(#background)\"/>\n", opts.Width, imageHeight)
+	r.printf("<text id=\"title\" x=\"%.2f\" y=\"24\">%s</text>\n", float64(opts.Width)/2, html.EscapeString(opts.Title))
+	r.printf("<text id=\"details\" x=\"%d\" y=\"%d\"> </text>\n", svgXPad, imageHeight-svgYPad2/2)
+	r.printf("<text id=\"unzoom\" x=\"%d\" y=\"24\" class=\"hide\">Reset Zoom</text>\n", svgXPad)
+	r.printf("<text id=\"search\" x=\"%d\" y=\"24\">Search</text>\n", opts.Width-svgXPad-100)
+	r.printf("<text id=\"ignorecase\" x=\"%d\" y=\"24\">ic</text>\n", opts.Width-svgXPad-16)
+	r.printf("<text id=\"matched\" x=\"%d\" y=\"%d\"> </text>\n", opts.Width-svgXPad-100, imageHeight-svgYPad2/2)
+	r.printf("<g id=\"frames\">\n")
+	if root.Value > 0 {
+		widthPerValue := float64(opts.Width-2*svgXPad) / float64(root.Value)
+		r.writeFrame("all", root, 0, 0, widthPerValue)
+	}
+	r.printf("</g>\n</svg>\n")
+	if r.err != nil {
+		return r.err
+	}
+	return errors.Wrap(buf.Flush(), "can't write svg")
+}
+
+type svgRenderer struct {
+	w           *bufio.Writer
+	opts        svgOptions
+	imageHeight int
+	total       uint64
+	maxDelta    int64
+	err         error
+}
+
+func (r *svgRenderer) printf(format string, args ...interface{}) {
+	if r.err != nil {
+		return
+	}
+	if _, err := fmt.Fprintf(r.w, format, args...); err != nil {
+		r.err = errors.Wrap(err, "can't write svg")
+	}
+}
+
+// writeFrame write node and all children recursively, offset is value before node on the same depth
+func (r *svgRenderer) writeFrame(name string, node *stackNode, depth int, offset uint64, widthPerValue float64) {
+	width := float64(node.Value) * widthPerValue
+	if width < svgMinWidth {
+		return
+	}
+	x := float64(svgXPad) + float64(offset)*widthPerValue
+	y := float64(r.imageHeight-svgYPad2-(depth+1)*r.opts.Height) + 1
+	height := float64(r.opts.Height - 1)
+	info := fmt.Sprintf("%s (%s %s, %.2f%%)", name, formatCount(node.Value), r.opts.CountName, 100*float64(node.Value)/float64(r.total))
+	color := frameColor(r.opts.Colors, name)
+	if r.opts.Colors == "diff" {
+		info = fmt.Sprintf("%s (%s %s, %.2f%%; %+.2f%%)", name, formatCount(node.Value), r.opts.CountName, 100*float64(node.Value)/float64(r.total), 100*float64(node.Delta)/float64(r.total))
+		color = diffFrameColor(node.Delta, r.maxDelta)
+	}
+	r.printf("<g>\n<title>%s</title><rect x=\"%.1f\" y=\"%.1f\" width=\"%.1f\" height=\"%.1f\" fill=\"%s\" rx=\"2\" ry=\"2\"/>\n<text x=\"%.2f\" y=\"%.1f\">%s</text>\n</g>\n",
+		html.EscapeString(info), x, y, width, height, color,
+		x+3, y+height/2+4, html.EscapeString(fitFrameText(name, width)),
+	)
+	childOffset := offset
+	for _, child := range node.sortedChildren() {
+		r.writeFrame(child.Name, child, depth+1, childOffset, widthPerValue)
+		childOffset += child.Value
+	}
+}
+
+// fitFrameText truncate function name to frame width
+func fitFrameText(name string, width float64) string {
+	chars := int(width / (svgFontSize * svgFontWidth))
+	if chars < 3 {
+		return ""
+	}
+	runes := []rune(name)
+	if len(runes) <= chars {
+		return name
+	}
+	return string(runes[:chars-2]) + ".."
+}
+
+// frameColor return deterministic color for frame name, palettes the same as flamegraph.pl --hash
+func frameColor(palette, name string) string {
+	if name == "" || name == "-" || name == "--" {
+		return "rgb(160,160,160)"
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(name))
+	sum := h.Sum32()
+	v1 := float64(sum&0xff) / 255
+	v2 := float64((sum>>8)&0xff) / 255
+	v3 := float64((sum>>16)&0xff) / 255
+	switch palette {
+	case "mem":
+		return fmt.Sprintf("rgb(%d,%d,%d)", 0, 190+int(50*v2), int(210*v1))
+	case "io":
+		return fmt.Sprintf("rgb(%d,%d,%d)", 80+int(60*v1), 80+int(60*v1), 190+int(55*v2))
+	default:
+		return fmt.Sprintf("rgb(%d,%d,%d)", 205+int(50*v3), int(230*v1), int(55*v2))
+	}
+}
+
+// diffFrameColor return red for grown frames and blue for shrunk frames, intensity depends on delta
+func diffFrameColor(delta, maxDelta int64) string {
+	if delta == 0 || maxDelta == 0 {
+		return "rgb(250,250,250)"
+	}
+	if delta > 0 {
+		c := int(210 * (1 - float64(delta)/float64(maxDelta)))
+		return fmt.Sprintf("rgb(255,%d,%d)", c, c)
+	}
+	c := int(210 * (1 - float64(-delta)/float64(maxDelta)))
+	return fmt.Sprintf("rgb(%d,%d,255)", c, c)
+}
+
+// formatCount format number with thousands separator
+func formatCount(value uint64) string {
+	s := strconv.FormatUint(value, 10)
+	if len(s) <= 3 {
+		return s
+	}
+	var b strings.Builder
+	pre := len(s) % 3
+	if pre > 0 {
+		b.WriteString(s[:pre])
+	}
+	for i := pre; i < len(s); i += 3 {
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(s[i : i+3])
+	}
+	return b.String()
+}
+
+const svgHeader = `<?xml version="1.0" standalone="no"?>
+<!DOCTYPE svg PUBLIC "-//W3C//DTD SVG 1.1//EN" "http://www.w3.org/Graphics/SVG/1.1/DTD/svg11.dtd">
+<svg version="1.1" width="%d" height="%d" onload="init(evt)" viewBox="0 0 %d %d" xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink">
+<defs>
+	<linearGradient id="background" y1="0" y2="1" x1="0" x2="0" >
+		<stop stop-color="#eeeeee" offset="5%%" />
+		<stop stop-color="#eeeeb0" offset="95%%" />
+	</linearGradient>
+</defs>
+`
+
+const svgStyle = `<style type="text/css">
+	text { font-family:Verdana; font-size:%dpx; fill:rgb(0,0,0); }
+	#search, #ignorecase { opacity:0.1; cursor:pointer; }
+	#search:hover, #search.show, #ignorecase:hover, #ignorecase.show { opacity:1; }
+	#subtitle { text-anchor:middle; font-color:rgb(160,160,160); }
+	#title { text-anchor:middle; font-size:17px}
+	#unzoom { cursor:pointer; }
+	#frames > *:hover { stroke:black; stroke-width:0.5; cursor:pointer; }
+	.hide { display:none; }
+	.parent { opacity:0.5; }
+</style>
+`
+
+// svgScript implements zoom, search and details for frames generated by renderSVG
+const svgScript = `"use strict";
+var details, searchbtn, unzoombtn, matchedtxt, ignorecasebtn, frames, svgwidth;
+var ignorecase = false, searchterm = null;
+function init(evt) {
+	details = document.getElementById("details").firstChild;
+	searchbtn = document.getElementById("search");
+	unzoombtn = document.getElementById("unzoom");
+	matchedtxt = document.getElementById("matched");
+	ignorecasebtn = document.getElementById("ignorecase");
+	frames = document.getElementById("frames");
+	svgwidth = parseFloat(document.getElementsByTagName("svg")[0].getAttribute("width"));
+	for (var i = 0; i < frames.children.length; i++) {
+		var r = frames.children[i].querySelector("rect");
+		r.setAttribute("data-x", r.getAttribute("x"));
+		r.setAttribute("data-width", r.getAttribute("width"));
+	}
+}
+window.addEventListener("click", function(e) {
+	var g = frame_of(e.target);
+	if (g) {
+		zoom(g);
+	} else if (e.target.id == "unzoom") {
+		unzoom();
+	} else if (e.target.id == "search") {
+		search_prompt();
+	} else if (e.target.id == "ignorecase") {
+		ignorecase = !ignorecase;
+		ignorecasebtn.classList.toggle("show", ignorecase);
+		if (searchterm != null) search(searchterm);
+	}
+}, false);
+window.addEventListener("mouseover", function(e) {
+	var g = frame_of(e.target);
+	if (g) details.nodeValue = nametype + " " + g.querySelector("title").firstChild.nodeValue;
+}, false);
+window.addEventListener("mouseout", function(e) {
+	if (frame_of(e.target)) details.nodeValue = " ";
+}, false);
+window.addEventListener("keydown", function(e) {
+	if (e.keyCode === 114 || (e.ctrlKey && e.keyCode === 70)) {
+		e.preventDefault();
+		search_prompt();
+	}
+}, false);
+function frame_of(node) {
+	while (node && node.parentElement) {
+		if (node.parentElement.id == "frames") return node;
+		node = node.parentElement;
+	}
+	return null;
+}
+function frame_name(g) {
+	var title = g.querySelector("title").firstChild.nodeValue;
+	return title.substring(0, title.lastIndexOf(" ("));
+}
+function frame_box(g) {
+	var r = g.querySelector("rect");
+	return {x: parseFloat(r.getAttribute("data-x")), w: parseFloat(r.getAttribute("data-width")), y: parseFloat(r.getAttribute("y"))};
+}
+function fit_text(g, x, w) {
+	var t = g.querySelector("text"), name = frame_name(g);
+	var chars = Math.floor(w / (fontsize * fontwidth));
+	t.setAttribute("x", x + 3);
+	if (chars < 3) {
+		t.textContent = "";
+	} else if (name.length <= chars) {
+		t.textContent = name;
+	} else {
+		t.textContent = name.substring(0, chars - 2) + "..";
+	}
+}
+function zoom(target) {
+	var box = frame_box(target);
+	var ratio = (svgwidth - 2 * xpad) / box.w;
+	unzoombtn.classList.remove("hide");
+	for (var i = 0; i < frames.children.length; i++) {
+		var g = frames.children[i], b = frame_box(g), r = g.querySelector("rect");
+		g.classList.remove("parent", "hide");
+		if (b.y > box.y && b.x <= box.x + 0.0001 && b.x + b.w >= box.x + box.w - 0.0001) {
+			g.classList.add("parent");
+			r.setAttribute("x", xpad);
+			r.setAttribute("width", svgwidth - 2 * xpad);
+			fit_text(g, xpad, svgwidth - 2 * xpad);
+		} else if (b.y <= box.y && b.x >= box.x - 0.0001 && b.x + b.w <= box.x + box.w + 0.0001) {
+			var x = xpad + (b.x - box.x) * ratio, w = b.w * ratio;
+			r.setAttribute("x", x);
+			r.setAttribute("width", w);
+			fit_text(g, x, w);
+		} else {
+			g.classList.add("hide");
+		}
+	}
+	if (searchterm != null) search(searchterm);
+}
+function unzoom() {
+	unzoombtn.classList.add("hide");
+	for (var i = 0; i < frames.children.length; i++) {
+		var g = frames.children[i], b = frame_box(g), r = g.querySelector("rect");
+		g.classList.remove("parent", "hide");
+		r.setAttribute("x", b.x);
+		r.setAttribute("width", b.w);
+		fit_text(g, b.x, b.w);
+	}
+	if (searchterm != null) search(searchterm);
+}
+function search_prompt() {
+	if (searchterm != null) {
+		reset_search();
+		return;
+	}
+	var term = prompt("Enter a search term (regexp allowed, eg: ^DB::)" + (ignorecase ? ", ignoring case" : "") + "\nPress Ctrl-i to toggle case sensitivity", "");
+	if (term != null && term != "") search(term);
+}
+function reset_search() {
+	searchterm = null;
+	searchbtn.classList.remove("show");
+	searchbtn.firstChild.nodeValue = "Search";
+	matchedtxt.classList.add("hide");
+	for (var i = 0; i < frames.children.length; i++) {
+		var r = frames.children[i].querySelector("rect");
+		if (r.hasAttribute("data-fill")) {
+			r.setAttribute("fill", r.getAttribute("data-fill"));
+			r.removeAttribute("data-fill");
+		}
+	}
+}
+function search(term) {
+	var re = new RegExp(term, ignorecase ? "i" : "");
+	reset_search();
+	searchterm = term;
+	var matches = [];
+	for (var i = 0; i < frames.children.length; i++) {
+		var g = frames.children[i], r = g.querySelector("rect");
+		if (g.classList.contains("hide") || !re.test(frame_name(g))) continue;
+		r.setAttribute("data-fill", r.getAttribute("fill"));
+		r.setAttribute("fill", "rgb(230,0,230)");
+		matches.push([parseFloat(r.getAttribute("x")), parseFloat(r.getAttribute("width"))]);
+	}
+	searchbtn.classList.add("show");
+	searchbtn.firstChild.nodeValue = "Reset Search";
+	matches.sort(function(a, b) { return a[0] - b[0]; });
+	var covered = 0, end = -1;
+	for (var j = 0; j < matches.length; j++) {
+		var x = matches[j][0], w = matches[j][1];
+		if (x >= end) {
+			covered += w;
+			end = x + w;
+		} else if (x + w > end) {
+			covered += x + w - end;
+			end = x + w;
+		}
+	}
+	matchedtxt.classList.remove("hide");
+	matchedtxt.firstChild.nodeValue = "Matched: " + (100 * covered / (svgwidth - 2 * xpad)).toFixed(1) + "%";
+}
+`
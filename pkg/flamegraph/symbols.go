@@ -0,0 +1,368 @@
+package flamegraph
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// serverFramesExpr resolve each frame on ClickHouse server, expensive for large time windows
+	serverFramesExpr = "arrayStringConcat(arrayReverse(arrayMap(x -> concat( demangle(addressToSymbol(x)), '#', addressToLine(x) ), trace)), ';')"
+	// rawFramesExpr return addresses as is, resolved via symbolizer
+	rawFramesExpr = "arrayStringConcat(arrayReverse(arrayMap(x -> toString(x), trace)), ';')"
+	// symbolizeBatchSize addresses count resolved by one query, addresses inlined into SQL
+	symbolizeBatchSize = 10000
+)
+
+var (
+	buildIdSQLTemplate = `
+SELECT hostName() AS host_name, buildId() AS build_id, version() AS version
+FROM {from}
+`
+
+	addressesSQLTemplate = `
+SELECT DISTINCT hostName() AS host_name, toString(arrayJoin(trace)) AS address
+FROM {from}
+WHERE {where}
+`
+
+	// loadBaseSQLTemplate return runtime address of main, address - load_base is the same on all hosts with the same binary
+	loadBaseSQLTemplate = `
+SELECT hostName() AS host_name, min(address_begin) AS load_base
+FROM {from}
+WHERE symbol = 'main'
+GROUP BY host_name
+SETTINGS allow_introspection_functions=1
+`
+
+	symbolsSQLTemplate = `
+SELECT toString(arrayJoin([{addresses}]) AS x) AS address, concat( demangle(addressToSymbol(x)), '#', addressToLine(x) ) AS frame
+FROM {from}
+WHERE hostName() = ?
+SETTINGS allow_introspection_functions=1
+`
+)
+
+// DefaultSymbolCacheDir return clickhouse-flamegraph directory inside user cache directory, or inside temporary directory when user cache directory is unknown
+func DefaultSymbolCacheDir() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		cacheDir = os.TempDir()
+	}
+	return filepath.Join(cacheDir, "clickhouse-flamegraph", "symbols")
+}
+
+// symbolCacheMu guard symbol cache files, because serve requests symbolize concurrently with own symbolizer,
+// and the same cache file is read and appended by each of them
+var symbolCacheMu sync.Mutex
+
+// symbolizer resolve raw addresses from system.trace_log only once for each unique address,
+// resolved frames stored into cacheDir/buildId-version.offsets.tsv, so next runs against the same ClickHouse binary don't use server CPU
+type symbolizer struct {
+	cacheDir string
+	// hostBuilds format = hostname -> buildId-version, or hostname -> hostname for Options.SymbolsBinary and hosts without load base, because PIE load address differs between hosts
+	hostBuilds map[string]string
+	// hostLoadBases format = hostname -> load base from loadBaseSQLTemplate, symbols contain offsets from it,
+	// because PIE binary loaded at different address on each host and after each restart, zero when symbols contain raw addresses
+	hostLoadBases map[string]uint64
+	// symbols format = hostBuilds value -> address - load base -> frame
+	symbols map[string]map[string]string
+}
+
+// newSymbolizer fetch build_id and version for each host and resolve all addresses from trace_log JOIN query_log with the same where as stacks,
+// via local Options.SymbolsBinary when set, or via addressToSymbol and addressToLine on server
+func (g *Generator) newSymbolizer(ctx context.Context, filter Filter, traceFrom string, traceFromArgs []interface{}, where string, whereArgs []interface{}) (*symbolizer, error) {
+	s := &symbolizer{
+		hostBuilds:    make(map[string]string),
+		hostLoadBases: make(map[string]uint64),
+		symbols:       make(map[string]map[string]string),
+	}
+	// serverBuildIds format = hostname -> buildId()
+	serverBuildIds := make(map[string]string)
+	oneTable, oneArgs := systemTable(filter, "one")
+	buildIdSQL := formatSQLTemplate(buildIdSQLTemplate, map[string]interface{}{"from": oneTable})
+	err := fetchQuery(ctx, g.db, buildIdSQL, oneArgs, func(r map[string]interface{}) error {
+		hostName := r["host_name"].(string)
+		serverBuildIds[hostName] = r["build_id"].(string)
+		s.hostBuilds[hostName] = unsafeFileNameChars.ReplaceAllString(r["build_id"].(string)+"-"+r["version"].(string), "_")
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// hostAddresses format = hostname -> unique addresses
+	hostAddresses := make(map[string][]string)
+	addressesSQL := formatSQLTemplate(addressesSQLTemplate, map[string]interface{}{
+		"where": where,
+		"from":  traceFrom,
+	})
+	addressesSQL = formatSQLTemplate(addressesSQL, map[string]interface{}{
+		"where": where,
+	})
+	addressesArgs := append(append([]interface{}{}, traceFromArgs...), whereArgs...)
+	err = fetchQuery(ctx, g.db, addressesSQL, addressesArgs, func(r map[string]interface{}) error {
+		hostName := r["host_name"].(string)
+		if _, exists := s.hostBuilds[hostName]; !exists {
+			return errors.Errorf("build_id for hostName = %s not found", hostName)
+		}
+		hostAddresses[hostName] = append(hostAddresses[hostName], r["address"].(string))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if g.symbolsBinary != nil {
+		return s, g.resolveLocal(s, serverBuildIds, hostAddresses)
+	}
+	if err := g.fetchLoadBases(ctx, filter, s); err != nil {
+		return nil, err
+	}
+	return s, g.resolveRemote(ctx, s, oneTable, oneArgs, hostAddresses)
+}
+
+// fetchLoadBases fill hostLoadBases from system.symbols, hosts without load base are resolved separately without cache
+func (g *Generator) fetchLoadBases(ctx context.Context, filter Filter, s *symbolizer) error {
+	exists := false
+	err := fetchQuery(ctx, g.db, "SELECT count() AS cnt FROM system.tables WHERE database='system' AND name='symbols'", nil, func(r map[string]interface{}) error {
+		exists = r["cnt"].(uint64) > 0
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if exists {
+		symbolsTable, symbolsArgs := systemTable(filter, "symbols")
+		loadBaseSQL := formatSQLTemplate(loadBaseSQLTemplate, map[string]interface{}{"from": symbolsTable})
+		err = fetchQuery(ctx, g.db, loadBaseSQL, symbolsArgs, func(r map[string]interface{}) error {
+			s.hostLoadBases[r["host_name"].(string)] = r["load_base"].(uint64)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for hostName := range s.hostBuilds {
+		if _, found := s.hostLoadBases[hostName]; !found {
+			log.Warn().Str("hostName", hostName).Msg("load base not found in system.symbols, symbol cache disabled for host")
+			s.hostBuilds[hostName] = hostName
+		}
+	}
+	return nil
+}
+
+// addressOffset return address - loadBase, formatted the same way as addresses from ClickHouse
+func addressOffset(address string, loadBase uint64) string {
+	if loadBase == 0 {
+		return address
+	}
+	rawAddress, err := strconv.ParseUint(address, 10, 64)
+	if err != nil {
+		return address
+	}
+	return strconv.FormatUint(rawAddress-loadBase, 10)
+}
+
+// resolveLocal resolve addresses for each host via Options.SymbolsBinary, PIE load address detected for each host separately
+func (g *Generator) resolveLocal(s *symbolizer, serverBuildIds map[string]string, hostAddresses map[string][]string) error {
+	for hostName, addresses := range hostAddresses {
+		if !g.symbolsBinary.matchBuildId(serverBuildIds[hostName]) {
+			log.Warn().Str("hostName", hostName).Str("serverBuildId", serverBuildIds[hostName]).Str("binaryBuildId", g.symbolsBinary.buildId).Msg("symbols-binary build_id doesn't match server, frames will be wrong")
+		}
+		rawAddresses := make([]uint64, 0, len(addresses))
+		for _, address := range addresses {
+			rawAddress, err := strconv.ParseUint(address, 10, 64)
+			if err != nil {
+				return errors.Wrapf(err, "invalid address = %s", address)
+			}
+			rawAddresses = append(rawAddresses, rawAddress)
+		}
+		base := g.opts.SymbolsBaseAddress
+		if base == 0 {
+			var err error
+			if base, err = g.symbolsBinary.detectBase(rawAddresses); err != nil {
+				return errors.Wrapf(err, "hostName = %s", hostName)
+			}
+		}
+		frames, err := g.symbolsBinary.resolve(rawAddresses, base)
+		if err != nil {
+			return err
+		}
+		s.hostBuilds[hostName] = hostName
+		s.symbols[hostName] = make(map[string]string, len(frames))
+		for rawAddress, frame := range frames {
+			s.symbols[hostName][strconv.FormatUint(rawAddress, 10)] = frame
+		}
+		log.Info().Str("hostName", hostName).Int("addresses", len(addresses)).Str("base", fmt.Sprintf("%#x", base)).Msg("symbolize addresses via symbols-binary")
+	}
+	return nil
+}
+
+// resolveRemote resolve addresses not found in cache via addressToSymbol and addressToLine, only once for hosts with the same binary,
+// cache contains offsets from load base, and addresses resolved on one host are converted to its own load base
+func (g *Generator) resolveRemote(ctx context.Context, s *symbolizer, oneTable string, oneArgs []interface{}, hostAddresses map[string][]string) error {
+	s.cacheDir = g.opts.SymbolCacheDir
+	if s.cacheDir == "" {
+		s.cacheDir = DefaultSymbolCacheDir()
+	}
+	if err := os.MkdirAll(s.cacheDir, 0755); err != nil {
+		return errors.Wrapf(err, "can't create symbol-cache-dir = %s", s.cacheDir)
+	}
+	// unresolved format = buildId-version -> offsets not found in cache, resolvedOn format = buildId-version -> hostname
+	unresolved := make(map[string]map[string]bool)
+	resolvedOn := make(map[string]string)
+	totalAddresses := 0
+	for hostName, addresses := range hostAddresses {
+		build, loadBase := s.hostBuilds[hostName], s.hostLoadBases[hostName]
+		if _, loaded := s.symbols[build]; !loaded {
+			symbols := make(map[string]string)
+			if build != hostName {
+				var err error
+				if symbols, err = s.loadCache(build); err != nil {
+					return err
+				}
+			}
+			s.symbols[build] = symbols
+		}
+		totalAddresses += len(addresses)
+		for _, address := range addresses {
+			offset := addressOffset(address, loadBase)
+			if _, cached := s.symbols[build][offset]; cached {
+				continue
+			}
+			if _, exists := unresolved[build]; !exists {
+				unresolved[build] = make(map[string]bool)
+				resolvedOn[build] = hostName
+			}
+			unresolved[build][offset] = true
+		}
+	}
+
+	resolvedAddresses := 0
+	for build, unresolvedAddresses := range unresolved {
+		hostName, loadBase := resolvedOn[build], s.hostLoadBases[resolvedOn[build]]
+		// offsets converted back to addresses of hostName
+		addresses := make([]string, 0, len(unresolvedAddresses))
+		offsets := make(map[string]string, len(unresolvedAddresses))
+		for offset := range unresolvedAddresses {
+			address := offset
+			if loadBase != 0 {
+				rawOffset, err := strconv.ParseUint(offset, 10, 64)
+				if err != nil {
+					return errors.Wrapf(err, "invalid address = %s", offset)
+				}
+				address = strconv.FormatUint(rawOffset+loadBase, 10)
+			}
+			addresses = append(addresses, address)
+			offsets[address] = offset
+		}
+		for start := 0; start < len(addresses); start += symbolizeBatchSize {
+			end := min(start+symbolizeBatchSize, len(addresses))
+			// addresses are UInt64 formatted by ClickHouse, so safe to inline
+			symbolsSQL := formatSQLTemplate(symbolsSQLTemplate, map[string]interface{}{
+				"addresses": strings.Join(addresses[start:end], ","),
+				"from":      oneTable,
+			})
+			resolved := make(map[string]string, end-start)
+			err := fetchQuery(ctx, g.db, symbolsSQL, append(append([]interface{}{}, oneArgs...), hostName), func(r map[string]interface{}) error {
+				// frames can't contain tab and new line, because they are stored in tsv cache file
+				resolved[offsets[r["address"].(string)]] = strings.NewReplacer("\t", " ", "\n", " ").Replace(r["frame"].(string))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if build != hostName {
+				if err := s.saveCache(build, resolved); err != nil {
+					return err
+				}
+			}
+			for address, frame := range resolved {
+				s.symbols[build][address] = frame
+			}
+			resolvedAddresses += len(resolved)
+		}
+	}
+	log.Info().Int("addresses", totalAddresses).Int("resolvedAddresses", resolvedAddresses).Str("symbolCacheDir", s.cacheDir).Msg("symbolize addresses")
+	return nil
+}
+
+func (s *symbolizer) cacheFileName(build string) string {
+	// raw addresses were stored in build.tsv before, they are wrong for PIE binary, so file name changed
+	return filepath.Join(s.cacheDir, build+".offsets.tsv")
+}
+
+// loadCache read "offset\tframe" lines, empty map when cache file doesn't exist
+func (s *symbolizer) loadCache(build string) (map[string]string, error) {
+	symbolCacheMu.Lock()
+	defer symbolCacheMu.Unlock()
+	symbols := make(map[string]string)
+	fileName := s.cacheFileName(build)
+	f, err := os.Open(fileName)
+	if os.IsNotExist(err) {
+		return symbols, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "can't open %s", fileName)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		address, frame, found := strings.Cut(scanner.Text(), "\t")
+		if found {
+			symbols[address] = frame
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrapf(err, "can't read %s", fileName)
+	}
+	log.Debug().Str("fileName", fileName).Int("symbols", len(symbols)).Msg("load symbol cache")
+	return symbols, nil
+}
+
+// saveCache append resolved frames to cache file, all lines written by one write call, so concurrent readers and other processes don't see interleaved lines
+func (s *symbolizer) saveCache(build string, resolved map[string]string) error {
+	var buf bytes.Buffer
+	for address, frame := range resolved {
+		fmt.Fprintf(&buf, "%s\t%s\n", address, frame)
+	}
+	symbolCacheMu.Lock()
+	defer symbolCacheMu.Unlock()
+	fileName := s.cacheFileName(build)
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "can't open %s", fileName)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		_ = f.Close()
+		return errors.Wrapf(err, "can't write %s", fileName)
+	}
+	return errors.Wrapf(f.Close(), "can't close %s", fileName)
+}
+
+// symbolize replace raw addresses after first trace_type or allocate/free frame
+func (s *symbolizer) symbolize(hostName, frames string) string {
+	traceTypeFrame, rest, found := strings.Cut(frames, ";")
+	if !found {
+		return frames
+	}
+	symbols, loadBase := s.symbols[s.hostBuilds[hostName]], s.hostLoadBases[hostName]
+	addresses := strings.Split(rest, ";")
+	for i, address := range addresses {
+		if frame, resolved := symbols[addressOffset(address, loadBase)]; resolved {
+			addresses[i] = frame
+		}
+	}
+	return traceTypeFrame + ";" + strings.Join(addresses, ";")
+}
@@ -0,0 +1,231 @@
+package flamegraph
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// pieDriver answer symbolsSQLTemplate queries the same way as server with PIE binary loaded at hostLoadBases
+type pieDriver struct {
+	hostLoadBases map[string]uint64
+	// frames format = offset -> frame
+	frames map[uint64]string
+	// queries contains hostName argument of each query
+	queries []string
+}
+
+type pieConn struct{ d *pieDriver }
+type pieStmt struct {
+	d     *pieDriver
+	query string
+}
+type pieRows struct {
+	rows [][]driver.Value
+	i    int
+}
+
+var pieAddresses = regexp.MustCompile(`arrayJoin\(\[([0-9,]+)\]\)`)
+
+func (d *pieDriver) Open(string) (driver.Conn, error) { return pieConn{d}, nil }
+func (c pieConn) Prepare(query string) (driver.Stmt, error) {
+	return &pieStmt{d: c.d, query: query}, nil
+}
+func (c pieConn) Close() error              { return nil }
+func (c pieConn) Begin() (driver.Tx, error) { return nil, io.EOF }
+func (s *pieStmt) Close() error             { return nil }
+func (s *pieStmt) NumInput() int            { return -1 }
+func (s *pieStmt) Exec([]driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(0), nil
+}
+func (s *pieStmt) Query(args []driver.Value) (driver.Rows, error) {
+	hostName := args[len(args)-1].(string)
+	s.d.queries = append(s.d.queries, hostName)
+	rows := &pieRows{}
+	for _, address := range strings.Split(pieAddresses.FindStringSubmatch(s.query)[1], ",") {
+		rawAddress, _ := strconv.ParseUint(address, 10, 64)
+		frame, exists := s.d.frames[rawAddress-s.d.hostLoadBases[hostName]]
+		if !exists {
+			frame = "??"
+		}
+		rows.rows = append(rows.rows, []driver.Value{address, frame})
+	}
+	return rows, nil
+}
+func (r *pieRows) Columns() []string { return []string{"address", "frame"} }
+func (r *pieRows) Close() error      { return nil }
+func (r *pieRows) Next(dest []driver.Value) error {
+	if r.i >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.i])
+	r.i++
+	return nil
+}
+
+func TestAddressOffset(t *testing.T) {
+	testCases := []struct {
+		address  string
+		loadBase uint64
+		expected string
+	}{
+		{"4096", 0, "4096"},
+		{"94000000004096", 94000000000000, "4096"},
+		{"not_address", 10, "not_address"},
+	}
+	for _, tc := range testCases {
+		if actual := addressOffset(tc.address, tc.loadBase); actual != tc.expected {
+			t.Errorf("addressOffset(%s, %d) expected %s, got %s", tc.address, tc.loadBase, tc.expected, actual)
+		}
+	}
+}
+
+// TestResolveRemotePIE check addresses from different hosts with the same binary resolved once, and cache is valid after restart with another load base
+func TestResolveRemotePIE(t *testing.T) {
+	d := &pieDriver{
+		hostLoadBases: map[string]uint64{"host1": 0x550000000000, "host2": 0x560000000000},
+		frames:        map[uint64]string{0x1000: "foo#a.cpp:1", 0x2000: "bar#a.cpp:2"},
+	}
+	sql.Register("pie-"+t.Name(), d)
+	db, err := sql.Open("pie-"+t.Name(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cacheDir := t.TempDir()
+	g := &Generator{opts: Options{SymbolCacheDir: cacheDir}, db: db}
+
+	address := func(hostName string, offset uint64) string {
+		return strconv.FormatUint(d.hostLoadBases[hostName]+offset, 10)
+	}
+	newSymbolizer := func() *symbolizer {
+		s := &symbolizer{
+			hostBuilds:    map[string]string{"host1": "build-24.8", "host2": "build-24.8"},
+			hostLoadBases: map[string]uint64{"host1": d.hostLoadBases["host1"], "host2": d.hostLoadBases["host2"]},
+			symbols:       make(map[string]map[string]string),
+		}
+		hostAddresses := map[string][]string{
+			"host1": {address("host1", 0x1000)},
+			"host2": {address("host2", 0x1000), address("host2", 0x2000)},
+		}
+		if err := g.resolveRemote(context.Background(), s, "system.one", nil, hostAddresses); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	s := newSymbolizer()
+	if len(d.queries) != 1 {
+		t.Fatalf("expected one query for the same build, got %v", d.queries)
+	}
+	expected := "CPU;foo#a.cpp:1;bar#a.cpp:2"
+	for _, hostName := range []string{"host1", "host2"} {
+		if actual := s.symbolize(hostName, "CPU;"+address(hostName, 0x1000)+";"+address(hostName, 0x2000)); actual != expected {
+			t.Errorf("%s expected %s, got %s", hostName, expected, actual)
+		}
+	}
+
+	// restart with new load address, all offsets already cached
+	d.hostLoadBases["host1"], d.hostLoadBases["host2"] = 0x570000000000, 0x580000000000
+	d.queries = nil
+	s = newSymbolizer()
+	if len(d.queries) != 0 {
+		t.Fatalf("expected all addresses in cache, got queries %v", d.queries)
+	}
+	for _, hostName := range []string{"host1", "host2"} {
+		if actual := s.symbolize(hostName, "CPU;"+address(hostName, 0x1000)+";"+address(hostName, 0x2000)); actual != expected {
+			t.Errorf("%s after restart expected %s, got %s", hostName, expected, actual)
+		}
+	}
+	if _, err := os.Stat(s.cacheFileName("build-24.8")); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestResolveRemoteWithoutLoadBase check hosts without system.symbols resolved separately and not cached
+func TestResolveRemoteWithoutLoadBase(t *testing.T) {
+	d := &pieDriver{
+		hostLoadBases: map[string]uint64{"host1": 0x550000000000, "host2": 0x560000000000},
+		frames:        map[uint64]string{0x1000: "foo#a.cpp:1"},
+	}
+	sql.Register("pie-"+t.Name(), d)
+	db, err := sql.Open("pie-"+t.Name(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	cacheDir := t.TempDir()
+	g := &Generator{opts: Options{SymbolCacheDir: cacheDir}, db: db}
+	s := &symbolizer{
+		hostBuilds:    map[string]string{"host1": "host1", "host2": "host2"},
+		hostLoadBases: map[string]uint64{},
+		symbols:       make(map[string]map[string]string),
+	}
+	host1Address, host2Address := strconv.FormatUint(0x550000001000, 10), strconv.FormatUint(0x560000001000, 10)
+	hostAddresses := map[string][]string{"host1": {host1Address}, "host2": {host2Address}}
+	if err := g.resolveRemote(context.Background(), s, "system.one", nil, hostAddresses); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.queries) != 2 {
+		t.Errorf("expected query for each host, got %v", d.queries)
+	}
+	for hostName, address := range map[string]string{"host1": host1Address, "host2": host2Address} {
+		if actual := s.symbolize(hostName, "CPU;"+address); actual != "CPU;foo#a.cpp:1" {
+			t.Errorf("%s expected CPU;foo#a.cpp:1, got %s", hostName, actual)
+		}
+	}
+	if entries, _ := os.ReadDir(cacheDir); len(entries) != 0 {
+		t.Errorf("expected empty cache, got %d files", len(entries))
+	}
+}
+
+// TestSymbolCacheConcurrent check concurrent serve requests don't interleave cache lines of the same build
+func TestSymbolCacheConcurrent(t *testing.T) {
+	const writers, symbolsPerWriter = 8, 500
+	cacheDir := t.TempDir()
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			resolved := make(map[string]string, symbolsPerWriter)
+			for j := 0; j < symbolsPerWriter; j++ {
+				resolved[strconv.Itoa(i*symbolsPerWriter+j)] = strings.Repeat("DB::Frame", 50) + strconv.Itoa(i)
+			}
+			errs <- (&symbolizer{cacheDir: cacheDir}).saveCache("build", resolved)
+		}(i)
+		go func() {
+			defer wg.Done()
+			_, err := (&symbolizer{cacheDir: cacheDir}).loadCache("build")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	symbols, err := (&symbolizer{cacheDir: cacheDir}).loadCache("build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(symbols) != writers*symbolsPerWriter {
+		t.Fatalf("expected %d symbols, got %d", writers*symbolsPerWriter, len(symbols))
+	}
+	for address, frame := range symbols {
+		i, err := strconv.Atoi(address)
+		if err != nil || frame != strings.Repeat("DB::Frame", 50)+strconv.Itoa(i/symbolsPerWriter) {
+			t.Fatalf("interleaved cache line %s\t%s", address, frame)
+		}
+	}
+}
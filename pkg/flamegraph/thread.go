@@ -0,0 +1,85 @@
+package flamegraph
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// GroupByQuery one profile for each query_id, default
+	GroupByQuery = "query"
+	// GroupByThread one profile for each query_id and thread, global profiles split by thread name
+	GroupByThread = "thread"
+	// GroupByThreadRoot one profile for each query_id, thread name and thread_id added as frame after trace_type frame
+	GroupByThreadRoot = "thread-root"
+)
+
+func validateGroupBy(groupBy string) error {
+	if groupBy != "" && groupBy != GroupByQuery && groupBy != GroupByThread && groupBy != GroupByThreadRoot {
+		return errors.Errorf("unsupported group-by = %s, accept values: %s, %s, %s", groupBy, GroupByQuery, GroupByThread, GroupByThreadRoot)
+	}
+	return nil
+}
+
+// threadNameJoin return JOIN with system.query_thread_log for resolve thread_id into thread_name,
+// empty when query_thread_log is disabled on server, event_time is thread finish time, so only lower bound applied
+func (g *Generator) threadNameJoin(ctx context.Context, filter Filter) (string, []interface{}, error) {
+	exists := false
+	err := fetchQuery(ctx, g.db, "SELECT count() AS cnt FROM system.tables WHERE database='system' AND name='query_thread_log'", nil, func(r map[string]interface{}) error {
+		exists = r["cnt"].(uint64) > 0
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if !exists {
+		log.Warn().Msg("system.query_thread_log doesn't exist, enable log_query_threads setting for resolve thread names")
+		return "", nil, nil
+	}
+	queryThreadLogTable, threadArgs := systemTable(filter, "query_thread_log")
+	// other query_log filters already applied to trace_log JOIN query_log, query_thread_log contains only part of query_log columns
+	threadWhere, threadArgs := addWhereArgs("", "event_time >= ?", threadArgs, filter.DateFrom)
+	if len(filter.QueryIds) != 0 {
+		queryIdsIn, queryIdsArgs := inPlaceholders(filter.QueryIds)
+		threadWhere, threadArgs = addWhereArgs(threadWhere, " AND query_id IN "+queryIdsIn, threadArgs, queryIdsArgs...)
+	}
+	threadJoin := " ANY LEFT JOIN (SELECT query_id, thread_id, any(thread_name) AS thread_name FROM " + queryThreadLogTable + " WHERE " + threadWhere + " GROUP BY query_id, thread_id) AS th ON th.query_id=t.query_id AND th.thread_id=t.thread_id"
+	return threadJoin, threadArgs, nil
+}
+
+// threadFrameName return "thread_name [thread_id]", thread_name is "thread" when not resolved
+func threadFrameName(threadName string, threadId uint64) string {
+	if threadName == "" {
+		threadName = "thread"
+	}
+	return fmt.Sprintf("%s [%d]", threadName, threadId)
+}
+
+// addThreadFrame insert thread frame after first trace_type or allocate/free frame
+func addThreadFrame(frames, threadName string, threadId uint64) string {
+	traceTypeFrame, rest, found := strings.Cut(frames, ";")
+	if !found {
+		return frames + ";" + threadFrameName(threadName, threadId)
+	}
+	return traceTypeFrame + ";" + threadFrameName(threadName, threadId) + ";" + rest
+}
+
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// threadProfileName used in file names, query profiles split by thread_id, global profiles split by thread name only,
+// because the same thread from pool executes different queries
+func threadProfileName(threadName string, threadId uint64, global bool) string {
+	if threadName == "" {
+		threadName = "thread"
+	}
+	threadName = unsafeFileNameChars.ReplaceAllString(threadName, "_")
+	if global {
+		return threadName
+	}
+	return fmt.Sprintf("%s_%d", threadName, threadId)
+}
@@ -0,0 +1,103 @@
+package flamegraph
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// RankByCPU rank queries by CPU samples count, default
+	RankByCPU = "cpu"
+	// RankByReal rank queries by Real samples count, includes time waiting for IO and locks
+	RankByReal = "real"
+	// RankByMemory rank queries by allocated and freed bytes from Memory and MemorySample trace types
+	RankByMemory = "memory"
+)
+
+var topQueriesSQLTemplate = `
+SELECT {queryIdField}, {rankValue} AS rank_value
+FROM {from}
+WHERE {where} AND t.query_id != ''
+GROUP BY query_id
+ORDER BY rank_value DESC, query_id
+LIMIT {limit}
+`
+
+func validateRankBy(rankBy string) error {
+	if rankBy != "" && rankBy != RankByCPU && rankBy != RankByReal && rankBy != RankByMemory {
+		return errors.Errorf("unsupported rank-by = %s, accept values: %s, %s, %s", rankBy, RankByCPU, RankByReal, RankByMemory)
+	}
+	return nil
+}
+
+// TopQueries return up to n query_id, or normalized query hashes when Filter.NormalizeQuery, with the most samples or bytes in system.trace_log,
+// Filter.TraceTypes ignored, trace types defined by rankBy
+func (g *Generator) TopQueries(ctx context.Context, filter Filter, n int, rankBy string) ([]string, error) {
+	if err := validateRankBy(rankBy); err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, errors.Errorf("invalid top = %d, shall be greater than 0", n)
+	}
+	filter = g.inServerTimeZone(filter)
+	if err := validateCluster(ctx, g.db, filter.Cluster); err != nil {
+		return nil, err
+	}
+	traceTypes, rankValue := []string{"CPU"}, "count()"
+	switch rankBy {
+	case RankByReal:
+		traceTypes = []string{"Real"}
+	case RankByMemory:
+		traceTypes, rankValue = []string{"Memory", "MemorySample"}, "sum(abs(size))"
+	}
+	filter.TraceTypes = traceTypes
+	if g.dump != nil {
+		return g.dump.topQueries(filter, traceTypes, n, rankBy)
+	}
+	traceFrom, traceFromArgs, where, whereArgs, queryIdField, err := traceLogSource(filter, traceTypes)
+	if err != nil {
+		return nil, err
+	}
+	topSQL := formatSQLTemplate(topQueriesSQLTemplate, map[string]interface{}{
+		"where":        where,
+		"from":         traceFrom,
+		"queryIdField": queryIdField,
+		"rankValue":    rankValue,
+		"limit":        "?",
+	})
+	topSQL = formatSQLTemplate(topSQL, map[string]interface{}{
+		"where": where,
+	})
+	topArgs := append(traceFromArgs, whereArgs...)
+	topArgs = append(topArgs, n)
+
+	var queryIds []string
+	err = fetchQuery(ctx, g.db, topSQL, topArgs, func(r map[string]interface{}) error {
+		queryIds = append(queryIds, r["query_id"].(string))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Int("top", n).Str("rankBy", rankBy).Str("queryIds", strings.Join(queryIds, ",")).Msg("rank queries")
+	return queryIds, nil
+}
+
+// topQueriesSet return nil when Options.Top is not set, it means all queries shall be written
+func (g *Generator) topQueriesSet(ctx context.Context, filter Filter) (map[string]bool, error) {
+	if g.opts.Top <= 0 {
+		return nil, nil
+	}
+	queryIds, err := g.TopQueries(ctx, filter, g.opts.Top, g.opts.RankBy)
+	if err != nil {
+		return nil, err
+	}
+	topSet := make(map[string]bool, len(queryIds))
+	for _, queryId := range queryIds {
+		topSet[queryId] = true
+	}
+	return topSet, nil
+}
@@ -0,0 +1,103 @@
+package flamegraph
+
+import (
+	"context"
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testTopTraceLog = `hostname	event_time	query_id	trace_type	thread_id	size	trace	symbols	lines
+host1	2026-10-01 10:00:00	q1	CPU	1	0	[1]	['main']	['a.cpp:1']
+host1	2026-10-01 10:00:01	q1	CPU	1	0	[1]	['main']	['a.cpp:1']
+host1	2026-10-01 10:00:00	q2	CPU	1	0	[1]	['main']	['a.cpp:1']
+host2	2026-10-01 10:00:01	q2	CPU	1	0	[1]	['main']	['a.cpp:1']
+host1	2026-10-01 10:00:02	q2	CPU	1	0	[1]	['main']	['a.cpp:1']
+host1	2026-10-01 10:00:00	q0	CPU	1	0	[1]	['main']	['a.cpp:1']
+host1	2026-10-01 10:00:01	q0	CPU	1	0	[1]	['main']	['a.cpp:1']
+host1	2026-10-01 10:00:00	q3	CPU	1	0	[1]	['main']	['a.cpp:1']
+host1	2026-10-01 10:00:00	q3	Real	1	0	[1]	['main']	['a.cpp:1']
+host1	2026-10-01 10:00:01	q3	Real	1	0	[1]	['main']	['a.cpp:1']
+host1	2026-10-01 10:00:00		CPU	1	0	[1]	['main']	['a.cpp:1']
+host1	2026-10-01 10:00:01		CPU	1	0	[1]	['main']	['a.cpp:1']
+host1	2026-10-01 10:00:02		CPU	1	0	[1]	['main']	['a.cpp:1']
+host1	2026-10-01 10:00:03		CPU	1	0	[1]	['main']	['a.cpp:1']
+host1	2026-10-01 10:00:00	q1	MemorySample	1	100	[1]	['main']	['a.cpp:1']
+host1	2026-10-01 10:00:01	q1	MemorySample	1	-100	[1]	['main']	['a.cpp:1']
+host1	2026-10-01 10:00:00	q2	Memory	1	150	[1]	['main']	['a.cpp:1']
+`
+
+// TestTopQueriesImport check queries ordered by rank descending, ties ordered by query_id, samples without query_id are not ranked
+func TestTopQueriesImport(t *testing.T) {
+	g, err := NewImportGenerator(Options{OutputDir: t.TempDir()}, ImportOptions{TraceLogFiles: []string{writeTestFile(t, "host1.tsv", testTopTraceLog)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		n        int
+		rankBy   string
+		expected []string
+	}{
+		{n: 10, rankBy: "", expected: []string{"q2", "q0", "q1", "q3"}},
+		{n: 10, rankBy: RankByCPU, expected: []string{"q2", "q0", "q1", "q3"}},
+		{n: 2, rankBy: RankByCPU, expected: []string{"q2", "q0"}},
+		{n: 3, rankBy: RankByCPU, expected: []string{"q2", "q0", "q1"}},
+		{n: 10, rankBy: RankByReal, expected: []string{"q3"}},
+		// freed bytes counted as absolute values
+		{n: 10, rankBy: RankByMemory, expected: []string{"q1", "q2"}},
+	}
+	for _, tc := range testCases {
+		actual, err := g.TopQueries(context.Background(), g.Options().Filter, tc.n, tc.rankBy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("top = %d, rank-by = %s expected %v, got %v", tc.n, tc.rankBy, tc.expected, actual)
+		}
+	}
+	for _, tc := range []struct {
+		n      int
+		rankBy string
+	}{{0, RankByCPU}, {-1, RankByCPU}, {1, "bytes"}} {
+		if _, err := g.TopQueries(context.Background(), g.Options().Filter, tc.n, tc.rankBy); err == nil {
+			t.Errorf("top = %d, rank-by = %s expected error", tc.n, tc.rankBy)
+		}
+	}
+}
+
+// TestTopQueriesSQL check server ranking SQL, ties ordered by query_id, and server order kept
+func TestTopQueriesSQL(t *testing.T) {
+	testCases := []struct {
+		rankBy     string
+		traceTypes string
+		rankValue  string
+	}{
+		{rankBy: RankByCPU, traceTypes: "trace_type IN ('CPU')", rankValue: "count() AS rank_value"},
+		{rankBy: RankByReal, traceTypes: "trace_type IN ('Real')", rankValue: "count() AS rank_value"},
+		{rankBy: RankByMemory, traceTypes: "trace_type IN ('Memory','MemorySample')", rankValue: "sum(abs(size)) AS rank_value"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.rankBy, func(t *testing.T) {
+			g, ch := newFakeGenerator(t, Options{}, time.UTC, func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+				return []string{"query_id", "rank_value"}, [][]driver.Value{{"q2", uint64(3)}, {"q0", uint64(2)}, {"q1", uint64(2)}}
+			})
+			filter := Filter{TraceTypes: []string{"CPU"}, DateFrom: time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC), DateTo: time.Date(2026, 10, 1, 11, 0, 0, 0, time.UTC)}
+			actual, err := g.TopQueries(context.Background(), filter, 3, tc.rankBy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := []string{"q2", "q0", "q1"}; !reflect.DeepEqual(actual, expected) {
+				t.Errorf("expected %v, got %v", expected, actual)
+			}
+			q := ch.findQuery(t, "rank_value")
+			sql := interpolateSQL(q.sql, q.args)
+			for _, expected := range []string{tc.traceTypes, tc.rankValue, "t.query_id != ''", "ORDER BY rank_value DESC, query_id\nLIMIT 3\n"} {
+				if !strings.Contains(sql, expected) {
+					t.Errorf("expected %s in:\n%s", expected, sql)
+				}
+			}
+		})
+	}
+}
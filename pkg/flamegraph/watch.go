@@ -0,0 +1,112 @@
+package flamegraph
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// watchDirLayout is time.Format layout for run subdirectory name, window end time in UTC
+const watchDirLayout = "20060102T150405Z"
+
+// WatchOptions contains schedule and retention parameters for Generator.Watch
+type WatchOptions struct {
+	// Interval between runs, window end aligned to interval boundary from unix epoch, shall be whole seconds
+	Interval time.Duration
+	// Window length of each run, Interval when not set
+	Window time.Duration
+	// RetentionCount keep only N latest run subdirectories, 0 means unlimited
+	RetentionCount int
+	// RetentionAge remove run subdirectories with window end older than age, 0 means unlimited
+	RetentionAge time.Duration
+}
+
+// Watch run Generate every WatchOptions.Interval until ctx canceled, each run write into outputDir/windowEnd subdirectory,
+// window end aligned to interval boundary, window start is end - WatchOptions.Window, Options.DateFrom and Options.DateTo ignored,
+// failed runs logged and don't stop watching
+func (g *Generator) Watch(ctx context.Context, w WatchOptions) error {
+	if w.Interval <= 0 || w.Interval%time.Second != 0 {
+		return errors.Errorf("invalid interval = %s, shall be whole seconds greater than 0", w.Interval)
+	}
+	if w.Window <= 0 {
+		w.Window = w.Interval
+	}
+	if w.RetentionCount < 0 || w.RetentionAge < 0 {
+		return errors.Errorf("invalid retention-count = %d or retention-age = %s, shall be 0 or greater", w.RetentionCount, w.RetentionAge)
+	}
+	// SYSTEM FLUSH LOGS at most once per flush interval, the same as serve, when interval is shorter
+	flusher := &logFlusher{interval: systemLogFlushInterval, flush: g.FlushLogs}
+	for {
+		windowEnd := bucketStart(time.Now(), w.Interval)
+		if err := g.watchRun(ctx, flusher, windowEnd.Add(-w.Window), windowEnd); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Error().Err(err).Time("dateTo", windowEnd).Msg("watch run failed")
+		}
+		if err := g.applyRetention(w, time.Now()); err != nil {
+			log.Error().Err(err).Msg("watch retention failed")
+		}
+		nextRun := windowEnd.Add(w.Interval)
+		log.Info().Time("nextRun", nextRun).Msg("watch wait")
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Until(nextRun)):
+		}
+	}
+}
+
+// watchRun generate flamegraphs for one window into outputDir/windowEnd
+func (g *Generator) watchRun(ctx context.Context, flusher *logFlusher, dateFrom, dateTo time.Time) error {
+	run := *g
+	run.flusher = flusher
+	run.opts.DateFrom, run.opts.DateTo = dateFrom, dateTo
+	run.opts.OutputDir = filepath.Join(g.opts.OutputDir, dateTo.UTC().Format(watchDirLayout))
+	log.Info().Time("dateFrom", dateFrom).Time("dateTo", dateTo).Str("outputDir", run.opts.OutputDir).Msg("watch run")
+	return run.Generate(ctx)
+}
+
+// applyRetention remove run subdirectories beyond WatchOptions.RetentionCount and older than WatchOptions.RetentionAge,
+// only subdirectories with watchDirLayout names are removed
+func (g *Generator) applyRetention(w WatchOptions, now time.Time) error {
+	if w.RetentionCount == 0 && w.RetentionAge == 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(g.opts.OutputDir)
+	if err != nil {
+		return errors.Wrapf(err, "can't read output-dir = %s", g.opts.OutputDir)
+	}
+	type runDir struct {
+		name      string
+		windowEnd time.Time
+	}
+	var runs []runDir
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if windowEnd, err := time.Parse(watchDirLayout, entry.Name()); err == nil {
+			runs = append(runs, runDir{name: entry.Name(), windowEnd: windowEnd})
+		}
+	}
+	// newest first
+	sort.Slice(runs, func(i, j int) bool { return runs[i].windowEnd.After(runs[j].windowEnd) })
+	for i, run := range runs {
+		expired := (w.RetentionCount > 0 && i >= w.RetentionCount) || (w.RetentionAge > 0 && now.Sub(run.windowEnd) > w.RetentionAge)
+		if !expired {
+			continue
+		}
+		runPath := filepath.Join(g.opts.OutputDir, run.name)
+		if err := os.RemoveAll(runPath); err != nil {
+			return errors.Wrapf(err, "can't remove %s", runPath)
+		}
+		log.Info().Str("dir", runPath).Msg("watch retention remove")
+	}
+	return nil
+}
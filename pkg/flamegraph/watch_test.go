@@ -0,0 +1,88 @@
+package flamegraph
+
+import (
+	"context"
+	"database/sql/driver"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyRetention(t *testing.T) {
+	now := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	runs := []string{"20261001T100000Z", "20261001T095500Z", "20261001T095000Z", "20261001T090000Z"}
+	testCases := []struct {
+		name     string
+		w        WatchOptions
+		expected []string
+	}{
+		{name: "unlimited", w: WatchOptions{}, expected: runs},
+		{name: "count", w: WatchOptions{RetentionCount: 2}, expected: runs[:2]},
+		{name: "age", w: WatchOptions{RetentionAge: 10 * time.Minute}, expected: runs[:3]},
+		{name: "count and age", w: WatchOptions{RetentionCount: 2, RetentionAge: 7 * time.Minute}, expected: runs[:2]},
+		{name: "age before count", w: WatchOptions{RetentionCount: 3, RetentionAge: time.Minute}, expected: runs[:1]},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			outputDir := t.TempDir()
+			// other files and directories in output-dir are not removed
+			for _, name := range append([]string{"custom", "20261001T080000"}, runs...) {
+				if err := os.MkdirAll(filepath.Join(outputDir, name, "host1"), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(filepath.Join(outputDir, "20261001T000000Z"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			g := &Generator{opts: Options{OutputDir: outputDir}}
+			if err := g.applyRetention(tc.w, now); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := os.ReadDir(outputDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var actual []string
+			for _, entry := range entries {
+				actual = append(actual, entry.Name())
+			}
+			expected := append([]string{"20261001T000000Z", "20261001T080000", "custom"}, tc.expected...)
+			sort.Strings(expected)
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("expected %v, got %v", expected, actual)
+			}
+		})
+	}
+}
+
+// TestWatchRunFlushLogs check runs share one logFlusher, so SYSTEM FLUSH LOGS is not repeated inside flush interval
+func TestWatchRunFlushLogs(t *testing.T) {
+	outputDir := t.TempDir()
+	g, ch := newFakeGenerator(t, Options{OutputDir: outputDir, OutputFormat: "txt"}, time.UTC, func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		return nil, nil
+	})
+	flusher := &logFlusher{interval: systemLogFlushInterval, flush: g.FlushLogs}
+	windowEnd := time.Date(2026, 10, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		dateTo := windowEnd.Add(time.Duration(i) * time.Second)
+		if err := g.watchRun(context.Background(), flusher, dateTo.Add(-time.Minute), dateTo); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(filepath.Join(outputDir, dateTo.Format(watchDirLayout))); err != nil {
+			t.Errorf("expected run directory, got %v", err)
+		}
+	}
+	flushes := 0
+	for _, q := range ch.queries {
+		if strings.Contains(q.sql, "SYSTEM FLUSH LOGS") {
+			flushes++
+		}
+	}
+	if flushes != 1 {
+		t.Errorf("expected 1 SYSTEM FLUSH LOGS, got %d", flushes)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Slach/clickhouse-flamegraph/pkg/flamegraph"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+)
+
+func serveCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "serve",
+		Usage: "run HTTP server with web UI, flamegraphs generated on demand, for example /flamegraph?query_id=...&from=-15m&trace_type=CPU&format=svg",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "listen",
+				Usage:   "HTTP server listen address",
+				Sources: cli.EnvVars("CH_FLAME_LISTEN"),
+				Value:   "localhost:8080",
+			},
+		},
+		Action: serve,
+	}
+}
+
+func serve(ctx context.Context, c *cli.Command) error {
+	opts, err := optionsFromCLI(c)
+	if err != nil {
+		return err
+	}
+	g, err := flamegraph.NewGenerator(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	srv := &http.Server{
+		Addr:              c.String("listen"),
+		Handler:           g.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			log.Error().Err(err).Msg("HTTP server shutdown failed")
+		}
+	}()
+	log.Info().Str("listen", srv.Addr).Msg("start HTTP server")
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return errors.Wrap(err, "HTTP server failed")
+	}
+	return nil
+}
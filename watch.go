@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/Slach/clickhouse-flamegraph/pkg/flamegraph"
+	"github.com/urfave/cli/v3"
+)
+
+func watchCommand() *cli.Command {
+	return &cli.Command{
+		Name:  "watch",
+		Usage: "run generate every --interval over sliding window aligned to interval boundaries, each run written into output-dir/YYYYMMDDThhmmssZ subdirectory named by window end, --date-from and --date-to ignored",
+		Flags: []cli.Flag{
+			&cli.DurationFlag{
+				Name:    "interval",
+				Usage:   "time between runs in whole seconds, window end aligned to interval boundary from unix epoch, for example 5m or 1h",
+				Sources: cli.EnvVars("CH_FLAME_WATCH_INTERVAL"),
+				Value:   5 * time.Minute,
+			},
+			&cli.DurationFlag{
+				Name:    "window",
+				Usage:   "window length of each run, the same as --interval when empty, greater value produce overlapped windows",
+				Sources: cli.EnvVars("CH_FLAME_WATCH_WINDOW"),
+			},
+			&cli.IntFlag{
+				Name:    "retention-count",
+				Usage:   "keep only N latest run subdirectories, 0 means unlimited",
+				Sources: cli.EnvVars("CH_FLAME_WATCH_RETENTION_COUNT"),
+			},
+			&cli.DurationFlag{
+				Name:    "retention-age",
+				Usage:   "remove run subdirectories older than age, for example 168h, 0 means unlimited",
+				Sources: cli.EnvVars("CH_FLAME_WATCH_RETENTION_AGE"),
+			},
+		},
+		Action: watch,
+	}
+}
+
+func watch(ctx context.Context, c *cli.Command) error {
+	opts, err := optionsFromCLI(c)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	g, err := flamegraph.NewGenerator(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer g.Close()
+	return g.Watch(ctx, flamegraph.WatchOptions{
+		Interval:       c.Duration("interval"),
+		Window:         c.Duration("window"),
+		RetentionCount: c.Int("retention-count"),
+		RetentionAge:   c.Duration("retention-age"),
+	})
+}